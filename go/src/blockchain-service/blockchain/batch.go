@@ -0,0 +1,81 @@
+package blockchain
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+
+	"github.com/google/trillian/merkle"
+)
+
+//Leaves of a permission marshal publication batch: the published certs followed by the timestamp leaf. Root is the Merkle
+//root the PM writes to the ledger, so a batch is addressed by its root.
+type Batch struct {
+	Root []byte `json:"root"`
+	Leaves [][]byte `json:"leaves"`
+	HashStrategy string `json:"hashStrategy,omitempty"` // Strategy the tree was built with, see hasher.go
+}
+
+//Builds the batch of leaves with the given hash strategy, computing its root
+func NewBatch(leaves [][]byte, strategy string) (*Batch, error) {
+	b := &Batch{nil, leaves, RecordedHashStrategy(strategy)}
+	tree, err := b.tree()
+	if err != nil {
+		return nil, err
+	}
+	b.Root = tree.CurrentRoot().Hash()
+	return b, nil
+}
+
+func (b *Batch) tree() (*merkle.InMemoryMerkleTree, error) {
+	if len(b.Leaves) == 0 {
+		return nil, errors.New("Batch has no leaves\n")
+	}
+	logHasher, err := NewHasher(b.HashStrategy)
+	if err != nil {
+		return nil, err
+	}
+	tree := merkle.NewInMemoryMerkleTree(logHasher)
+	for _, leaf := range b.Leaves {
+		tree.AddLeaf(leaf)
+	}
+	return tree, nil
+}
+
+//Checks Root is the Merkle root of the leaves
+func (b *Batch) Verify() error {
+	tree, err := b.tree()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tree.CurrentRoot().Hash(), b.Root) {
+		return errors.New(fmt.Sprintf("Leaves do not hash to batch root %x\n", b.Root))
+	}
+	return nil
+}
+
+//Index of leaf in the batch, -1 if it is not included
+func (b *Batch) Find(leaf []byte) int64 {
+	for index, l := range b.Leaves {
+		if bytes.Equal(l, leaf) {
+			return int64(index)
+		}
+	}
+	return -1
+}
+
+//Inclusion proof of leaf index (0 based) under Root. The block index is unknown to the batch and set to -1.
+func (b *Batch) Proof(index int64) (*ValidationInfo, error) {
+	if index < 0 || index >= int64(len(b.Leaves)) {
+		return nil, errors.New(fmt.Sprintf("Leaf %d not in batch of %d leaves\n", index, len(b.Leaves)))
+	}
+	tree, err := b.tree()
+	if err != nil {
+		return nil, err
+	}
+	var hashes [][]byte
+	for _, elem := range tree.PathToCurrentRoot(index + 1) {
+		hashes = append(hashes, elem.Value.Hash())
+	}
+	return &ValidationInfo{index, -1, tree.LeafCount(), tree.CurrentRoot().Hash(), hashes, b.HashStrategy}, nil
+}
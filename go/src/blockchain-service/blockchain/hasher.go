@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"fmt"
+	"errors"
+	"crypto"
+	_ "crypto/sha256" // Link the hash functions the strategies use
+	_ "crypto/sha512"
+
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/hashers"
+	"github.com/google/trillian/merkle/rfc6962"
+)
+
+//Hash strategies Merkle trees can be built with. Proofs, batches and v2 relay blocks record the strategy of their tree, an
+//empty strategy is RFC6962_SHA256 (everything written before the strategy was recorded).
+const (
+	HashRFC6962SHA256 = "RFC6962_SHA256"
+	HashRFC6962SHA512_256 = "RFC6962_SHA512_256" // RFC 6962 leaf and node prefixes over SHA-512/256
+	DefaultHashStrategy = HashRFC6962SHA256
+)
+
+var hashStrategies = map[string]crypto.Hash{
+	HashRFC6962SHA256: crypto.SHA256,
+	HashRFC6962SHA512_256: crypto.SHA512_256,
+}
+
+//Supported hash strategies, for flag help texts
+func HashStrategies() []string {
+	return []string{HashRFC6962SHA256, HashRFC6962SHA512_256}
+}
+
+//Returns the hasher of strategy ("" is DefaultHashStrategy)
+func NewHasher(strategy string) (hashers.LogHasher, error) {
+	if strategy == "" {
+		strategy = DefaultHashStrategy
+	}
+	hash, ok := hashStrategies[strategy]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown hash strategy: %s\n", strategy))
+	}
+	return rfc6962.New(hash), nil
+}
+
+//Strategy as it is recorded: empty for the default, so data built with it encodes exactly as before
+func RecordedHashStrategy(strategy string) string {
+	if strategy == DefaultHashStrategy {
+		return ""
+	}
+	return strategy
+}
+
+//Hasher of the tree the proof is for
+func (v *ValidationInfo) Hasher() (hashers.LogHasher, error) {
+	return NewHasher(v.HashStrategy)
+}
+
+//Checks leaf is included under v.MerkleRoot, using the hasher of the proof's strategy
+func (v *ValidationInfo) VerifyLeaf(leaf []byte) error {
+	logHasher, err := v.Hasher()
+	if err != nil {
+		return err
+	}
+	return VerifyMerkleProof(logHasher, v.LeafIndex, v.NumLeaves, v.MerkleRoot, leaf, v.Proof)
+}
+
+//Checks leaf is included at leafIndex in the tree of treeSize leaves with the given root
+func VerifyMerkleProof(logHasher hashers.LogHasher, leafIndex, treeSize int64, root, leaf []byte, proofSet [][]byte) error {
+	verifier := merkle.NewLogVerifier(logHasher)
+	leafHash := logHasher.HashLeaf(leaf)
+	fmt.Printf("Leaf Hash: %+v\n", leafHash)
+
+	return verifier.VerifyInclusionProof(leafIndex, treeSize, proofSet, root, leafHash)
+}
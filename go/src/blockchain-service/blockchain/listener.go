@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
+)
+
+type handleEvent func(uint64)
+
+//Snapshot of a BlockListener's state
+type ListenerHealth struct {
+	Connected bool `json:"connected"`
+	From uint64 `json:"from"` // Block the current (or last) registration started at
+	NextBlock uint64 `json:"nextBlock"` // Next block to be delivered
+	LastEvent time.Time `json:"lastEvent"` // Time of the last block event, zero if none yet
+	Reconnects int `json:"reconnects"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+//Supervised block event listener. Every (re)registration asks the caller where to resume (From) and uses the deliver
+//service to replay blocks committed since then, so no block is missed while disconnected. Blocks are delivered in order,
+//one at a time, from the listener's goroutine: duplicates are dropped and a gap in the event stream is filled by
+//delivering every missing block number.
+type BlockListener struct {
+	m *sync.Mutex //Must acquire before using fSetup
+	fSetup *FabricSetup
+	fn handleEvent
+	from func() uint64 // Next block the caller needs, e.g. last processed height + 1
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	healthLock sync.Mutex //Must acquire before using health
+	health ListenerHealth
+}
+
+func NewBlockListener(m *sync.Mutex, fSetup *FabricSetup, fn handleEvent, from func() uint64) *BlockListener {
+	return &BlockListener{m: m, fSetup: fSetup, fn: fn, from: from, MinBackoff: 1 * time.Second, MaxBackoff: 1 * time.Minute}
+}
+
+//Returns a snapshot of the listener's state
+func (bl *BlockListener) Health() ListenerHealth {
+	bl.healthLock.Lock()
+	defer bl.healthLock.Unlock()
+	return bl.health
+}
+
+func (bl *BlockListener) setHealth(f func(h *ListenerHealth)) {
+	bl.healthLock.Lock()
+	f(&bl.health)
+	bl.healthLock.Unlock()
+}
+
+//Registers, delivers events until the registration ends and re-registers with exponential backoff, until stop is closed.
+//done is signaled once the listener has stopped.
+func (bl *BlockListener) Run(stop, done chan bool) {
+	defer func () {
+		done <- true
+	}()
+	backoff := bl.MinBackoff
+	for attempt := 0; true; attempt++ {
+		if attempt > 0 {
+			fmt.Printf("Block listener: Reconnecting in %s\n", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return
+			}
+		}
+
+		delivered, err := bl.listen(stop)
+		if err == nil {
+			return
+		}
+		fmt.Printf("Block listener: %s\n", err)
+		bl.setHealth(func(h *ListenerHealth) {
+			h.Connected = false
+			h.Reconnects++
+			h.LastError = err.Error()
+		})
+
+		//Back off while registration keeps failing, start over once events flowed again
+		if delivered {
+			backoff = bl.MinBackoff
+		} else if attempt > 0 {
+			backoff *= 2
+			if backoff > bl.MaxBackoff {
+				backoff = bl.MaxBackoff
+			}
+		}
+	}
+}
+
+//Registers from the caller's height and delivers events until stop is closed (returns nil) or the registration ends.
+//Reports whether any block was delivered.
+func (bl *BlockListener) listen(stop chan bool) (bool, error) {
+	next := bl.from()
+	fmt.Printf("Block listener: Registering from block %d\n", next)
+	bl.m.Lock()
+	client, reg, blockEventChannel, err := bl.fSetup.RegisterBlockListenerFrom(next)
+	bl.m.Unlock()
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Could not register block listener: %s", err))
+	}
+	defer func() {
+		bl.m.Lock()
+		client.Unregister(reg)
+		bl.m.Unlock()
+	}()
+	fmt.Printf("Block listener registered\n")
+	bl.setHealth(func(h *ListenerHealth) {
+		h.Connected = true
+		h.From = next
+		h.NextBlock = next
+	})
+
+	delivered := false
+	fmt.Printf("Waiting for block events...\n")
+	for true {
+		var event *fab.FilteredBlockEvent
+		var isOpen bool
+		select {
+		case event, isOpen = <-blockEventChannel:
+		case <-stop:
+			return delivered, nil
+		}
+		if !isOpen {
+			return delivered, errors.New("Event channel closed")
+		}
+		if event.FilteredBlock == nil {
+			return delivered, errors.New("Received an event without a block")
+		}
+		n := event.FilteredBlock.Number
+		fmt.Printf("----------------------Got block event %d----------------------\n", n)
+		bl.setHealth(func(h *ListenerHealth) {
+			h.LastEvent = time.Now()
+		})
+		if n < next {
+			fmt.Printf("Block listener: Block %d already delivered\n", n)
+			continue
+		}
+
+		//Deliver every block up to n, in order, even if the event stream skipped some
+		for ; next <= n; next++ {
+			select {
+			case <-stop:
+				return delivered, nil
+			default:
+			}
+			bl.fn(next)
+			delivered = true
+			bl.setHealth(func(h *ListenerHealth) {
+				h.NextBlock = next + 1
+			})
+		}
+	}
+	return delivered, nil
+}
@@ -0,0 +1,215 @@
+package blockchain
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+)
+
+/*
+PCN file formats.
+v1: PEM certificates followed by the indented JSON ProofList (ToFileFormat). This is what policy-eval reads.
+v2: a single DER encoded structure, PEM armored as "GPCHAIN PCN":
+
+	PCN ::= SEQUENCE {
+		version         INTEGER (2),
+		chain           SEQUENCE OF Certificate,
+		proofs          SEQUENCE OF Proof,                  -- ProofList, block level (batch root -> relay block root)
+		batchProofs     [0] EXPLICIT SEQUENCE OF Proof OPTIONAL, -- cert -> batch root, aligned with proofs from the front
+		revoke          [1] EXPLICIT Revoke OPTIONAL,
+		policyBookHash  [2] EXPLICIT OCTET STRING OPTIONAL,
+		relayBlocks     [3] EXPLICIT SEQUENCE OF OCTET STRING OPTIONAL, -- binary relay block messages (relay/relayWire)
+		checkpoints     [4] EXPLICIT SEQUENCE OF OCTET STRING OPTIONAL  -- binary checkpoint messages (relay/relayWire)
+	}
+	Proof ::= SEQUENCE { index INTEGER, height INTEGER, numLeaves INTEGER, merkleRoot OCTET STRING, hashes SEQUENCE OF OCTET STRING,
+	                     hashStrategy [0] EXPLICIT UTF8String OPTIONAL }
+	-- height is the relay block index, merkleRoot is empty if the root is the last hash, hashStrategy is absent for RFC6962_SHA256
+	Revoke ::= SEQUENCE { message UTF8String, signature OCTET STRING }
+
+Only the DER encoding is accepted, so every v2 PCN has exactly one encoding.
+*/
+
+const (
+	PCNVersion1 = 1
+	PCNVersion2 = 2
+)
+
+const pcnPEMType = "GPCHAIN PCN"
+
+type pcnProof struct {
+	LeafIndex int64
+	BlockIndex int64
+	NumLeaves int64
+	MerkleRoot []byte
+	Hashes [][]byte
+	HashStrategy string `asn1:"optional,explicit,tag:0,utf8"`
+}
+
+type pcnRevoke struct {
+	Message string `asn1:"utf8"`
+	Signature []byte
+}
+
+type pcnV2 struct {
+	Version int
+	Chain []asn1.RawValue
+	Proofs []pcnProof
+	BatchProofs []pcnProof `asn1:"optional,explicit,tag:0"`
+	Revoke pcnRevoke `asn1:"optional,explicit,tag:1"`
+	PolicyBookHash []byte `asn1:"optional,explicit,tag:2"`
+	RelayBlocks [][]byte `asn1:"optional,explicit,tag:3"`
+	Checkpoints [][]byte `asn1:"optional,explicit,tag:4"`
+}
+
+func toPcnProofs(proofs []ValidationInfo) []pcnProof {
+	list := []pcnProof{}
+	for _, v := range proofs {
+		hashes := v.Proof
+		if hashes == nil {
+			hashes = [][]byte{}
+		}
+		list = append(list, pcnProof{v.LeafIndex, v.BlockIndex, v.NumLeaves, v.MerkleRoot, hashes, RecordedHashStrategy(v.HashStrategy)})
+	}
+	return list
+}
+
+func fromPcnProofs(proofs []pcnProof) []ValidationInfo {
+	var list []ValidationInfo
+	for _, p := range proofs {
+		v := ValidationInfo{p.LeafIndex, p.BlockIndex, p.NumLeaves, nil, nil, p.HashStrategy}
+		if len(p.MerkleRoot) != 0 {
+			v.MerkleRoot = p.MerkleRoot
+		}
+		if len(p.Hashes) != 0 {
+			v.Proof = p.Hashes
+		}
+		list = append(list, v)
+	}
+	return list
+}
+
+//Empty optional fields are left out of the encoding
+func nilIfEmpty(list [][]byte) [][]byte {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+//Encodes the PCN in the v2 format
+func (p *ProofFile) ToV2() ([]byte, error) {
+	pcn := pcnV2{Version: PCNVersion2, Chain: []asn1.RawValue{}, Proofs: []pcnProof{}}
+	for _, cert := range p.Certs {
+		pcn.Chain = append(pcn.Chain, asn1.RawValue{FullBytes: cert.Raw})
+	}
+	if p.ProofList != nil {
+		pcn.Proofs = toPcnProofs(p.ProofList.ProofList)
+		pcn.Revoke = pcnRevoke{p.ProofList.Revoke.Cert, p.ProofList.Revoke.Signature}
+		if len(pcn.Revoke.Signature) == 0 {
+			pcn.Revoke.Signature = nil
+		}
+	}
+	if len(p.BatchProofs) != 0 {
+		pcn.BatchProofs = toPcnProofs(p.BatchProofs)
+	}
+	if len(p.PolicyBookHash) != 0 {
+		pcn.PolicyBookHash = p.PolicyBookHash
+	}
+	pcn.RelayBlocks = nilIfEmpty(p.RelayBlocks)
+	pcn.Checkpoints = nilIfEmpty(p.Checkpoints)
+
+	der, err := asn1.Marshal(pcn)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pcnPEMType, Bytes: der}), nil
+}
+
+//Encodes the PCN in the format it was parsed from (v1 unless it was a v2 PCN)
+func (p *ProofFile) Encode() ([]byte, error) {
+	if p.Version == PCNVersion2 {
+		return p.ToV2()
+	}
+	return p.ToFileFormat()
+}
+
+//Reports whether data is a v2 PCN
+func IsPCNv2(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN "+pcnPEMType+"-----"))
+}
+
+func parsePCNv2(data []byte, strict bool) (*ProofFile, error) {
+	block, rest := pem.Decode(bytes.TrimSpace(data))
+	if block == nil || block.Type != pcnPEMType {
+		return nil, errors.New("Could not decode PCN PEM block\n")
+	}
+	if len(block.Headers) != 0 || len(bytes.TrimSpace(rest)) != 0 {
+		return nil, errors.New("Unexpected data around PCN PEM block\n")
+	}
+
+	var pcn pcnV2
+	trailing, err := asn1.Unmarshal(block.Bytes, &pcn)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode PCN: %s\n", err)
+	}
+	if len(trailing) != 0 {
+		return nil, errors.New("Trailing data after PCN\n")
+	}
+	if pcn.Version != PCNVersion2 {
+		return nil, fmt.Errorf("Unsupported PCN version %d\n", pcn.Version)
+	}
+	if strict {
+		//Only the canonical (DER) encoding is accepted
+		der, err := asn1.Marshal(pcn)
+		if err != nil || !bytes.Equal(der, block.Bytes) {
+			return nil, errors.New("PCN is not DER encoded\n")
+		}
+		//Optional fields are left out rather than encoded empty (a present but empty SEQUENCE decodes to an empty, non nil slice)
+		if (pcn.BatchProofs != nil && len(pcn.BatchProofs) == 0) || (pcn.PolicyBookHash != nil && len(pcn.PolicyBookHash) == 0) ||
+			(pcn.RelayBlocks != nil && len(pcn.RelayBlocks) == 0) || (pcn.Checkpoints != nil && len(pcn.Checkpoints) == 0) {
+			return nil, errors.New("PCN has empty optional fields\n")
+		}
+	}
+
+	p := &ProofFile{Version: PCNVersion2, ProofList: &ProofList{}}
+	for _, raw := range pcn.Chain {
+		cert, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse certs: %s\n", err)
+		}
+		p.Certs = append(p.Certs, cert)
+	}
+	p.ProofList.ProofList = fromPcnProofs(pcn.Proofs)
+	p.ProofList.Revoke = ValidatorRevokeInfo{pcn.Revoke.Signature, pcn.Revoke.Message}
+	p.BatchProofs = fromPcnProofs(pcn.BatchProofs)
+	p.PolicyBookHash = pcn.PolicyBookHash
+	p.RelayBlocks = pcn.RelayBlocks
+	p.Checkpoints = pcn.Checkpoints
+	if !strict {
+		return p, nil
+	}
+	if err = p.Validate(); err != nil {
+		return nil, err
+	}
+	//Every PCN has exactly one encoding, the one ToV2 produces (e.g. the default hash strategy is left out)
+	canonical, err := p.ToV2()
+	if err != nil {
+		return nil, err
+	}
+	if canonicalBlock, _ := pem.Decode(canonical); canonicalBlock == nil || !bytes.Equal(canonicalBlock.Bytes, block.Bytes) {
+		return nil, errors.New("PCN is not canonically encoded\n")
+	}
+	return p, nil
+}
+
+//Converts a PCN of either version to v2
+func UpgradePCN(data []byte) ([]byte, error) {
+	p, err := ParsePCN(data)
+	if err != nil {
+		return nil, err
+	}
+	return p.ToV2()
+}
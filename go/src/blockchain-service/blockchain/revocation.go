@@ -0,0 +1,277 @@
+package blockchain
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"crypto/x509"
+	"crypto/sha256"
+	"encoding/pem"
+	"encoding/json"
+)
+
+/*
+Revocation statements, the message a revoking principal signs (the revoke field of a PCN, ValidatorRevokeInfo.Cert).
+v1 statements only name the certificate:
+
+	REVOKE
+	<PEM certificate>
+
+v2 statements also carry an RFC 5280 reason code, the time the revocation takes effect (e.g. when the key was compromised,
+never after publication) and the revoker (common name of the certificate that signs the statement):
+
+	<action>
+	reason: <reason name>
+	effective: <RFC 3339 time, UTC>
+	revoker: <common name>
+	<PEM certificate>
+
+The action is REVOKE, SUSPEND (reason certificateHold, until lifted by a REINSTATE) or REINSTATE (reason removeFromCRL).
+Only the canonical form of v2 statements (as written by String) is accepted, so every v2 statement has exactly one encoding.
+*/
+
+const (
+	StatementRevoke = "REVOKE"
+	StatementSuspend = "SUSPEND"
+	StatementReinstate = "REINSTATE"
+)
+
+const (
+	StatementVersion1 = 1
+	StatementVersion2 = 2
+)
+
+//RFC 5280 CRLReason
+type RevocationReason int
+
+const (
+	ReasonUnspecified RevocationReason = 0
+	ReasonKeyCompromise RevocationReason = 1
+	ReasonCACompromise RevocationReason = 2
+	ReasonAffiliationChanged RevocationReason = 3
+	ReasonSuperseded RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+	ReasonCertificateHold RevocationReason = 6
+	ReasonRemoveFromCRL RevocationReason = 8
+	ReasonPrivilegeWithdrawn RevocationReason = 9
+	ReasonAACompromise RevocationReason = 10
+)
+
+var reasonNames = map[RevocationReason]string{
+	ReasonUnspecified: "unspecified",
+	ReasonKeyCompromise: "keyCompromise",
+	ReasonCACompromise: "cACompromise",
+	ReasonAffiliationChanged: "affiliationChanged",
+	ReasonSuperseded: "superseded",
+	ReasonCessationOfOperation: "cessationOfOperation",
+	ReasonCertificateHold: "certificateHold",
+	ReasonRemoveFromCRL: "removeFromCRL",
+	ReasonPrivilegeWithdrawn: "privilegeWithdrawn",
+	ReasonAACompromise: "aACompromise",
+}
+
+func (r RevocationReason) String() string {
+	if name, ok := reasonNames[r]; ok {
+		return name
+	}
+	return strconv.Itoa(int(r))
+}
+
+//Parses a reason by its RFC 5280 name (e.g. keyCompromise) or code
+func ParseRevocationReason(s string) (RevocationReason, error) {
+	for reason, name := range reasonNames {
+		if s == name || s == strconv.Itoa(int(reason)) {
+			return reason, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("Unknown revocation reason: %s\n", s))
+}
+
+type RevocationStatement struct {
+	Version int
+	Action string
+	Reason RevocationReason // ReasonUnspecified for v1 statements
+	Effective time.Time // Zero for v1 statements (effective on publication)
+	Revoker string // Empty for v1 statements
+	Cert *x509.Certificate
+	certPEM []byte // PEM of Cert as it appears in the statement
+}
+
+//Statement of the given action, v2 unless it is a bare revocation (REVOKE without reason, effective time and revoker)
+func NewRevocationStatement(action string, reason RevocationReason, effective time.Time, revoker string, cert *x509.Certificate) (*RevocationStatement, error) {
+	s := &RevocationStatement{StatementVersion2, action, reason, effective.UTC().Truncate(time.Second), revoker, cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})}
+	if action == StatementRevoke && reason == ReasonUnspecified && effective.IsZero() && revoker == "" {
+		s.Version = StatementVersion1
+		return s, nil
+	}
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//Parses a v1 or v2 statement
+func ParseRevocationStatement(message string) (*RevocationStatement, error) {
+	lines := strings.SplitN(message, "\n", 2)
+	if len(lines) != 2 {
+		return nil, errors.New("Revocation statement has no certificate\n")
+	}
+	s := &RevocationStatement{Version: StatementVersion1, Action: lines[0]}
+	switch s.Action {
+	case StatementRevoke, StatementSuspend, StatementReinstate:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown revocation action: %s\n", s.Action))
+	}
+
+	rest := lines[1]
+	if !strings.HasPrefix(strings.TrimLeft(rest, " \t\r\n"), "-----BEGIN ") {
+		s.Version = StatementVersion2
+		var err error
+		fields := map[string]string{}
+		for _, name := range []string{"reason", "effective", "revoker"} {
+			lines = strings.SplitN(rest, "\n", 2)
+			if len(lines) != 2 || !strings.HasPrefix(lines[0], name+": ") {
+				return nil, errors.New(fmt.Sprintf("Revocation statement has no %s\n", name))
+			}
+			fields[name] = strings.TrimPrefix(lines[0], name+": ")
+			rest = lines[1]
+		}
+		if s.Reason, err = ParseRevocationReason(fields["reason"]); err != nil {
+			return nil, err
+		}
+		if s.Effective, err = time.Parse(time.RFC3339, fields["effective"]); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid effective time: %s\n", err))
+		}
+		s.Revoker = fields["revoker"]
+	}
+
+	block, trailing := pem.Decode([]byte(rest))
+	if block == nil || block.Type != "CERTIFICATE" || len(bytes.TrimSpace(trailing)) != 0 {
+		return nil, errors.New("Revoked certificate is not a single PEM certificate\n")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	s.Cert = cert
+	s.certPEM = []byte(rest)
+
+	if s.Version == StatementVersion1 {
+		if s.Action != StatementRevoke {
+			return nil, errors.New(fmt.Sprintf("%s statements need a reason, effective time and revoker\n", s.Action))
+		}
+		return s, nil
+	}
+	if err = s.check(); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(s.certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})) || s.String() != message {
+		return nil, errors.New("Revocation statement is not in canonical form\n")
+	}
+	return s, nil
+}
+
+//Checks the reason fits the action and the effective time and revoker are set
+func (s *RevocationStatement) check() error {
+	switch s.Action {
+	case StatementSuspend:
+		if s.Reason != ReasonCertificateHold {
+			return errors.New(fmt.Sprintf("Suspensions need reason %s, not %s\n", ReasonCertificateHold, s.Reason))
+		}
+	case StatementReinstate:
+		if s.Reason != ReasonRemoveFromCRL {
+			return errors.New(fmt.Sprintf("Reinstatements need reason %s, not %s\n", ReasonRemoveFromCRL, s.Reason))
+		}
+	case StatementRevoke:
+		if _, ok := reasonNames[s.Reason]; !ok || s.Reason == ReasonCertificateHold || s.Reason == ReasonRemoveFromCRL {
+			return errors.New(fmt.Sprintf("Invalid revocation reason %s\n", s.Reason))
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unknown revocation action: %s\n", s.Action))
+	}
+	if s.Effective.IsZero() {
+		return errors.New("Revocation statement has no effective time\n")
+	}
+	if s.Effective.Before(s.Cert.NotBefore.Truncate(time.Second)) {
+		return errors.New(fmt.Sprintf("Effective time %s is before the certificate is valid\n", s.Effective.Format(time.RFC3339)))
+	}
+	if s.Revoker == "" || strings.ContainsAny(s.Revoker, "\r\n") {
+		return errors.New("Revocation statement has no valid revoker\n")
+	}
+	return nil
+}
+
+//The signed message
+func (s *RevocationStatement) String() string {
+	if s.Version == StatementVersion1 {
+		return fmt.Sprintf("%s\n%s", s.Action, s.certPEM)
+	}
+	return fmt.Sprintf("%s\nreason: %s\neffective: %s\nrevoker: %s\n%s", s.Action, s.Reason, s.Effective.UTC().Format(time.RFC3339), s.Revoker, s.certPEM)
+}
+
+//PEM of the certificate the statement is about
+func (s *RevocationStatement) CertPEM() []byte {
+	return append([]byte{}, s.certPEM...)
+}
+
+//Key of the certificate in revocation sets and bloom filters: sha256(PEM of the certificate)
+func (s *RevocationStatement) Key() [32]byte {
+	return sha256.Sum256(s.certPEM)
+}
+
+//Hash chained into the relay's revocation digest: the key for v1 statements (as before statements had a version), the
+//hash of the whole statement for v2 so the digest also commits to action, reason, effective time and revoker
+func (s *RevocationStatement) Digest() [32]byte {
+	if s.Version == StatementVersion1 {
+		return s.Key()
+	}
+	return sha256.Sum256([]byte(s.String()))
+}
+
+//Parses the PCN's revocation statement and checks it is signed by (and, for v2 statements, names as revoker) the first
+//cert of the chain
+func (p *ProofFile) VerifyRevocation() (*RevocationStatement, error) {
+	if p.ProofList == nil || p.ProofList.Revoke.Cert == "" {
+		return nil, errors.New("PCN has no revocation statement\n")
+	}
+	s, err := ParseRevocationStatement(p.ProofList.Revoke.Cert)
+	if err != nil {
+		return nil, err
+	}
+	if s.Version == StatementVersion2 && s.Revoker != p.Certs[0].Subject.CommonName {
+		return nil, errors.New(fmt.Sprintf("Revocation statement names %s as revoker but is signed by %s\n", s.Revoker, p.Certs[0].Subject.CommonName))
+	}
+	if err = p.Certs[0].CheckSignature(x509.SHA256WithRSA, []byte(p.ProofList.Revoke.Cert), p.ProofList.Revoke.Signature); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//Revocation statements of a ledger write (the JSON list of revoker PCNs pubcc stores under a batch root). The ledger keeps
+//revocations accepted before PCNs were validated strictly, so the PCNs are only decoded, and writes or revocations that
+//can't be read at all are logged and skipped. Every reader of the ledger (relay, PM, gpc-replay) uses this, so they skip the
+//same revocations and a block is never rejected over one of them.
+func LedgerRevocations(value []byte) []*RevocationStatement {
+	var revokeJson [][]byte
+	if err := json.Unmarshal(value, &revokeJson); err != nil {
+		fmt.Printf("Skipping revocations of malformed ledger write: %s\n", err)
+		return nil
+	}
+	var statements []*RevocationStatement
+	for index, r := range revokeJson {
+		pcn, err := parsePCN(r, false)
+		var statement *RevocationStatement
+		if err == nil {
+			statement, err = ParseRevocationStatement(pcn.ProofList.Revoke.Cert)
+		}
+		if err != nil {
+			fmt.Printf("Skipping malformed revocation %d on the ledger: %s", index, err)
+			continue
+		}
+		statements = append(statements, statement)
+	}
+	return statements
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
 	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fab/events/deliverclient/seek"
 	"github.com/hyperledger/fabric-sdk-go/third_party/github.com/hyperledger/fabric/protos/common"
 )
 
@@ -159,6 +160,22 @@ func (setup *FabricSetup) UnregisterBlockListener(reg *fab.Registration) {
 	setup.eventClient.Unregister(*reg)
 }
 
+//Registers for filtered block events starting at block from, blocks committed since then are replayed by the deliver
+//service. Each call uses its own event client, unregister with client.Unregister(registration).
+func (setup *FabricSetup) RegisterBlockListenerFrom(from uint64) (*event.Client, fab.Registration, <-chan *fab.FilteredBlockEvent, error) {
+	ctx := setup.sdk.ChannelContext(setup.ChannelID, fabsdk.WithUser(setup.UserName))
+	client, err := event.New(ctx, event.WithSeekType(seek.FromBlock), event.WithBlockNum(from))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create new event client: %v", err)
+	}
+	registration, blockEventChannel, err := client.RegisterFilteredBlockEvent()
+	if err != nil {
+		fmt.Printf("failed to register block event: %s\n", err)
+		return nil, nil, nil, err
+	}
+	return client, registration, blockEventChannel, nil
+}
+
 func (setup *FabricSetup) Pub(merkleRoot []byte, revocationJsonString []byte) (string, error) {
 	if !setup.channelClientInitialized {
 		err := setup.InitializeChannelClient()
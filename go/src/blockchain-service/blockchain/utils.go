@@ -2,22 +2,18 @@ package blockchain
 
 import(
 	"fmt"
-	"sync"
-	"flag"
 	"errors"
 	"time"
 	"bytes"
+	"math/big"
 	"crypto/x509"
+	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/json"
 	"encoding/pem"
 
-	"github.com/google/trillian"
-	"github.com/google/trillian/merkle"
-	"github.com/google/trillian/merkle/hashers"
-    _ "github.com/google/trillian/merkle/rfc6962" // Load hashers
 
 	"github.com/hyperledger/fabric-sdk-go/third_party/github.com/hyperledger/fabric/protos/common"
-	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
 	p1 "github.com/hyperledger/fabric-sdk-go/third_party/github.com/hyperledger/fabric/protos/peer"
 	p2 "github.com/hyperledger/fabric/protos/peer"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
@@ -36,6 +32,25 @@ type Block struct {
 	Transactions []*Transaction
 	Header *common.BlockHeader
 	Metadata *common.BlockMetadata
+	Timestamp time.Time // Latest transaction timestamp (from the channel headers) in the block
+	Hash []byte // Block header hash, as referenced by the next block's PreviousHash
+}
+
+//Same encoding fabric uses to hash block headers (protos/common BlockHeader.Hash)
+type asn1Header struct {
+	Number *big.Int
+	PreviousHash []byte
+	DataHash []byte
+}
+
+//Returns SHA256(ASN.1(Number, PreviousHash, DataHash)), the hash fabric chains blocks with
+func HeaderHash(header *common.BlockHeader) ([]byte, error) {
+	headerBytes, err := asn1.Marshal(asn1Header{new(big.Int).SetUint64(header.GetNumber()), header.GetPreviousHash(), header.GetDataHash()})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(headerBytes)
+	return sum[:], nil
 }
 
 type ValidationInfo struct {
@@ -44,6 +59,7 @@ type ValidationInfo struct {
 	NumLeaves int64 `json:"numLeaves"`
 	MerkleRoot []byte `json:"merkleRoot,omitempty"`
 	Proof [][]byte `json:"hashes"`
+	HashStrategy string `json:"hashStrategy,omitempty"` // Strategy the tree was built with, see hasher.go
 }
 
 type ValidatorRevokeInfo struct {
@@ -59,6 +75,11 @@ type ProofList struct {
 type ProofFile struct {
 	Certs []*x509.Certificate
 	ProofList *ProofList
+	Version int // Format the PCN was parsed from (PCNVersion1 or PCNVersion2), see pcn.go
+	BatchProofs []ValidationInfo // v2: proofs of the certs under their batch roots, aligned with ProofList from the front (may be shorter)
+	PolicyBookHash []byte // v2: SHA256 of the policy book the chain was evaluated against
+	RelayBlocks [][]byte // v2: binary relay block messages committing to the block roots of ProofList
+	Checkpoints [][]byte // v2: binary checkpoint messages the relay blocks chain back to
 }
 
 type Revocation struct {
@@ -72,10 +93,18 @@ func (p *ProofFile) AddMerkleProof(v *ValidationInfo) error {
 	if len(p.Certs) != len(p.ProofList.ProofList) +1 {
 		return errors.New("Cannot add entry to this file")
 	}
+	if err := validateProof("proof", v, true); err != nil {
+		return err
+	}
 	p.ProofList.ProofList = append([]ValidationInfo{*v}, p.ProofList.ProofList...)
 	return nil
 }
 
+//Adds the proof of the newest cert under its batch root. Only kept by v2 PCNs.
+func (p *ProofFile) AddBatchProof(v *ValidationInfo) {
+	p.BatchProofs = append([]ValidationInfo{*v}, p.BatchProofs...)
+}
+
 func (p *ProofFile) Print() {
 	fmt.Printf("Certificates:\n")
 	for _,cert := range p.Certs {
@@ -88,6 +117,7 @@ func (p *ProofFile) Print() {
 	return
 }
 
+//Encodes the PCN in the v1 format
 func (p *ProofFile) ToFileFormat() ([]byte, error) {
 	var returnString []byte	
 	write := bytes.NewBuffer([]byte{})
@@ -111,13 +141,16 @@ func (p *ProofFile) ToFileFormat() ([]byte, error) {
 	return returnString, nil
 }
 
+//Decodes the PEM certificates at the start of data, returns the rest (the JSON section). Anything but a certificate (or
+//whitespace) before the JSON section is rejected, pem.Decode alone would skip it.
 func getX509Chain(data []byte) ([]*x509.Certificate, []byte, error) {
 	var certs []*x509.Certificate
-	var residue []byte
 	var temp *pem.Block
+	residue := bytes.TrimLeft(data, " \t\r\n")
 	//Decode PEM encoded Cert Chain
-	for temp, residue = pem.Decode(data); temp != nil; temp, residue = pem.Decode(residue) {
-		if temp == nil || temp.Type != "CERTIFICATE" {
+	for bytes.HasPrefix(residue, []byte("-----BEGIN ")) {
+		temp, residue = pem.Decode(residue)
+		if temp == nil || temp.Type != "CERTIFICATE" || len(temp.Headers) != 0 {
 			return nil, nil, errors.New("Could not decode PEM string\n")
 		}
 		cert, err := x509.ParseCertificate(temp.Bytes)
@@ -125,8 +158,15 @@ func getX509Chain(data []byte) ([]*x509.Certificate, []byte, error) {
 			return nil, nil, err
 		}
 		certs = append(certs, cert)
+		residue = bytes.TrimLeft(residue, " \t\r\n")
 	}
-	return certs,residue, nil
+	if len(certs) == 0 {
+		return nil, nil, errors.New("No certificates found\n")
+	}
+	if !bytes.HasPrefix(residue, []byte("{")) {
+		return nil, nil, errors.New("Unexpected data after certificates\n")
+	}
+	return certs, residue, nil
 }
 
 func getMekerkleProofArray(data []byte) (*ProofList, error) {
@@ -137,7 +177,16 @@ func getMekerkleProofArray(data []byte) (*ProofList, error) {
 	return &proofList, nil
 }
 
+//Parses a v1 or v2 PCN
 func ParsePCN(data []byte) (*ProofFile, error) {
+	return parsePCN(data, true)
+}
+
+//Without strict the PCN is only decoded, it is neither validated nor required to be canonically encoded
+func parsePCN(data []byte, strict bool) (*ProofFile, error) {
+	if IsPCNv2(data) {
+		return parsePCNv2(data, strict)
+	}
 	certs, residue, err := getX509Chain(data)
 	if err != nil {
 		return nil, fmt.Errorf("Could not parse certs: %s\n", err)
@@ -146,7 +195,14 @@ func ParsePCN(data []byte) (*ProofFile, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Could not parse json section: %s\n", err)
 	}
-	return &ProofFile{certs, proofArray}, nil
+	pcn := &ProofFile{Certs: certs, ProofList: proofArray, Version: PCNVersion1}
+	if !strict {
+		return pcn, nil
+	}
+	if err = pcn.Validate(); err != nil {
+		return nil, err
+	}
+	return pcn, nil
 }
 
 func (b *Block) Print() {
@@ -197,6 +253,16 @@ func (setup *FabricSetup) GetBlock(blockNumber uint64) (*Block, error){
 	myBlock.Transactions = make([]*Transaction, 0, len(blk.Data.Data))
 	myBlock.Header = blk.GetHeader()
 	myBlock.Metadata = blk.GetMetadata()
+	if myBlock.Hash, err = HeaderHash(myBlock.Header); err != nil {
+		fmt.Printf("Could not hash block header")
+		return nil, err
+	}
+
+	//The header only commits to the transactions through DataHash, so check the data we are about to use matches it
+	dataHash := sha256.Sum256(bytes.Join(blk.Data.Data, nil))
+	if !bytes.Equal(dataHash[:], myBlock.Header.GetDataHash()) {
+		return nil, errors.New(fmt.Sprintf("Data of block %d does not match the data hash in its header\n", myBlock.Header.GetNumber()))
+	}
 	
 	for _, data := range blk.Data.Data {
 		var myTransaction Transaction
@@ -214,6 +280,17 @@ func (setup *FabricSetup) GetBlock(blockNumber uint64) (*Block, error){
 			fmt.Printf("Could unmarshal to payload")
 			return nil, err
 		}
+
+		chdr := common.ChannelHeader{}
+		if err = proto.Unmarshal(payload.GetHeader().GetChannelHeader(), &chdr); err != nil {
+			fmt.Printf("Could unmarshal to channel header")
+			return nil, err
+		}
+		if ts := chdr.GetTimestamp(); ts != nil {
+			if txTime := time.Unix(ts.GetSeconds(), int64(ts.GetNanos())); txTime.After(myBlock.Timestamp) {
+				myBlock.Timestamp = txTime
+			}
+		}
 		
 		if err = proto.Unmarshal(payload.GetData(), &tx); err != nil {
 			fmt.Printf("Could unmarshal to transaction")
@@ -239,85 +316,3 @@ func (setup *FabricSetup) GetBlock(blockNumber uint64) (*Block, error){
 	}
 	return &myBlock, nil
 }
-
-var HashStrategyFlag = flag.String("hash_strategy", "RFC6962_SHA256", "The log hashing strategy to use")
-
-func InitHasher() (hashers.LogHasher, error) {
-    strategy, ok := trillian.HashStrategy_value[*HashStrategyFlag]
-	if !ok {
-        fmt.Printf("Unknown hash strategy: %s", *HashStrategyFlag)
-        return nil, errors.New(fmt.Sprintf("Unknown hash strategy: %s", *HashStrategyFlag))
-	}
-
-    logHasher, err := hashers.NewLogHasher(trillian.HashStrategy(strategy))
-    if err != nil {
-        fmt.Printf("Could Not Create Log Hasher: %v\n", err)
-        return nil, err
-	}
-	return  logHasher, nil
-}
-
-func VerifyMerkleProof(leafIndex, treeSize int64, root, leaf []byte, proofSet [][]byte) error {
-	logHasher, err := InitHasher()
-    if err != nil {
-        fmt.Printf("Could Not Create Log Hasher: %v\n", err)
-        return err
-	}
-		
-	verifier := merkle.NewLogVerifier(logHasher)
-	leafHash := logHasher.HashLeaf(leaf)
-	fmt.Printf("Leaf Hash: %+v\n", leafHash)
-
-	return verifier.VerifyInclusionProof(leafIndex, treeSize, proofSet, root, leafHash)
-}
-
-type handleEvent func(uint64)
-
-func BlockListener(m *sync.Mutex, fSetup *FabricSetup, fn handleEvent, stop, done chan bool) {
-	defer func () {
-		done <- true
-	}()
-	attempts := 0
-	var reg *fab.Registration
-	var blockEventChannel <-chan *fab.FilteredBlockEvent
-	var err error
-	for err = errors.New(""); err != nil && attempts < 200; attempts++ {
-		if attempts > 0 {
-			time.Sleep(1 * time.Second)
-		}
-		fmt.Printf("Attempt %d to register block listener\n", attempts)
-		m.Lock()
-		reg, blockEventChannel, err = fSetup.RegisterBlockListener()
-		m.Unlock()
-	}
-	if err != nil {
-		fmt.Printf("Could not register block listener: %s\n", err)
-		return
-	}
-	fmt.Printf("Block listener registered\n")
-	defer func() {
-		m.Lock()
-		fSetup.UnregisterBlockListener(reg)
-		m.Unlock()
-	}()
-	
-	fmt.Printf("Waiting for block events...\n")
-	for true {
-		select {
-			case event, isOpen := <-blockEventChannel:
-				if !isOpen {
-					fmt.Printf("Channel closed while waiting\n")
-					return 
-				}
-				if event.FilteredBlock == nil {
-					fmt.Printf("Block is nil\n")
-					return
-				}
-				fmt.Printf("----------------------Got block event----------------------\n")
-				go fn(event.FilteredBlock.Number)
-			case <-stop:
-				done <- true
-				return
-		}
-	}
-}
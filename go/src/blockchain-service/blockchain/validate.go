@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"fmt"
+	"errors"
+	"strings"
+	"math/bits"
+)
+
+//Reasons a PCN fails validation, see ValidationError
+var (
+	ErrNoCerts = errors.New("no certificates")
+	ErrMalformedChain = errors.New("malformed certificate chain")
+	ErrNoProofList = errors.New("no proof list")
+	ErrProofCount = errors.New("wrong number of proofs for the chain")
+	ErrLeafIndex = errors.New("leaf index out of range")
+	ErrBlockIndex = errors.New("negative block index")
+	ErrEmptyRoot = errors.New("empty merkle root")
+	ErrProofLength = errors.New("wrong number of hashes for the leaf index and tree size")
+	ErrHashLength = errors.New("hashes of different length")
+	ErrRevocation = errors.New("malformed revocation statement")
+	ErrHashStrategy = errors.New("unknown hash strategy")
+)
+
+//Structural problem found in a PCN. Reason is one of the Err values above, Field locates it (e.g. "proofList[1]").
+type ValidationError struct {
+	Field string
+	Reason error
+	Detail string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("Invalid PCN: %s: %s", e.Field, e.Reason)
+	}
+	return fmt.Sprintf("Invalid PCN: %s: %s (%s)", e.Field, e.Reason, e.Detail)
+}
+
+func invalid(field string, reason error, format string, a ...interface{}) error {
+	return &ValidationError{field, reason, fmt.Sprintf(format, a...)}
+}
+
+//Number of hashes in the audit path of leaf index in a tree of size leaves (RFC 6962)
+func auditPathLength(index, size int64) int {
+	inner := bits.Len64(uint64(index ^ (size - 1)))
+	border := bits.OnesCount64(uint64(index) >> uint(inner))
+	return inner + border
+}
+
+//Checks a single Merkle proof: the leaf index is within the tree, the root is present (either MerkleRoot or, as the PM
+//writes block level proofs, the last hash), the hash strategy is known and the number and size of the hashes match the
+//audit path of the leaf.
+func validateProof(field string, v *ValidationInfo, block bool) error {
+	if v.NumLeaves < 1 || v.LeafIndex < 0 || v.LeafIndex >= v.NumLeaves {
+		return invalid(field, ErrLeafIndex, "leaf %d of %d", v.LeafIndex, v.NumLeaves)
+	}
+	if block && v.BlockIndex < 0 {
+		return invalid(field, ErrBlockIndex, "%d", v.BlockIndex)
+	}
+	want := auditPathLength(v.LeafIndex, v.NumLeaves)
+	hashes := v.Proof
+	root := v.MerkleRoot
+	if len(root) == 0 {
+		if len(hashes) == 0 {
+			return invalid(field, ErrEmptyRoot, "")
+		}
+		root = hashes[len(hashes)-1]
+		hashes = hashes[:len(hashes)-1]
+	}
+	if len(root) == 0 {
+		return invalid(field, ErrEmptyRoot, "")
+	}
+	hasher, err := v.Hasher()
+	if err != nil {
+		return invalid(field, ErrHashStrategy, "%s", v.HashStrategy)
+	}
+	if len(root) != hasher.Size() {
+		return invalid(field, ErrHashLength, "root has %d bytes, %s hashes have %d", len(root), v.HashStrategy, hasher.Size())
+	}
+	if len(hashes) != want {
+		return invalid(field, ErrProofLength, "%d hashes, want %d for leaf %d of %d", len(hashes), want, v.LeafIndex, v.NumLeaves)
+	}
+	for i, hash := range hashes {
+		if len(hash) != len(root) {
+			return invalid(fmt.Sprintf("%s.hashes[%d]", field, i), ErrHashLength, "%d bytes, root has %d", len(hash), len(root))
+		}
+	}
+	return nil
+}
+
+//Checks the structural invariants of the PCN: a chain of certificates, one block level proof per published cert (every
+//cert but the newest until it is published), well formed proofs and, if present, a well formed revocation statement.
+//Errors are *ValidationError.
+func (p *ProofFile) Validate() error {
+	if len(p.Certs) == 0 {
+		return invalid("certs", ErrNoCerts, "")
+	}
+	for i, cert := range p.Certs {
+		if cert == nil {
+			return invalid(fmt.Sprintf("certs[%d]", i), ErrMalformedChain, "missing certificate")
+		}
+	}
+	if p.ProofList == nil {
+		return invalid("proofList", ErrNoProofList, "")
+	}
+	proofs := p.ProofList.ProofList
+	if len(proofs) != len(p.Certs) && len(proofs) != len(p.Certs)-1 {
+		return invalid("proofList", ErrProofCount, "%d proofs for %d certificates", len(proofs), len(p.Certs))
+	}
+	for i := range proofs {
+		if err := validateProof(fmt.Sprintf("proofList[%d]", i), &proofs[i], true); err != nil {
+			return err
+		}
+	}
+	if len(p.BatchProofs) > len(proofs) {
+		return invalid("batchProofs", ErrProofCount, "%d batch proofs for %d proofs", len(p.BatchProofs), len(proofs))
+	}
+	for i := range p.BatchProofs {
+		if err := validateProof(fmt.Sprintf("batchProofs[%d]", i), &p.BatchProofs[i], true); err != nil {
+			return err
+		}
+	}
+
+	revoke := p.ProofList.Revoke
+	if revoke.Cert == "" && len(revoke.Signature) == 0 {
+		return nil
+	}
+	if revoke.Cert == "" || len(revoke.Signature) == 0 {
+		return invalid("revoke", ErrRevocation, "want a statement and a signature")
+	}
+	if _, err := ParseRevocationStatement(revoke.Cert); err != nil {
+		return invalid("revoke", ErrRevocation, "%s", strings.TrimSpace(err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package blockchain
+
+import (
+	"time"
+	"bytes"
+	"testing"
+	"math/big"
+	"encoding/pem"
+	"encoding/asn1"
+	"encoding/json"
+	"crypto/rsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+)
+
+//Self signed cert if parent is nil, otherwise signed by parent
+func testCert(tb testing.TB, cn string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		tb.Fatalf("Could not generate rsa key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: cn},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		tb.Fatalf("Could not create cert: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatalf("Could not parse cert: %s", err)
+	}
+	return cert, key
+}
+
+//Proof of leaf index in a tree over leaves, as recorded for relay block blockIndex
+func testProof(tb testing.TB, leaves [][]byte, index, blockIndex int64) ValidationInfo {
+	batch, err := NewBatch(leaves, DefaultHashStrategy)
+	if err != nil {
+		tb.Fatalf("Could not build tree: %s", err)
+	}
+	proof, err := batch.Proof(index)
+	if err != nil {
+		tb.Fatalf("Could not build proof: %s", err)
+	}
+	proof.BlockIndex = blockIndex
+	return *proof
+}
+
+//Block level proof the way the PM writes it, with the root as the last hash
+func rootAsLastHash(v ValidationInfo) ValidationInfo {
+	v.Proof = append(append([][]byte{}, v.Proof...), v.MerkleRoot)
+	v.MerkleRoot = nil
+	return v
+}
+
+//A root cert published in relay block 0 and a cert it issued, published through a batch in relay block 1
+func testChain(tb testing.TB) *ProofFile {
+	root, rootKey := testCert(tb, "root", nil, nil)
+	cert, _ := testCert(tb, "user", root, rootKey)
+	other, _ := testCert(tb, "other", root, rootKey)
+
+	batch, err := NewBatch([][]byte{other.Raw, cert.Raw, []byte("timestamp")}, DefaultHashStrategy)
+	if err != nil {
+		tb.Fatalf("Could not build batch: %s", err)
+	}
+	batchProof := testProof(tb, batch.Leaves, 1, 1)
+	blockProof := rootAsLastHash(testProof(tb, [][]byte{[]byte("batch root"), batch.Root}, 1, 1))
+	rootProof := testProof(tb, [][]byte{root.Raw}, 0, 0)
+	return &ProofFile{
+		Certs: []*x509.Certificate{cert, root},
+		ProofList: &ProofList{ProofList: []ValidationInfo{blockProof, rootProof}},
+		BatchProofs: []ValidationInfo{batchProof},
+	}
+}
+
+func FuzzParsePCN(f *testing.F) {
+	pcn := testChain(f)
+	unpublished := &ProofFile{Certs: pcn.Certs, ProofList: &ProofList{ProofList: pcn.ProofList.ProofList[1:]}}
+	for _, p := range []*ProofFile{pcn, unpublished} {
+		v1, err := p.ToFileFormat()
+		if err != nil {
+			f.Fatalf("Could not encode v1 PCN: %s", err)
+		}
+		v2, err := p.ToV2()
+		if err != nil {
+			f.Fatalf("Could not encode v2 PCN: %s", err)
+		}
+		f.Add(v1)
+		f.Add(v2)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := ParsePCN(data)
+		if err != nil {
+			return
+		}
+		if err = p.Validate(); err != nil {
+			t.Fatalf("Parsed PCN does not validate: %s", err)
+		}
+		//Every parsed PCN can be re-encoded and parsed again
+		v2, err := p.ToV2()
+		if err != nil {
+			t.Fatalf("Could not encode parsed PCN: %s", err)
+		}
+		if _, err = ParsePCN(v2); err != nil {
+			t.Fatalf("Could not parse re-encoded PCN: %s", err)
+		}
+		//A v2 PCN has exactly one encoding, re-encoding it gives the input back
+		if IsPCNv2(data) {
+			in, _ := pem.Decode(bytes.TrimSpace(data))
+			out, _ := pem.Decode(v2)
+			if !bytes.Equal(in.Bytes, out.Bytes) {
+				t.Fatalf("Re-encoded PCN differs from the input:\n%x\n%x", in.Bytes, out.Bytes)
+			}
+		}
+	})
+}
+
+func TestParsePCNRoundTrip(t *testing.T) {
+	pcn := testChain(t)
+	v1, err := pcn.ToFileFormat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := pcn.ToV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, err := ParsePCN(v1)
+	if err != nil {
+		t.Fatalf("Could not parse v1 PCN: %s", err)
+	}
+	if p1.Version != PCNVersion1 || len(p1.BatchProofs) != 0 {
+		t.Fatalf("v1 PCN parsed as version %d with %d batch proofs", p1.Version, len(p1.BatchProofs))
+	}
+	p2, err := ParsePCN(v2)
+	if err != nil {
+		t.Fatalf("Could not parse v2 PCN: %s", err)
+	}
+	if p2.Version != PCNVersion2 || len(p2.BatchProofs) != 1 || len(p2.Certs) != 2 || !bytes.Equal(p2.Certs[0].Raw, pcn.Certs[0].Raw) {
+		t.Fatalf("v2 PCN did not round trip: %+v", p2)
+	}
+	again, err := p2.ToV2()
+	if err != nil || !bytes.Equal(again, v2) {
+		t.Fatalf("v2 PCN has more than one encoding: %s", err)
+	}
+}
+
+func TestParsePCNRejectsNonCanonical(t *testing.T) {
+	pcn := testChain(t)
+	v2, err := pcn.ToV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(v2)
+	var fields pcnV2
+	if _, err = asn1.Unmarshal(block.Bytes, &fields); err != nil {
+		t.Fatal(err)
+	}
+	withDefault := fields
+	withDefault.Proofs = append([]pcnProof{}, fields.Proofs...)
+	withDefault.Proofs[0].HashStrategy = DefaultHashStrategy
+	cases := map[string]func(*pcnV2){
+		"empty batch proofs": func(p *pcnV2) { p.BatchProofs = []pcnProof{} },
+		"empty relay blocks": func(p *pcnV2) { p.RelayBlocks = [][]byte{} },
+		"empty checkpoints": func(p *pcnV2) { p.Checkpoints = [][]byte{} },
+		"empty policy book hash": func(p *pcnV2) { p.PolicyBookHash = []byte{} },
+		"default hash strategy": func(p *pcnV2) { *p = withDefault },
+	}
+	for name, change := range cases {
+		changed := fields
+		change(&changed)
+		der, err := asn1.Marshal(changed)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, err = ParsePCN(pem.EncodeToMemory(&pem.Block{Type: pcnPEMType, Bytes: der})); err == nil {
+			t.Fatalf("%s: non canonical PCN was accepted", name)
+		}
+	}
+}
+
+func TestAuditPathLength(t *testing.T) {
+	for size := int64(1); size <= 33; size++ {
+		leaves := make([][]byte, size)
+		for i := range leaves {
+			leaves[i] = []byte{byte(i)}
+		}
+		for index := int64(0); index < size; index++ {
+			proof := testProof(t, leaves, index, 0)
+			if got := auditPathLength(index, size); got != len(proof.Proof) {
+				t.Fatalf("auditPathLength(%d, %d) = %d, tree has %d hashes", index, size, got, len(proof.Proof))
+			}
+		}
+	}
+}
+
+func checkReason(t *testing.T, name string, err, want error) {
+	if want == nil {
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		return
+	}
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("%s: got %v, want a ValidationError (%s)", name, err, want)
+	}
+	if verr.Reason != want {
+		t.Fatalf("%s: got %s, want %s", name, verr, want)
+	}
+}
+
+func TestValidateProof(t *testing.T) {
+	leaves := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+	valid := testProof(t, leaves, 2, 3)
+
+	cases := []struct {
+		name string
+		edit func(v *ValidationInfo)
+		block bool
+		want error
+	}{
+		{"valid", func(v *ValidationInfo) {}, true, nil},
+		{"root as last hash", func(v *ValidationInfo) { *v = rootAsLastHash(*v) }, true, nil},
+		{"index equals NumLeaves", func(v *ValidationInfo) { v.LeafIndex = v.NumLeaves }, true, ErrLeafIndex},
+		{"index above NumLeaves", func(v *ValidationInfo) { v.LeafIndex = v.NumLeaves + 4 }, true, ErrLeafIndex},
+		{"negative index", func(v *ValidationInfo) { v.LeafIndex = -1 }, true, ErrLeafIndex},
+		{"empty tree", func(v *ValidationInfo) { v.NumLeaves = 0 }, true, ErrLeafIndex},
+		{"negative block index", func(v *ValidationInfo) { v.BlockIndex = -1 }, true, ErrBlockIndex},
+		{"unpublished batch proof", func(v *ValidationInfo) { v.BlockIndex = -1 }, false, nil},
+		{"no root, no hashes", func(v *ValidationInfo) { v.MerkleRoot, v.Proof = nil, nil }, true, ErrEmptyRoot},
+		{"empty last hash", func(v *ValidationInfo) { *v = rootAsLastHash(*v); v.Proof[len(v.Proof)-1] = []byte{} }, true, ErrEmptyRoot},
+		{"missing hash", func(v *ValidationInfo) { v.Proof = v.Proof[1:] }, true, ErrProofLength},
+		{"extra hash", func(v *ValidationInfo) { v.Proof = append(v.Proof, v.Proof[0]) }, true, ErrProofLength},
+		{"proof for a larger tree", func(v *ValidationInfo) { v.NumLeaves = 9 }, true, ErrProofLength},
+		{"short root", func(v *ValidationInfo) { v.MerkleRoot = v.MerkleRoot[:16] }, true, ErrHashLength},
+		{"short hash", func(v *ValidationInfo) { v.Proof[0] = v.Proof[0][:16] }, true, ErrHashLength},
+		{"unknown hash strategy", func(v *ValidationInfo) { v.HashStrategy = "MD5" }, true, ErrHashStrategy},
+	}
+	for _, c := range cases {
+		v := valid
+		v.Proof = append([][]byte{}, valid.Proof...)
+		c.edit(&v)
+		checkReason(t, c.name, validateProof("proof", &v, c.block), c.want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		edit func(p *ProofFile)
+		want error
+	}{
+		{"valid", func(p *ProofFile) {}, nil},
+		{"unpublished", func(p *ProofFile) { p.ProofList.ProofList = p.ProofList.ProofList[1:]; p.BatchProofs = nil }, nil},
+		{"no certs", func(p *ProofFile) { p.Certs = nil }, ErrNoCerts},
+		{"missing cert", func(p *ProofFile) { p.Certs[1] = nil }, ErrMalformedChain},
+		{"no proof list", func(p *ProofFile) { p.ProofList = nil }, ErrNoProofList},
+		{"too many proofs", func(p *ProofFile) { p.ProofList.ProofList = append(p.ProofList.ProofList, p.ProofList.ProofList[1]) }, ErrProofCount},
+		{"too few proofs", func(p *ProofFile) { p.ProofList.ProofList = nil }, ErrProofCount},
+		{"too many batch proofs", func(p *ProofFile) { p.BatchProofs = append(p.BatchProofs, p.BatchProofs[0], p.BatchProofs[0]) }, ErrProofCount},
+		{"block proof index out of range", func(p *ProofFile) { p.ProofList.ProofList[0].LeafIndex = 2 }, ErrLeafIndex},
+		{"batch proof index out of range", func(p *ProofFile) { p.BatchProofs[0].LeafIndex = 3 }, ErrLeafIndex},
+		{"batch proof without block", func(p *ProofFile) { p.BatchProofs[0].BlockIndex = -1 }, ErrBlockIndex},
+		{"empty root", func(p *ProofFile) { p.ProofList.ProofList[1].MerkleRoot = nil }, ErrEmptyRoot},
+		{"short batch proof", func(p *ProofFile) { p.BatchProofs[0].Proof = p.BatchProofs[0].Proof[1:] }, ErrProofLength},
+		{"statement without signature", func(p *ProofFile) { p.ProofList.Revoke.Cert = "REVOKE\n" }, ErrRevocation},
+		{"signature without statement", func(p *ProofFile) { p.ProofList.Revoke.Signature = []byte{1} }, ErrRevocation},
+		{"malformed statement", func(p *ProofFile) { p.ProofList.Revoke = ValidatorRevokeInfo{[]byte{1}, "REVOKE\nnot a cert"} }, ErrRevocation},
+	}
+	for _, c := range cases {
+		p := testChain(t)
+		c.edit(p)
+		checkReason(t, c.name, p.Validate(), c.want)
+	}
+}
+
+func TestLedgerRevocations(t *testing.T) {
+	revoked, _ := testCert(t, "revoked", nil, nil)
+	statement, err := NewRevocationStatement(StatementRevoke, ReasonUnspecified, time.Time{}, "", revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocation := func(edit func(p *ProofFile)) []byte {
+		p := testChain(t)
+		p.ProofList.Revoke = ValidatorRevokeInfo{[]byte{1}, statement.String()}
+		edit(p)
+		data, err := p.ToFileFormat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	valid := revocation(func(p *ProofFile) {})
+	//Accepted by pubcc before PCNs were validated strictly
+	legacy := revocation(func(p *ProofFile) { p.ProofList.ProofList = append(p.ProofList.ProofList, p.ProofList.ProofList[1]) })
+	malformed := revocation(func(p *ProofFile) { p.ProofList.Revoke.Cert = "REVOKE\nnot a cert" })
+	if _, err = ParsePCN(legacy); err == nil {
+		t.Fatalf("Legacy revocation passes strict parsing")
+	}
+
+	value, err := json.Marshal([][]byte{valid, []byte("not a pcn"), legacy, malformed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := LedgerRevocations(value)
+	if len(statements) != 2 || !bytes.Equal(statements[0].Cert.Raw, revoked.Raw) || !bytes.Equal(statements[1].Cert.Raw, revoked.Raw) {
+		t.Fatalf("Got %d statements, want the valid and the legacy revocation", len(statements))
+	}
+	if statements = LedgerRevocations([]byte("not json")); len(statements) != 0 {
+		t.Fatalf("Got %d statements from a malformed write", len(statements))
+	}
+}
@@ -0,0 +1,300 @@
+package blockchain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"net/url"
+	"crypto/x509"
+	"encoding/json"
+
+	"github.com/google/trillian/merkle"
+)
+
+//Source of the block level Merkle roots PCN proofs are checked against
+type RootSource interface {
+	//Root of the Merkle tree over the batch roots published in relay block index (the root certs for relay block 0), built
+	//with hash strategy. Sources that can't rebuild the tree fail if the block was built with a different strategy.
+	BlockRoot(index int64, strategy string) ([]byte, error)
+}
+
+//Source of the batch roots published on the ledger, for verifiers that can't rebuild relay block roots (e.g. the chaincode,
+//which only sees the world state)
+type BatchSource interface {
+	//Fails unless root was published as a batch root
+	BatchPublished(root []byte) error
+}
+
+//Each proof is checked with the hasher of the strategy it records. Without Roots the block level is checked against
+//Batches: the batch root must be published, the block level proof is only checked against the root it claims.
+type VerifyContext struct {
+	Roots RootSource
+	Batches BatchSource
+	Now time.Time // Time the validity periods are checked at, time.Now() if zero
+	TrustAnchors []*x509.Certificate // If set, the last cert of the chain must be one of them
+}
+
+//Why a level of a certificate's proof could not be checked
+var (
+	ErrNotPublished = errors.New("certificate has no proof, it is not published yet")
+	ErrNoBatchProof = errors.New("no batch proof for the certificate (v1 PCN)")
+)
+
+//Result of verifying one certificate of the chain. A nil error means the check passed.
+type CertReport struct {
+	Subject string
+	Signature error // Signed by the next cert of the chain (the last cert: self signed and a trust anchor)
+	Validity error // Within its validity period
+	Batch error // Included under its batch root
+	Block error // Batch root (the cert itself for relay block 0) included under the relay block root
+}
+
+func (r *CertReport) Err() error {
+	for _, err := range []error{r.Signature, r.Validity, r.Batch, r.Block} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type VerifyReport struct {
+	Certs []CertReport // Same order as ProofFile.Certs
+}
+
+//First failed check, nil if every certificate passed every check
+func (r *VerifyReport) Err() error {
+	for _, cert := range r.Certs {
+		if err := cert.Err(); err != nil {
+			return fmt.Errorf("%s: %s", cert.Subject, err)
+		}
+	}
+	return nil
+}
+
+func verifyInclusion(v *ValidationInfo, root, leaf []byte) error {
+	hasher, err := v.Hasher()
+	if err != nil {
+		return err
+	}
+	hashes := v.Proof
+	if len(v.MerkleRoot) == 0 {
+		//Block level proofs written by the PM carry the root as the last hash
+		if len(hashes) == 0 {
+			return errors.New("empty proof")
+		}
+		hashes = hashes[:len(hashes)-1]
+	}
+	return merkle.NewLogVerifier(hasher).VerifyInclusionProof(v.LeafIndex, v.NumLeaves, hashes, root, hasher.HashLeaf(leaf))
+}
+
+//Root a proof claims, either MerkleRoot or the last hash
+func claimedRoot(v *ValidationInfo) []byte {
+	if len(v.MerkleRoot) != 0 || len(v.Proof) == 0 {
+		return v.MerkleRoot
+	}
+	return v.Proof[len(v.Proof)-1]
+}
+
+//Verifies every certificate of the chain: the X.509 signature, the validity period, the inclusion of the cert under its
+//batch root and of the batch root under the root of its relay block, as supplied by ctx.Roots (or ctx.Batches). The returned error is only set
+//if the PCN is malformed, the outcome of each check is in the report.
+func (p *ProofFile) Verify(ctx VerifyContext) (*VerifyReport, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	now := ctx.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	//Proofs are aligned with the end of the chain, the newest cert has none until it is published
+	proofs := p.ProofList.ProofList
+	offset := len(p.Certs) - len(proofs)
+	report := &VerifyReport{}
+	for i, cert := range p.Certs {
+		r := CertReport{Subject: cert.Subject.CommonName}
+
+		if i+1 < len(p.Certs) {
+			r.Signature = cert.CheckSignatureFrom(p.Certs[i+1])
+		} else {
+			r.Signature = cert.CheckSignatureFrom(cert)
+			if r.Signature == nil && ctx.TrustAnchors != nil {
+				r.Signature = errors.New("root certificate is not a trust anchor")
+				for _, anchor := range ctx.TrustAnchors {
+					if bytes.Equal(anchor.Raw, cert.Raw) {
+						r.Signature = nil
+						break
+					}
+				}
+			}
+		}
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			r.Validity = fmt.Errorf("not valid at %s (valid %s to %s)", now.Format(time.RFC3339), cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+		}
+
+		if i < offset {
+			r.Batch, r.Block = ErrNotPublished, ErrNotPublished
+			report.Certs = append(report.Certs, r)
+			continue
+		}
+		block := &proofs[i-offset]
+		blockRoot := claimedRoot(block)
+		if ctx.Roots != nil {
+			root, err := ctx.Roots.BlockRoot(block.BlockIndex, block.HashStrategy)
+			if err != nil {
+				r.Block = fmt.Errorf("could not look up root of relay block %d: %s", block.BlockIndex, err)
+			} else if !bytes.Equal(blockRoot, root) {
+				r.Block = fmt.Errorf("proof is for a different root than relay block %d", block.BlockIndex)
+			}
+		} else if ctx.Batches == nil {
+			r.Block = errors.New("no source of relay block or batch roots")
+		}
+
+		//Root certs are published directly in relay block 0, everything else through a batch
+		leaf := cert.Raw
+		if block.BlockIndex != 0 && i-offset >= len(p.BatchProofs) {
+			r.Batch = ErrNoBatchProof
+			if r.Block == nil {
+				r.Block = ErrNoBatchProof
+			}
+		} else if block.BlockIndex != 0 {
+			batch := &p.BatchProofs[i-offset]
+			leaf = claimedRoot(batch)
+			if batch.BlockIndex != block.BlockIndex {
+				r.Batch = fmt.Errorf("batch proof is for relay block %d, block proof for relay block %d", batch.BlockIndex, block.BlockIndex)
+			} else if err := verifyInclusion(batch, leaf, cert.Raw); err != nil {
+				r.Batch = fmt.Errorf("not included under batch root: %s", err)
+			}
+		}
+		if r.Block == nil {
+			if err := verifyInclusion(block, blockRoot, leaf); err != nil {
+				r.Block = fmt.Errorf("not included under the root of relay block %d: %s", block.BlockIndex, err)
+			} else if ctx.Roots == nil {
+				if err := ctx.Batches.BatchPublished(leaf); err != nil {
+					r.Block = fmt.Errorf("batch root is not published: %s", err)
+				}
+			}
+		}
+		report.Certs = append(report.Certs, r)
+	}
+	return report, nil
+}
+
+//Block roots read from the ledger
+type LedgerRoots struct {
+	SdkLock *sync.Mutex //Must acquire before using FSetup
+	FSetup *FabricSetup
+}
+
+//Leaves of the block level tree of relay block index: the batch roots published in the fabric block, or the root certs for
+//relay block 0
+func (l LedgerRoots) blockLeaves(index int64) ([][]byte, error) {
+	if index < 0 {
+		return nil, fmt.Errorf("invalid relay block %d", index)
+	}
+	l.SdkLock.Lock()
+	block, err := l.FSetup.GetBlock(uint64(index) + BlockOffset)
+	l.SdkLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var leaves [][]byte
+	for txIndex, valid := range block.Metadata.Metadata[2] {
+		if valid != 0 {
+			continue
+		}
+		for _, write := range block.Transactions[txIndex].Writes {
+			key, err := url.QueryUnescape(write.KvRwSet.Writes[0].Key)
+			if err != nil {
+				return nil, err
+			}
+			if index != 0 {
+				leaves = append(leaves, []byte(key))
+				continue
+			}
+			//The chaincode instantiation block publishes the root certs
+			var certs [][]byte
+			if err = json.Unmarshal(write.KvRwSet.Writes[0].Value, &certs); err != nil {
+				return nil, err
+			}
+			leaves = append(leaves, certs...)
+		}
+	}
+	return leaves, nil
+}
+
+func (l LedgerRoots) BlockRoot(index int64, strategy string) ([]byte, error) {
+	leaves, err := l.blockLeaves(index)
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := NewHasher(strategy)
+	if err != nil {
+		return nil, err
+	}
+	tree := merkle.NewInMemoryMerkleTree(hasher)
+	for _, leaf := range leaves {
+		tree.AddLeaf(leaf)
+	}
+	return tree.CurrentRoot().Hash(), nil
+}
+
+//Block level proof of leaf (a batch root, or a root cert for relay block 0) in relay block index, for proofs of publication
+//that only carry the batch level proof
+func (l LedgerRoots) BlockProof(index int64, strategy string, leaf []byte) (*ValidationInfo, error) {
+	leaves, err := l.blockLeaves(index)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := NewBatch(leaves, strategy)
+	if err != nil {
+		return nil, err
+	}
+	leafIndex := tree.Find(leaf)
+	if leafIndex < 0 {
+		return nil, fmt.Errorf("not published in relay block %d", index)
+	}
+	proof, err := tree.Proof(leafIndex)
+	if err != nil {
+		return nil, err
+	}
+	proof.BlockIndex = index
+	return proof, nil
+}
+
+//Caches the roots of another source, relay block roots never change once published
+type CachedRoots struct {
+	Source RootSource
+	lock sync.Mutex
+	roots map[cachedRoot][]byte
+}
+
+type cachedRoot struct {
+	index int64
+	strategy string
+}
+
+func NewCachedRoots(source RootSource) *CachedRoots {
+	return &CachedRoots{Source: source, roots: make(map[cachedRoot][]byte)}
+}
+
+func (c *CachedRoots) BlockRoot(index int64, strategy string) ([]byte, error) {
+	key := cachedRoot{index, RecordedHashStrategy(strategy)}
+	c.lock.Lock()
+	root, ok := c.roots[key]
+	c.lock.Unlock()
+	if ok {
+		return root, nil
+	}
+	root, err := c.Source.BlockRoot(index, strategy)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.roots[key] = root
+	c.lock.Unlock()
+	return root, nil
+}
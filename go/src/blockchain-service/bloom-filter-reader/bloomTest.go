@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"bytes"
 	"github.com/willf/bloom"
+	"blockchain-service/relay/relayWire"
 )
 
 // Exit Code 0: Data is part of bloom filter
@@ -43,7 +44,15 @@ func main() {
 		os.Exit(2)
 	}
 
-	if err = json.Unmarshal(filterJson, &ff); err != nil {
+	//The filter file is either a JSON bloom message or a binary one (as published on the -bloomfilters-bin topic)
+	if relayWire.IsBinary(filterJson) {
+		var bloomMsg relayWire.BloomMessage
+		if err = bloomMsg.UnmarshalBinary(filterJson); err != nil {
+			fmt.Printf("Could not decode binary bloom filter file: %s\n", err)
+			os.Exit(2)
+		}
+		ff = filterFile{int(bloomMsg.Index), bloomMsg.Filter}
+	} else if err = json.Unmarshal(filterJson, &ff); err != nil {
 		fmt.Printf("Could not json unmarshal bloom filter file: %s\n", err)
 		os.Exit(2)
 	}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"flag"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/base64"
+
+	"github.com/boltdb/bolt"
+
+	"blockchain-service/blockchain"
+)
+
+// Content addressed store of permission marshal publication batches. The ledger only holds batch roots, the store keeps the
+// leaves of every batch under its root so proofs can be rebuilt and a root can be resolved to what it committed to, even if
+// the issuing PM is lost.
+//
+// PUT  /batches/<root hex>                  Store a batch (JSON {"leaves": [...]}), rejected unless the leaves hash to root
+// GET  /batches/<root hex>                  The batch stored under root
+// GET  /proof?root=<hex>&index=<n>          Inclusion proof of leaf n (0 based)
+// GET  /proof?root=<hex>&leaf=<base64>      Inclusion proof of the given leaf
+// GET  /proofs?leaf=<base64>                Inclusion proofs of the given leaf in every stored batch that holds it
+//
+// Uploads are not authenticated and roots are not checked against the ledger, so a leaf may be stored under roots that were
+// never published. /proofs returns all of them, callers keep the proof whose root they find on the ledger.
+
+//Largest batch accepted on upload
+const maxBatchSize = 64 << 20
+
+var db *bolt.DB
+
+func getBatch(root []byte) (*blockchain.Batch, error) {
+	var batch *blockchain.Batch
+	err := db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte("BATCHES")).Get(root)
+		if value == nil {
+			return nil
+		}
+		batch = &blockchain.Batch{}
+		return json.Unmarshal(value, batch)
+	})
+	return batch, err
+}
+
+//Verifies batch against its root and stores it. Storing a batch again has no effect.
+func putBatch(batch *blockchain.Batch) (bool, error) {
+	if err := batch.Verify(); err != nil {
+		return false, err
+	}
+	value, err := json.Marshal(batch)
+	if err != nil {
+		return false, err
+	}
+	created := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("BATCHES"))
+		if bucket.Get(batch.Root) != nil {
+			return nil
+		}
+		created = true
+		if err := bucket.Put(batch.Root, value); err != nil {
+			return err
+		}
+		return indexLeaves(tx, batch)
+	})
+	return created, err
+}
+
+//Records the root of batch under the sha256 of each of its leaves (LEAVES/<sha256 of leaf>/<root>)
+func indexLeaves(tx *bolt.Tx, batch *blockchain.Batch) error {
+	leaves := tx.Bucket([]byte("LEAVES"))
+	for _, leaf := range batch.Leaves {
+		sum := sha256.Sum256(leaf)
+		roots, err := leaves.CreateBucketIfNotExists(sum[:])
+		if err != nil {
+			return err
+		}
+		if err = roots.Put(batch.Root, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Roots of every stored batch that holds leaf
+func findRoots(leaf []byte) ([][]byte, error) {
+	var found [][]byte
+	sum := sha256.Sum256(leaf)
+	err := db.View(func(tx *bolt.Tx) error {
+		roots := tx.Bucket([]byte("LEAVES")).Bucket(sum[:])
+		if roots == nil {
+			return nil
+		}
+		return roots.ForEach(func(root, _ []byte) error {
+			found = append(found, append([]byte{}, root...))
+			return nil
+		})
+	})
+	return found, err
+}
+
+func parseRoot(s string) ([]byte, error) {
+	root, err := hex.DecodeString(s)
+	if err != nil || len(root) == 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid batch root %q\n", s))
+	}
+	return root, nil
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	root, err := parseRoot(strings.TrimPrefix(r.URL.Path, "/batches/"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		batch, err := getBatch(root)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Could not read batch: %s\n", err)
+			return
+		}
+		if batch == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "No batch stored under %x\n", root)
+			return
+		}
+		batchStr, err := json.Marshal(batch)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Could not marshal batch: %s\n", err)
+			return
+		}
+		w.Write(batchStr)
+	case http.MethodPut, http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchSize))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not read body of HTTP request: %s\n", err)
+			return
+		}
+		var batch blockchain.Batch
+		if err = json.Unmarshal(body, &batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not parse batch: %s\n", err)
+			return
+		}
+		if batch.Root != nil && !bytes.Equal(batch.Root, root) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Batch root %x does not match url\n", batch.Root)
+			return
+		}
+		batch.Root = root
+		created, err := putBatch(&batch)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not store batch: %s", err)
+			fmt.Printf("Rejected batch %x: %s", root, err)
+			return
+		}
+		if created {
+			fmt.Printf("Stored batch %x (%d leaves)\n", root, len(batch.Leaves))
+			w.WriteHeader(http.StatusCreated)
+		}
+		fmt.Fprintf(w, "%x\n", root)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method %s not allowed\n", r.Method)
+	}
+}
+
+func proofHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	root, err := parseRoot(q.Get("root"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	batch, err := getBatch(root)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not read batch: %s\n", err)
+		return
+	}
+	if batch == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No batch stored under %x\n", root)
+		return
+	}
+
+	var index int64
+	if leafStr := q.Get("leaf"); leafStr != "" {
+		leaf, err := base64.StdEncoding.DecodeString(leafStr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not decode leaf: %s\n", err)
+			return
+		}
+		if index = batch.Find(leaf); index < 0 {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Leaf not in batch %x\n", root)
+			return
+		}
+	} else if index, err = strconv.ParseInt(q.Get("index"), 10, 64); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Provide a leaf or an index\n")
+		return
+	}
+
+	proof, err := batch.Proof(index)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	proofStr, err := json.Marshal(proof)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not marshal proof: %s\n", err)
+		return
+	}
+	w.Write(proofStr)
+}
+
+func proofsHandler(w http.ResponseWriter, r *http.Request) {
+	leaf, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("leaf"))
+	if err != nil || len(leaf) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Provide a base64 leaf\n")
+		return
+	}
+	roots, err := findRoots(leaf)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not read leaf index: %s\n", err)
+		return
+	}
+	if len(roots) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Leaf not in any stored batch\n")
+		return
+	}
+
+	proofs := []*blockchain.ValidationInfo{}
+	for _, root := range roots {
+		batch, err := getBatch(root)
+		if err != nil || batch == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Could not read batch %x: %s\n", root, err)
+			return
+		}
+		proof, err := batch.Proof(batch.Find(leaf))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		proofs = append(proofs, proof)
+	}
+	proofsStr, err := json.Marshal(proofs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not marshal proofs: %s\n", err)
+		return
+	}
+	w.Write(proofsStr)
+}
+
+func main() {
+	addr := flag.String("addr", ":8082", "Address the store listens on")
+	dbPath := flag.String("db", "./data/availability.db", "Bolt database the batches are kept in")
+	cert := flag.String("cert", "", "TLS certificate, plain HTTP if empty")
+	key := flag.String("key", "", "TLS key")
+	flag.Parse()
+
+	var err error
+	if db, err = bolt.Open(*dbPath, 0600, nil); err != nil {
+		log.Fatalf("Could not open %s: %s\n", *dbPath, err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"BATCHES", "LEAVES"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Could not init data store: %s\n", err)
+	}
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/batches/", batchHandler)
+	serveMux.HandleFunc("/proof", proofHandler)
+	serveMux.HandleFunc("/proofs", proofsHandler)
+	fmt.Printf("Availability Store Listening on %s\n", *addr)
+	if *cert != "" {
+		log.Fatal(http.ListenAndServeTLS(*addr, *cert, *key, serveMux))
+	}
+	log.Fatal(http.ListenAndServe(*addr, serveMux))
+}
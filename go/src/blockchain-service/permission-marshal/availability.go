@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"time"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+
+	"blockchain-service/blockchain"
+)
+
+//Availability store (availability-store) published batches are uploaded to, disabled if empty
+var availabilityUrl string
+
+var availabilityClient = &http.Client{Timeout: 30 * time.Second}
+
+//Queues a published batch for upload. Batches stay in the UPLOADS bucket until the availability store has accepted them.
+func queueBatch(batch *blockchain.Batch) error {
+	if availabilityUrl == "" {
+		return nil
+	}
+	batchStr, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("UPLOADS")).Put(batch.Root, batchStr)
+	})
+}
+
+//Uploads every queued batch, batches that fail are retried on the next call
+func uploadBatches() {
+	if availabilityUrl == "" {
+		return
+	}
+	var queued []blockchain.Batch
+	dbLock.Lock()
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("UPLOADS")).ForEach(func(k, v []byte) error {
+			var batch blockchain.Batch
+			if err := json.Unmarshal(v, &batch); err != nil {
+				return err
+			}
+			queued = append(queued, batch)
+			return nil
+		})
+	})
+	dbLock.Unlock()
+	if err != nil {
+		fmt.Printf("Could not read queued batches: %s\n", err)
+		return
+	}
+
+	for _, batch := range queued {
+		if err := uploadBatch(&batch); err != nil {
+			fmt.Printf("Could not upload batch %x to the availability store: %s\n", batch.Root, err)
+			continue
+		}
+		fmt.Printf("Uploaded batch %x to the availability store\n", batch.Root)
+		dbLock.Lock()
+		err = db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("UPLOADS")).Delete(batch.Root)
+		})
+		dbLock.Unlock()
+		if err != nil {
+			fmt.Printf("Could not dequeue batch %x: %s\n", batch.Root, err)
+		}
+	}
+}
+
+func uploadBatch(batch *blockchain.Batch) error {
+	batchStr, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/batches/%x", strings.TrimRight(availabilityUrl, "/"), batch.Root), bytes.NewReader(batchStr))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := availabilityClient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.New(fmt.Sprintf("%s: %s", resp.Status, body))
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"time"
+	"net/http"
+	"io/ioutil"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+
+	"blockchain-service/blockchain"
+)
+
+/*
+Federation between Permission Marshals.
+Every PM serves a signed feed of the certificates it published (/federation/feed) and mirrors the feeds of the PMs listed in
+its federation config. A mirrored certificate is only stored after its inclusion under a Merkle root on the ledger has been
+verified, the feed signature only authenticates which PM it came from. Mirrored certificates are served like local ones
+(e.g. /csr/get/my_csrs) and can be revoked through this PM.
+*/
+
+//Federated PM whose feed is mirrored
+type federationPeer struct {
+	Name string `json:"name"`
+	Url string `json:"url"` // e.g. https://pm2:8080
+	Cert string `json:"cert"` // Certificate of the key the peer signs its feed with (its webserver cert), also trusted for TLS
+	key *rsa.PublicKey
+	client *http.Client
+}
+
+type federationConfig struct {
+	Name string `json:"name"` // Name of this PM, reported in its feed
+	Key string `json:"key"` // RSA key the feed is signed with
+	PollInterval int `json:"pollInterval"` // Seconds between polls of the peers' feeds
+	Peers []*federationPeer `json:"peers"`
+}
+
+//Published certificate as listed in a federation feed
+type feedEntry struct {
+	Cert []byte `json:"cert"`
+	PCN []byte `json:"pcn"`
+	PubValidationInfo blockchain.ValidationInfo `json:"pubValidationInfo"`
+	BroadcastValidationInfo blockchain.ValidationInfo `json:"broadcastValidationInfo"`
+}
+
+//Certificates published by Origin in blocks Since to Height-1. The PM handles blocks in order, so the list is complete and a
+//mirror continues with since=Height.
+type feed struct {
+	Origin string `json:"origin"`
+	Since uint64 `json:"since"`
+	Height uint64 `json:"height"`
+	Entries []feedEntry `json:"entries"`
+}
+
+type signedFeed struct {
+	Feed json.RawMessage `json:"feed"`
+	Signature []byte `json:"signature"` // RSA_SIG(SHA256(feed))
+}
+
+var federation = federationConfig{Key: "certs/gpchain-webserver.key", PollInterval: 30}
+var federationKey *rsa.PrivateKey
+
+//Loads the federation config. Without a config file the feed is still served (signed with the webserver key) but nothing
+//is mirrored.
+func initFederation(path string) error {
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(data, &federation); err != nil {
+			return errors.New(fmt.Sprintf("Could not parse federation config %s: %s\n", path, err))
+		}
+	}
+	if federation.PollInterval <= 0 {
+		return errors.New("Federation poll interval must be positive\n")
+	}
+
+	data, err := ioutil.ReadFile(federation.Key)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New(fmt.Sprintf("No PEM data found in %s\n", federation.Key))
+	}
+	if federationKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Could not parse federation key %s: %s\n", federation.Key, err))
+		}
+		var ok bool
+		if federationKey, ok = key.(*rsa.PrivateKey); !ok {
+			return errors.New(fmt.Sprintf("%s is not an RSA key\n", federation.Key))
+		}
+	}
+
+	for _, peer := range federation.Peers {
+		if peer.Name == "" || peer.Url == "" {
+			return errors.New("Federation peers need a name and a url\n")
+		}
+		data, err := ioutil.ReadFile(peer.Cert)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return errors.New(fmt.Sprintf("No PEM data found in %s\n", peer.Cert))
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if peer.key, ok = cert.PublicKey.(*rsa.PublicKey); !ok {
+			return errors.New(fmt.Sprintf("%s does not contain an RSA key\n", peer.Cert))
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		roots.AddCert(cert)
+		peer.client = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+	return nil
+}
+
+//Serves the signed feed of certificates published by this PM since block ?since=<n> (default 0)
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	var err error
+	if s := r.URL.Query().Get("since"); s != "" {
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid since: %s\n", err)
+			return
+		}
+	}
+	f := feed{Origin: federation.Name, Since: since, Height: resumeHeight(), Entries: []feedEntry{}}
+
+	dbLock.Lock()
+	err = db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("USERS"))
+		outter := root.Cursor()
+		for user,_ := outter.First(); user != nil; user,_ = outter.Next() {
+			inner := root.Bucket(user).Cursor()
+			for k,v := inner.First(); k != nil; k,v = inner.Next() {
+				var value dbValue
+				if err := json.Unmarshal(v, &value); err != nil {
+					return err
+				}
+				//Only certs published by this PM, once (entries are stored under the requestor and the CA)
+				if value.Status != PUBLISHED || value.Origin != "" || value.PCN == nil || strings.ToLower(value.From) != string(user) {
+					continue
+				}
+				height := value.PubValidationInfo.BlockIndex
+				if height < int64(since) || height >= int64(f.Height) {
+					continue
+				}
+				f.Entries = append(f.Entries, feedEntry{value.Data, value.PCN, value.PubValidationInfo, value.BroadcastValidationInfo})
+			}
+		}
+		return nil
+	})
+	dbLock.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not read published certificates: %s\n", err)
+		fmt.Printf("Could not read published certificates: %s\n", err)
+		return
+	}
+
+	feedStr, err := json.Marshal(f)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not marshal feed: %s\n", err)
+		return
+	}
+	hash := sha256.Sum256(feedStr)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, federationKey, crypto.SHA256, hash[:])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not sign feed: %s\n", err)
+		fmt.Printf("Could not sign feed: %s\n", err)
+		return
+	}
+	signedStr, err := json.Marshal(signedFeed{feedStr, sig})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not marshal feed: %s\n", err)
+		return
+	}
+	w.Write(signedStr)
+}
+
+func federationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/federation/feed":
+		feedHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound);
+		fmt.Fprintf(w, "%s", "404 Page Not Found")
+		return
+	}
+}
+
+//Block the feed of peer is mirrored up to (exclusive), persisted in META
+func peerCursor(peer string) (uint64, error) {
+	var since uint64
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	err := db.View(func(tx *bolt.Tx) error {
+		if cursor := tx.Bucket([]byte("META")).Get([]byte("federation:" + peer)); cursor != nil {
+			if len(cursor) != 8 {
+				return errors.New(fmt.Sprintf("Invalid federation cursor for %s in data store\n", peer))
+			}
+			since = binary.BigEndian.Uint64(cursor)
+		}
+		return nil
+	})
+	return since, err
+}
+
+func setPeerCursor(peer string, height uint64) error {
+	var cursor [8]byte
+	binary.BigEndian.PutUint64(cursor[:], height)
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("META")).Put([]byte("federation:" + peer), cursor[:])
+	})
+}
+
+//Fetches and verifies the peer's feed since its cursor and mirrors every entry. The cursor only advances when every entry
+//was mirrored, so an entry that can't be verified (e.g. the ledger is unreachable) is retried on the next poll.
+func pollPeer(peer *federationPeer) error {
+	since, err := peerCursor(peer.Name)
+	if err != nil {
+		return err
+	}
+	resp, err := peer.client.Get(fmt.Sprintf("%s/federation/feed?since=%d", strings.TrimRight(peer.Url, "/"), since))
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Feed request failed (%s): %s\n", resp.Status, body))
+	}
+
+	var signed signedFeed
+	if err = json.Unmarshal(body, &signed); err != nil {
+		return err
+	}
+	hash := sha256.Sum256(signed.Feed)
+	if err = rsa.VerifyPKCS1v15(peer.key, crypto.SHA256, hash[:], signed.Signature); err != nil {
+		return errors.New(fmt.Sprintf("Invalid feed signature: %s\n", err))
+	}
+	var f feed
+	if err = json.Unmarshal(signed.Feed, &f); err != nil {
+		return err
+	}
+	if f.Since != since || f.Height < since {
+		return errors.New(fmt.Sprintf("Feed covers blocks %d to %d, requested from %d\n", f.Since, f.Height, since))
+	}
+
+	for _, entry := range f.Entries {
+		if err = mirrorEntry(peer.Name, &entry); err != nil {
+			return err
+		}
+	}
+	if f.Height == since {
+		return nil
+	}
+	fmt.Printf("Federation: Mirrored %d certificates from %s (blocks %d to %d)\n", len(f.Entries), peer.Name, since, f.Height-1)
+	return setPeerCursor(peer.Name, f.Height)
+}
+
+//Verifies a feed entry against the ledger and stores it under the subject and the CA. Entries managed by this PM, revoked
+//certificates and entries mirrored from another peer are left untouched. With -cascade, entries below a revoked certificate
+//are stored as REVOKED_CASCADED.
+func mirrorEntry(origin string, entry *feedEntry) error {
+	cert, err := x509.ParseCertificate(entry.Cert)
+	if err != nil {
+		return err
+	}
+	key, err := entryKey(cert.PublicKey)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Certificate of %s: %s", cert.Subject.CommonName, err))
+	}
+	pcn, err := blockchain.ParsePCN(entry.PCN)
+	if err != nil {
+		return err
+	}
+	if len(pcn.Certs) == 0 || !bytes.Equal(pcn.Certs[0].Raw, cert.Raw) {
+		return errors.New(fmt.Sprintf("PCN of %s is for a different certificate\n", cert.Subject.CommonName))
+	}
+	value := dbValue{cert.Raw, strings.ToLower(cert.Issuer.CommonName), strings.ToLower(cert.Subject.CommonName), PUBLISHED, entry.PubValidationInfo, entry.BroadcastValidationInfo, entry.PCN, origin, nil, nil, false}
+	if err = verifyPublication(&value); err != nil {
+		return errors.New(fmt.Sprintf("Could not verify publication of %s: %s\n", cert.Subject.CommonName, err))
+	}
+	//Certs mirrored after the revocation of an ancestor was published are cascaded on arrival
+	if cascadeRevocations {
+		if err = isChainRevoked(pcn.Certs[1:]); err != nil {
+			fmt.Printf("Federation: %s is below a revoked certificate (%s)\n", cert.Subject.CommonName, strings.TrimSpace(err.Error()))
+			value.Status = REVOKED_CASCADED
+		}
+	}
+
+	valueString, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	dbLock.Lock()
+	err = db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("USERS"))
+		bucket, err := root.CreateBucketIfNotExists([]byte(value.From))
+		if err != nil {
+			return err
+		}
+		if temp := bucket.Get(key); temp != nil {
+			var existing dbValue
+			if err := json.Unmarshal(temp, &existing); err != nil {
+				return err
+			}
+			if existing.Origin != origin || existing.Status != PUBLISHED {
+				fmt.Printf("Federation: %s already known (status %d), not mirroring from %s\n", value.From, existing.Status, origin)
+				return nil
+			}
+		}
+		if err = bucket.Put(key, valueString); err != nil {
+			return err
+		}
+		bucket, err = root.CreateBucketIfNotExists([]byte(value.To))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, valueString)
+	})
+	dbLock.Unlock()
+	return err
+}
+
+//Every PollInterval seconds mirror the feeds of all peers
+func mirror(stop, done chan bool) {
+	defer func() {
+		done <- true
+	}()
+	if len(federation.Peers) == 0 {
+		<-stop
+		return
+	}
+	ticker := time.NewTicker(time.Duration(federation.PollInterval) * time.Second)
+	defer ticker.Stop()
+	for true {
+		for _, peer := range federation.Peers {
+			if err := pollPeer(peer); err != nil {
+				fmt.Printf("Federation: Could not mirror %s: %s\n", peer.Name, err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
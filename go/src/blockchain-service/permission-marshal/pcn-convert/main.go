@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"sort"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/base64"
+
+	"blockchain-service/blockchain"
+	"blockchain-service/relay/relayWire"
+)
+
+// Converts PCN files between the v1 (PEM certificates + JSON proof list) and v2 (PEM armored DER) formats. When upgrading,
+// the relay blocks the proofs refer to can be bundled so the v2 PCN can be verified without contacting the relay, and the
+// batch proofs a v1 PCN lacks can be fetched from an availability store.
+//
+// Exit Code 0: Converted
+// Exit Code 2: Error occurred
+
+//Fetches relay block index from the relay's block request api in the binary encoding
+func fetchRelayBlock(relayUrl string, index int64) ([]byte, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/blocks?blockNumber=%d", strings.TrimRight(relayUrl, "/"), index))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var msg relayWire.RelayBlockMessage
+	if err = json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("relay block %d: %s (%s)", index, err, strings.TrimSpace(string(body)))
+	}
+	if msg.Block.Index != uint64(index) {
+		return nil, fmt.Errorf("relay returned block %d for block %d", msg.Block.Index, index)
+	}
+	return msg.MarshalBinary()
+}
+
+//Fetches the proofs of leaf in every batch the availability store holds it in
+func fetchBatchProofs(availabilityUrl string, leaf []byte) ([]blockchain.ValidationInfo, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/proofs?leaf=%s", strings.TrimRight(availabilityUrl, "/"), url.QueryEscape(base64.StdEncoding.EncodeToString(leaf))))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s (%s)", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var proofs []blockchain.ValidationInfo
+	if err = json.Unmarshal(body, &proofs); err != nil {
+		return nil, err
+	}
+	return proofs, nil
+}
+
+//Checks leaf (a batch root) is included under the root of the block level proof, which the PM writes as the last hash
+func verifyBlockLeaf(block blockchain.ValidationInfo, leaf []byte) error {
+	if len(block.MerkleRoot) == 0 && len(block.Proof) != 0 {
+		block.MerkleRoot = block.Proof[len(block.Proof)-1]
+		block.Proof = block.Proof[:len(block.Proof)-1]
+	}
+	return block.VerifyLeaf(leaf)
+}
+
+//Adds the batch proofs the PCN lacks (v1 PCNs carry none). Batch proofs are aligned with the block level proofs from the
+//front, so they are added in order up to the root certs, which are published without a batch.
+func addBatchProofs(pcn *blockchain.ProofFile, availabilityUrl string) error {
+	proofs := pcn.ProofList.ProofList
+	offset := len(pcn.Certs) - len(proofs)
+	for i := len(pcn.BatchProofs); i < len(proofs); i++ {
+		if proofs[i].BlockIndex == 0 {
+			break
+		}
+		cert := pcn.Certs[i+offset]
+		candidates, err := fetchBatchProofs(availabilityUrl, cert.Raw)
+		if err != nil {
+			return fmt.Errorf("batch of %s: %s", cert.Subject.CommonName, err)
+		}
+		//The store does not check roots against the ledger, keep the batch whose root is in the cert's relay block
+		var batch *blockchain.ValidationInfo
+		for j := range candidates {
+			if candidates[j].VerifyLeaf(cert.Raw) == nil && verifyBlockLeaf(proofs[i], candidates[j].MerkleRoot) == nil {
+				batch = &candidates[j]
+				break
+			}
+		}
+		if batch == nil {
+			return fmt.Errorf("none of the %d batches holding %s is in relay block %d", len(candidates), cert.Subject.CommonName, proofs[i].BlockIndex)
+		}
+		batch.BlockIndex = proofs[i].BlockIndex
+		pcn.BatchProofs = append(pcn.BatchProofs, *batch)
+	}
+	return nil
+}
+
+//Relay blocks the proofs of the PCN refer to
+func proofBlocks(pcn *blockchain.ProofFile) []int64 {
+	seen := make(map[int64]bool)
+	var indexes []int64
+	proofs := append([]blockchain.ValidationInfo{}, pcn.BatchProofs...)
+	if pcn.ProofList != nil {
+		proofs = append(proofs, pcn.ProofList.ProofList...)
+	}
+	for _, proof := range proofs {
+		if proof.BlockIndex >= 0 && !seen[proof.BlockIndex] {
+			seen[proof.BlockIndex] = true
+			indexes = append(indexes, proof.BlockIndex)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes
+}
+
+func main() {
+	in := flag.String("in", "", "PCN file to convert (v1 or v2)")
+	out := flag.String("out", "", "Output file, defaults to stdout")
+	toV1 := flag.Bool("v1", false, "Write the v1 format instead (drops everything v1 can't hold)")
+	relayUrl := flag.String("relay_url", "", "Block request api of the relay (e.g. http://relay:8081), bundles the relay blocks the proofs refer to")
+	policyBook := flag.String("policy_book", "", "Policy book the chain was evaluated against, its hash is recorded in the PCN")
+	availabilityUrl := flag.String("availability_url", "", "Availability store (e.g. http://store:8082) the batch proofs the PCN lacks are fetched from")
+	flag.Parse()
+
+	if *in == "" {
+		fmt.Printf("-in is required\n")
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadFile(*in)
+	if err != nil {
+		fmt.Printf("Could not read %s: %s\n", *in, err)
+		os.Exit(2)
+	}
+	pcn, err := blockchain.ParsePCN(data)
+	if err != nil {
+		fmt.Printf("Could not parse %s: %s\n", *in, err)
+		os.Exit(2)
+	}
+
+	if *policyBook != "" {
+		book, err := ioutil.ReadFile(*policyBook)
+		if err != nil {
+			fmt.Printf("Could not read policy book: %s\n", err)
+			os.Exit(2)
+		}
+		sum := sha256.Sum256(book)
+		pcn.PolicyBookHash = sum[:]
+	}
+	if *availabilityUrl != "" {
+		if err = addBatchProofs(pcn, *availabilityUrl); err != nil {
+			fmt.Printf("Could not add batch proofs: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if *relayUrl != "" {
+		pcn.RelayBlocks = nil
+		for _, index := range proofBlocks(pcn) {
+			block, err := fetchRelayBlock(*relayUrl, index)
+			if err != nil {
+				fmt.Printf("Could not fetch relay block: %s\n", err)
+				os.Exit(2)
+			}
+			pcn.RelayBlocks = append(pcn.RelayBlocks, block)
+		}
+	}
+
+	var converted []byte
+	if *toV1 {
+		converted, err = pcn.ToFileFormat()
+	} else {
+		converted, err = pcn.ToV2()
+	}
+	if err != nil {
+		fmt.Printf("Could not encode PCN: %s\n", err)
+		os.Exit(2)
+	}
+	if *out == "" {
+		os.Stdout.Write(converted)
+		return
+	}
+	if err = ioutil.WriteFile(*out, converted, 0644); err != nil {
+		fmt.Printf("Could not write %s: %s\n", *out, err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,55 @@
+package pmTypes
+
+import (
+	"fmt"
+	"errors"
+	"crypto/rsa"
+	"crypto/sha256"
+
+	"blockchain-service/blockchain"
+)
+
+/*
+Data store types of the permission marshal, shared with the tools that read its data store (gpc-replay).
+Every entry is stored as JSON under EntryKey of its public key, in the bucket of the requestor and in the bucket of the CA.
+*/
+
+type Workflow int
+
+const(
+	CREATED Workflow = 1 << iota //1
+	SIGNED //2
+	PUBLISHED //4
+	REVOKED_PENDING //8
+	REVOKED //16
+	REVOKED_PUBLISHED //32
+	SUSPENDED //64
+	SUSPENDED_PUBLISHED //128
+	REINSTATED //256
+	REVOKED_CASCADED //512
+	SUSPENDED_REVOKED //1024 Revocation of a suspended cert, pending publication. Unlike REVOKED the cert stays on the revocation list.
+)
+
+type DBValue struct {
+	Data []byte
+	To string
+	From string
+	Status Workflow
+	PubValidationInfo blockchain.ValidationInfo
+	BroadcastValidationInfo blockchain.ValidationInfo
+	PCN []byte
+	Origin string // Federated PM the entry was mirrored from, empty if managed by this PM
+	Statement []byte // PCN of the revoker carrying the last accepted revocation statement (revocation, suspension or reinstatement)
+	Renews []byte // Key of the published entry this CSR renews (/csr/renew), nil otherwise
+	RevokeRenewed bool // Mark the renewed entry for revocation once this one is published
+}
+
+//Key an entry is stored under: sha256 of the RSA modulus and exponent
+func EntryKey(pub interface{}) ([]byte, error) {
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Key is not an RSA key\n")
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s%d", rsaKey.N.String(), rsaKey.E)))
+	return sum[:], nil
+}
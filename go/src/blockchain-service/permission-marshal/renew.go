@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+
+	"github.com/boltdb/bolt"
+
+	"blockchain-service/blockchain"
+)
+
+/*
+Renewal and rekey of published certificates.
+The holder of a published certificate posts a new CSR (with a new key) to /csr/renew, signed with the key of the current
+certificate. The CSR is stored as a new entry linked to the current one (dbValue.Renews) and routed to the CA that issued the
+current certificate, /csr/get/to_sign lists it with the attributes of the current certificate if the CSR does not carry
+any. If requested, the current certificate is marked for revocation (REVOKED_PENDING) once the new one is published, the CA
+then revokes it (e.g. with reason superseded) like any other certificate marked on /revoke/mark.
+*/
+
+type renewRequest struct {
+	PemString string // New CSR
+	Cert string // Published certificate being renewed (PEM)
+	Signature []byte // RSA_SIG(SHA256(DER of the new CSR)) with the key of Cert
+	RevokeOld bool // Mark Cert for revocation once the new certificate is published
+}
+
+func renewCsr(w http.ResponseWriter, r *http.Request) {
+	var data renewRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not read body of HTTP request: %s\n", err)
+		return
+	}
+	if err = json.Unmarshal(body, &data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Could not create JSON using body of request: %s\n", err)
+		return
+	}
+
+	entry, err := linkRenewal(&data)
+	if err != nil {
+		fmt.Printf("Could not accept renewal: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Could not accept renewal: %s", err)
+		return
+	}
+	fmt.Printf("Renewal of %x requested by %s, routed to %s\n", entry.Value.Renews, entry.Value.From, entry.Value.To)
+	fmt.Fprintf(w, "Success")
+}
+
+/*
+Verifies the following and stores the new CSR:
+(1) The new CSR is signed with its own key, which is not the key of the current certificate
+(2) The request is signed with the key of the current certificate, and both are for the same subject
+(3) The current certificate is PUBLISHED and managed by this PM (mirrored certificates are renewed at their origin)
+*/
+func linkRenewal(data *renewRequest) (*dbEntry, error) {
+	csr, err := pemToCsr(data.PemString)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, errors.New(fmt.Sprintf("CSR signature is not valid: %s\n", err))
+	}
+	block, _ := pem.Decode([]byte(data.Cert))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("Could not decode current certificate\n")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = cert.CheckSignature(x509.SHA256WithRSA, csr.Raw, data.Signature); err != nil {
+		return nil, errors.New(fmt.Sprintf("Renewal is not signed with the key of the current certificate: %s\n", err))
+	}
+	if !strings.EqualFold(csr.Subject.CommonName, cert.Subject.CommonName) {
+		return nil, errors.New(fmt.Sprintf("CSR is for %s, current certificate for %s\n", csr.Subject.CommonName, cert.Subject.CommonName))
+	}
+	oldKey, err := entryKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := entryKey(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(oldKey, newKey) {
+		return nil, errors.New("A renewal needs a new key\n")
+	}
+
+	var entry *dbEntry
+	dbLock.Lock()
+	err = db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("USERS"))
+		bucket := root.Bucket([]byte(strings.ToLower(cert.Subject.CommonName)))
+		if bucket == nil {
+			return errors.New(fmt.Sprintf("(Requestor) User %s does not exist\n", cert.Subject.CommonName))
+		}
+		temp := bucket.Get(oldKey)
+		if temp == nil {
+			return errors.New("Current certificate not found in requestors kvs\n")
+		}
+		var old dbValue
+		if err := json.Unmarshal(temp, &old); err != nil {
+			return err
+		}
+		if !bytes.Equal(old.Data, cert.Raw) || old.Status != PUBLISHED {
+			return errors.New("Cannot Renew Entry Unless Status is PUBLISHED!\n")
+		}
+		if old.Origin != "" {
+			return errors.New(fmt.Sprintf("Certificate is managed by %s, renew it there\n", old.Origin))
+		}
+		if bucket.Get(newKey) != nil {
+			return errors.New("An entry for the new key already exists\n")
+		}
+
+		//Same requestor and CA as the current certificate
+		entry = &dbEntry{newKey, dbValue{csr.Raw, old.To, old.From, CREATED, blockchain.ValidationInfo{}, blockchain.ValidationInfo{}, nil, "", nil, oldKey, data.RevokeOld}}
+		valueString, err := json.Marshal(entry.Value)
+		if err != nil {
+			return err
+		}
+		for _, user := range []string{entry.Value.To, entry.Value.From} {
+			bucket, err := root.CreateBucketIfNotExists([]byte(user))
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(newKey, valueString); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	dbLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+//Certificate a renewal entry renews
+func renewedCert(value *dbValue) (*x509.Certificate, error) {
+	var old dbValue
+	dbLock.Lock()
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("USERS")).Bucket([]byte(value.From))
+		if bucket == nil {
+			return errors.New(fmt.Sprintf("User %s does not exist\n", value.From))
+		}
+		temp := bucket.Get(value.Renews)
+		if temp == nil {
+			return errors.New("Renewed certificate not found\n")
+		}
+		return json.Unmarshal(temp, &old)
+	})
+	dbLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(old.Data)
+}
+
+//Marks the certificate renewed by a newly published entry for revocation, unless it is no longer PUBLISHED (e.g. already
+//revoked or marked)
+func scheduleRevocation(value *dbValue) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	return db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("USERS"))
+		for _, user := range []string{value.From, value.To} {
+			bucket := root.Bucket([]byte(user))
+			if bucket == nil {
+				continue
+			}
+			temp := bucket.Get(value.Renews)
+			if temp == nil {
+				continue
+			}
+			var old dbValue
+			if err := json.Unmarshal(temp, &old); err != nil {
+				return err
+			}
+			if old.Status != PUBLISHED {
+				continue
+			}
+			old.Status = REVOKED_PENDING
+			valueString, err := json.Marshal(old)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(value.Renews, valueString); err != nil {
+				return err
+			}
+			fmt.Printf("Renewed certificate %x of %s marked for revocation\n", value.Renews, value.From)
+		}
+		return nil
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"flag"
 	"os/signal"
 	"os/exec"
 	"log"
@@ -15,9 +16,9 @@ import (
 	"net/url"
 	"io/ioutil"
 	"encoding/json"
+	"encoding/binary"
 	"encoding/base64"
 	"encoding/pem"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"unicode"
@@ -25,8 +26,10 @@ import (
 	
 	"github.com/boltdb/bolt"
 	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/hashers"
 	
 	"blockchain-service/blockchain"
+	"blockchain-service/permission-marshal/pmTypes"
 )
 
 
@@ -48,17 +51,48 @@ var db *bolt.DB
 var dbLock sync.Mutex
 var sdkLock sync.Mutex
 
-type Workflow int
+//Relay block roots rebuilt from the ledger, proofs of publication are checked against them
+var ledgerRoots = blockchain.NewCachedRoots(blockchain.LedgerRoots{SdkLock: &sdkLock, FSetup: &fSetup})
+
+var blockListener *blockchain.BlockListener
+var nextBlock uint64 // Next block to handle (last processed height + 1, persisted in META). Must acquire nextBlockLock before using.
+var nextBlockLock sync.Mutex
+
+//Hash strategies (as recorded in proofs) and hashers of the batch trees the PM publishes and of the block trees it rebuilds.
+//The block strategy must match the relay's.
+var batchStrategy, blockStrategy string
+var batchHasher, blockHasher hashers.LogHasher
+
+//Mark every known descendant of a cert as REVOKED_CASCADED when its revocation is published
+var cascadeRevocations bool
+
+//Format of the PCNs handed out on /csr/get (blockchain.PCNVersion1 or PCNVersion2). PCNs are stored as v2.
+var pcnVersion int
+
+//Number of attempts made to handle a block before giving up until the next block event (or restart)
+const blockAttempts = 3
+
+//Data store types, shared with gpc-replay (see pmTypes)
+type Workflow = pmTypes.Workflow
+type dbValue = pmTypes.DBValue
 
 const(
-	CREATED Workflow = 1 << iota //1
-	SIGNED //2
-	PUBLISHED //4
-	REVOKED_PENDING //8
-	REVOKED //16
-	REVOKED_PUBLISHED //32
+	CREATED = pmTypes.CREATED
+	SIGNED = pmTypes.SIGNED
+	PUBLISHED = pmTypes.PUBLISHED
+	REVOKED_PENDING = pmTypes.REVOKED_PENDING
+	REVOKED = pmTypes.REVOKED
+	REVOKED_PUBLISHED = pmTypes.REVOKED_PUBLISHED
+	SUSPENDED = pmTypes.SUSPENDED
+	SUSPENDED_PUBLISHED = pmTypes.SUSPENDED_PUBLISHED
+	REINSTATED = pmTypes.REINSTATED
+	REVOKED_CASCADED = pmTypes.REVOKED_CASCADED
+	SUSPENDED_REVOKED = pmTypes.SUSPENDED_REVOKED
 )
 
+//Key an entry is stored under
+var entryKey = pmTypes.EntryKey
+
 type csrData struct {
 	C string
 	S string
@@ -83,6 +117,7 @@ type csrResponse struct {
 	PubValidationInfo blockchain.ValidationInfo
 	BroadcastValidationInfo blockchain.ValidationInfo
 	AttrString string
+	Renews string `json:",omitempty"` // PEM of the certificate a renewal CSR renews
 }
 
 type signRequest struct {
@@ -97,16 +132,6 @@ type signResponse struct {
 	Revocation string
 }
 
-type dbValue struct {
-	Data []byte
-	To string
-	From string 
-	Status Workflow
-	PubValidationInfo blockchain.ValidationInfo
-	BroadcastValidationInfo blockchain.ValidationInfo
-	PCN []byte
-}
-
 type dbEntry struct {
 	Key []byte
 	Value dbValue
@@ -150,16 +175,47 @@ func initDataStore() error{
 			//Roll Back tx
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("META")); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("UPLOADS")); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//Resume after the last processed block, a new data store starts at the first block after chaincode instantiation
+	nextBlock = blockchain.BlockOffset + 1
+	return db.View(func(tx *bolt.Tx) error {
+		if last := tx.Bucket([]byte("META")).Get([]byte("lastBlock")); last != nil {
+			if len(last) != 8 {
+				return errors.New("Invalid last processed block in data store\n")
+			}
+			nextBlock = binary.BigEndian.Uint64(last) + 1
+		}
 		return nil
 	})
-	return err
+}
+
+//Persists n as the last processed block
+func setLastBlock(n uint64) error {
+	var last [8]byte
+	binary.BigEndian.PutUint64(last[:], n)
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("META")).Put([]byte("lastBlock"), last[:])
+	})
 }
 
 //Utils
 /*
 Verifies the following:
 (1) Verify signer has permission to sign by making a call to the policy evaluator
-(2) Check PM's local state to see if signer's cert has been revoked
+(2) Check PM's local state to see if signer's cert or any of its ancestors has been revoked
 */
 func permissionToSign(pcn *blockchain.ProofFile) error{
 	//Write pcn struct to a []byte in file format	
@@ -197,33 +253,35 @@ func permissionToSign(pcn *blockchain.ProofFile) error{
 	}
 	
 	fmt.Printf("Checking Revocation List...\n")
-	//Check that singer's cert is not revoked
-	return isRevoked(pcn.Certs[1])
+	//Check that singer's cert and the certs above it are not revoked
+	return isChainRevoked(pcn.Certs[1:])
 }
 
 /*
-Verifies the following:
-(1) Cert being revoked matches cert in PCN
-(2) Verify signer has permission to revoke by making a call to the policy evaluator
-(3) Verify the signature over "REVOKE<cert>" is valid
-(4) Check PM's local state to see if signer's cert has been revoked
+Verifies the following for a revocation, suspension or reinstatement:
+(1) Verify the statement is signed by the revoker it names (pcn.VerifyRevocation)
+(2) Verify the statement does not take effect in the future
+(3) Verify signer has permission to revoke by making a call to the policy evaluator
+(4) Check PM's local state to see if signer's cert or any of its ancestors has been revoked or suspended
+Returns the statement.
 */
-func permissionToRevoke(pcn *blockchain.ProofFile, revoked *x509.Certificate) error{	
-	//check that Cert in pcn.ProofList.Revoke.Cert matches the cert being revoked!	
-	cert, _, err := pemToCert(strings.Replace(pcn.ProofList.Revoke.Cert, "REVOKE\n", "", 1))
+func permissionToRevoke(pcn *blockchain.ProofFile) (*blockchain.RevocationStatement, error) {
+	fmt.Printf("Checking Signature...\n")
+	statement, err := pcn.VerifyRevocation()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if !bytes.Equal(cert.Raw, revoked.Raw) {
-		return errors.New("Revocation message is for different cert!\n")
+	fmt.Printf("...Valid\n")
+	if statement.Effective.After(time.Now()) {
+		return nil, errors.New(fmt.Sprintf("%s takes effect in the future (%s)\n", statement.Action, statement.Effective.Format(time.RFC3339)))
 	}
+	revoked := statement.Cert
 
 	//Prepend pcn of revoking principle with certificate that is being revoked creating a new cert chain	
 	revokedCertStr := bytes.NewBuffer([]byte(""))
 	chainToEval, err := pcn.ToFileFormat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	block := &pem.Block{
 		Type: "CERTIFICATE",
@@ -231,21 +289,21 @@ func permissionToRevoke(pcn *blockchain.ProofFile, revoked *x509.Certificate) er
 	}
 	
 	if err := pem.Encode(revokedCertStr, block); err != nil {
-		return nil
+		return nil, err
 	}
 	chainToEval = append(revokedCertStr.Bytes(), chainToEval...)
 
 	//Use URLEncoding(Sha256(current time)) as temp file name
 	timeAsBin, err := time.Now().MarshalBinary()
 	if err != nil {
-		return errors.New(fmt.Sprintf("Could not get current time as []byte: %s\n", err))
+		return nil, errors.New(fmt.Sprintf("Could not get current time as []byte: %s\n", err))
 	}
 	timeHash := sha256.Sum256(timeAsBin)
 	fileName := fmt.Sprintf("%s.pcn", url.QueryEscape(base64.StdEncoding.EncodeToString(timeHash[:])))
 	
 	//Write new cert chain to temp file
 	if err = ioutil.WriteFile(fmt.Sprintf("./policy-eval/%s", fileName), chainToEval, 0444); err != nil {
-		return errors.New(fmt.Sprintf("Could not write to temp pcn file: %s\n", err))
+		return nil, errors.New(fmt.Sprintf("Could not write to temp pcn file: %s\n", err))
 	}
 	fmt.Printf("Checking Policy...\n")
 
@@ -256,37 +314,30 @@ func permissionToRevoke(pcn *blockchain.ProofFile, revoked *x509.Certificate) er
 
 	//Delete temp file
 	if err := os.Remove(fmt.Sprintf("./policy-eval/%s", fileName)); err != nil {
-		return errors.New(fmt.Sprintf("Could not remove temp pcn file: %s\n", err))
+		return nil, errors.New(fmt.Sprintf("Could not remove temp pcn file: %s\n", err))
 	}
 	if returnCode != nil {
-		return returnCode
+		return nil, returnCode
 	}
 	fmt.Printf("...Valid\n")
 
-	//Check that revocation has been signed by the revoker
-	fmt.Printf("Checking Signature...\n")
-	err = pcn.Certs[0].CheckSignature(x509.SHA256WithRSA, []byte(pcn.ProofList.Revoke.Cert), pcn.ProofList.Revoke.Signature)
-	if err != nil {
-		return err
-	}
-	fmt.Printf("...Valid\n")
-
-	//Check that revoker's cert is not included in revocation list
+	//Check that revoker's cert and the certs above it are not included in revocation list
 	fmt.Printf("Revocation List...\n")	
-	if err = isRevoked(pcn.Certs[0]); err != nil {
-		return err
+	if err = isChainRevoked(pcn.Certs); err != nil {
+		return nil, err
 	}
 	fmt.Printf("...Valid\n")
-	return nil
+	return statement, nil
 }
 
 //Check PM's local state to see if the provided x509 has been revoked
 func isRevoked(cert *x509.Certificate) error {
-	rsaKey := cert.PublicKey.(*rsa.PublicKey)
-	sum := sha256.Sum256([]byte(fmt.Sprintf("%s%d", rsaKey.N.String(), rsaKey.E)))
-	key := sum[:]
+	key, err := entryKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
 	dbLock.Lock()
-	err := db.View(func(tx *bolt.Tx) error {
+	err = db.View(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("USERS"))
 		bucket := root.Bucket([]byte(strings.ToLower(cert.Subject.CommonName)))
 		//PM's are aware of all revocations (since they listen for block events, adding revocations to their key value store).
@@ -301,7 +352,8 @@ func isRevoked(cert *x509.Certificate) error {
 				if err != nil {
 					return err
 				}
-				if value.Status == REVOKED_PUBLISHED {
+				//Suspended certs stay on the list until their reinstatement is published, or for good once they are revoked
+				if value.Status & (REVOKED_PUBLISHED|SUSPENDED_PUBLISHED|REINSTATED|REVOKED_CASCADED|SUSPENDED_REVOKED) != 0 {
 					return errors.New("Revoking cert found on PM's revocation list!\n")
 				}
 			}
@@ -312,18 +364,26 @@ func isRevoked(cert *x509.Certificate) error {
 	return err
 }
 
+//Checks every cert of a chain (isRevoked only checks the cert itself)
+func isChainRevoked(certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		if err := isRevoked(cert); err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", cert.Subject.CommonName, err))
+		}
+	}
+	return nil
+}
+
 //Checks if cert is published. If so, returns the corresponding key-value-store entry
 func isPublished(cert *x509.Certificate, proofPubJson string) (*dbEntry, error) {
-	var rsaKey *rsa.PublicKey
 	var value dbValue
-	var returnValue *dbEntry
-	published := false
-	rsaKey = cert.PublicKey.(*rsa.PublicKey)
-	sum := sha256.Sum256([]byte(fmt.Sprintf("%s%d", rsaKey.N.String(), rsaKey.E)))
-	key := sum[:]
+	key, err := entryKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
 
 	dbLock.Lock()
-	err := db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
 		root := tx.Bucket([]byte("USERS"))
 		bucket, err:= root.CreateBucketIfNotExists([]byte(strings.ToLower(cert.Subject.CommonName)))
 		if err != nil {
@@ -331,19 +391,23 @@ func isPublished(cert *x509.Certificate, proofPubJson string) (*dbEntry, error)
 		}
 		//Get Entry
 		temp := bucket.Get(key)
-		//If there is no entry, this certificate might be managed by another Permission Marshal. Construct dbValue and commit tx to check 
-		//if the certificate was published by abother Permission Marshal.
+		//If there is no entry, this certificate is managed by a Permission Marshal that is not federated with this one. Construct
+		//dbValue from the caller's proof of publication and commit tx to check if it was published by that Permission Marshal.
+		//Certificates mirrored from federated Permission Marshals have an entry (see federation.go).
 		if temp == nil {
+			if proofPubJson == "" {
+				return errors.New("Certificate not managed by this PM or mirrored from a federated PM, and no proof of publication provided\n")
+			}
 			fmt.Printf("Certificate Published by another PM\n")
 			var proofPub blockchain.ValidationInfo
 			if err := json.Unmarshal([]byte(proofPubJson), &proofPub); err != nil {
 				//Rollback tx
 				return err
 			}
-			value = dbValue{cert.Raw, cert.Issuer.CommonName, cert.Subject.CommonName, PUBLISHED, proofPub, blockchain.ValidationInfo{}, nil}
+			value = dbValue{cert.Raw, cert.Issuer.CommonName, cert.Subject.CommonName, PUBLISHED, proofPub, blockchain.ValidationInfo{}, nil, "", nil, nil, false}
 			return nil
 		} else {
-			fmt.Printf("Certificate Published by this PM\n")
+			fmt.Printf("Certificate Published by this PM (or mirrored)\n")
 			//Unmarhsal dbValue
 			if err := json.Unmarshal(temp, &value); err != nil {
 				//Rollback tx
@@ -357,62 +421,116 @@ func isPublished(cert *x509.Certificate, proofPubJson string) (*dbEntry, error)
 		return nil, err
 	}
 
-	sdkLock.Lock()
-	bci, err := fSetup.GetLedgerInfo()
-	sdkLock.Unlock()
-	if err != nil {
+	if err = verifyPublication(&value); err != nil {
 		return nil, err
 	}
-	
-	fmt.Printf("Fetching Block %d of %d\n", value.PubValidationInfo.BlockIndex, bci.BCI.GetHeight()-1)
-	if value.PubValidationInfo.BlockIndex <=-1 || uint64(value.PubValidationInfo.BlockIndex) > bci.BCI.GetHeight()-1{
-		return nil , errors.New("Invalid block index in proof of publication\n")
-	}
-	sdkLock.Lock()
-	block, err := fSetup.GetBlock(uint64(value.PubValidationInfo.BlockIndex))
-	sdkLock.Unlock()
+	return &dbEntry{key, value}, nil
+}
+
+//Checks that value.Data is included under its batch root (value.PubValidationInfo) and the batch root under the root of the
+//relay block rebuilt from the ledger. Entries without a block level proof (e.g. published by a PM that is not federated with
+//this one) get it from the ledger and keep it, pubcc checks revocations against it.
+func verifyPublication(value *dbValue) error {
+	cert, err := x509.ParseCertificate(value.Data)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for index, valid := range block.Metadata.Metadata[2] {
-		if valid != 0 {
-			//If tx was not accepted by peer, continue to next transaction
-			continue
+	batch := value.PubValidationInfo
+	block := value.BroadcastValidationInfo
+	if block.NumLeaves == 0 {
+		//The batch level proof records the fabric block the batch root was published in
+		if batch.BlockIndex < int64(blockchain.BlockOffset) {
+			return errors.New("Invalid block index in proof of publication\n")
 		}
+		proof, err := blockchain.LedgerRoots{SdkLock: &sdkLock, FSetup: &fSetup}.BlockProof(batch.BlockIndex - int64(blockchain.BlockOffset), blockStrategy, batch.MerkleRoot)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Merkle Root Not Found in Published Block: %s\n", err))
+		}
+		block = *proof
+		value.BroadcastValidationInfo = block
+	}
+	batch.BlockIndex = block.BlockIndex
 
-		for _, write := range block.Transactions[index].Writes {			
-			//Parse Merkle Roots and Revocations
-			rootString, err := url.QueryUnescape(write.KvRwSet.Writes[0].Key)
-			if err != nil {
-				return nil, err
-			}
-			//If the current tx does not contain merkle root for published cert, continue
-			if !bytes.Equal([]byte(rootString), value.PubValidationInfo.MerkleRoot) {
-				continue;
-			}
-			fmt.Printf("MATCH: %+v, %+v\n", []byte(rootString), value.PubValidationInfo.MerkleRoot)
-			if err = blockchain.VerifyMerkleProof(value.PubValidationInfo.LeafIndex, value.PubValidationInfo.NumLeaves, value.PubValidationInfo.MerkleRoot, value.Data, value.PubValidationInfo.Proof); err != nil {
-				return nil, errors.New(fmt.Sprintf("Merkle Root Found for Certificate, but Could Not Verify Inclusion: %s", err))
-			} else {
-				fmt.Printf("Inclusion Verified\n")
-				published = true
-				returnValue = &dbEntry{key, value}
-				break
-			}
+	pcn := &blockchain.ProofFile{Certs: []*x509.Certificate{cert}, ProofList: &blockchain.ProofList{ProofList: []blockchain.ValidationInfo{block}}, BatchProofs: []blockchain.ValidationInfo{batch}}
+	report, err := pcn.Verify(blockchain.VerifyContext{Roots: ledgerRoots})
+	if err != nil {
+		return err
+	}
+	//Only the publication is checked, the issuer is not part of the chain
+	if err = report.Certs[0].Batch; err != nil {
+		return errors.New(fmt.Sprintf("Could Not Verify Inclusion Under Batch Root: %s\n", err))
+	}
+	if err = report.Certs[0].Block; err != nil {
+		return errors.New(fmt.Sprintf("Could Not Verify Publication: %s\n", err))
+	}
+	fmt.Printf("Inclusion Verified\n")
+	return nil
+}
+
+//Batch proofs of the chain a signing app posted, taken from the issuer's stored PCN if the chain still carries the
+//issuer's proofs. Signing apps that only read v1 PCNs drop them. Must be called within a db transaction.
+func issuerBatchProofs(root *bolt.Bucket, pcn *blockchain.ProofFile) []blockchain.ValidationInfo {
+	if len(pcn.Certs) < 2 {
+		return nil
+	}
+	issuer := pcn.Certs[1]
+	key, err := entryKey(issuer.PublicKey)
+	if err != nil {
+		return nil
+	}
+	bucket := root.Bucket([]byte(strings.ToLower(issuer.Subject.CommonName)))
+	if bucket == nil {
+		return nil
+	}
+	temp := bucket.Get(key)
+	if temp == nil {
+		return nil
+	}
+	var value dbValue
+	if err := json.Unmarshal(temp, &value); err != nil || value.PCN == nil {
+		return nil
+	}
+	stored, err := blockchain.ParsePCN(value.PCN)
+	if err != nil || len(stored.Certs) != len(pcn.Certs)-1 || len(stored.ProofList.ProofList) != len(pcn.ProofList.ProofList) {
+		return nil
+	}
+	for i, cert := range stored.Certs {
+		if !bytes.Equal(cert.Raw, pcn.Certs[i+1].Raw) {
+			return nil
 		}
 	}
+	for i, proof := range stored.ProofList.ProofList {
+		posted := pcn.ProofList.ProofList[i]
+		if proof.BlockIndex != posted.BlockIndex || proof.LeafIndex != posted.LeafIndex || proof.NumLeaves != posted.NumLeaves {
+			return nil
+		}
+	}
+	return stored.BatchProofs
+}
 
-	if published {
-		return returnValue, nil
-	} else {
-		return nil, errors.New("Merkle Root Not Found in Any Published Block!")
+//Encodes a stored PCN in the format handed out (pcnVersion). PCNs that can't be re-encoded (e.g. legacy v1 PCNs that
+//don't pass Validate) are handed out as stored.
+func outputPCN(data []byte) []byte {
+	pcn, err := blockchain.ParsePCN(data)
+	var out []byte
+	if err == nil {
+		if pcnVersion == blockchain.PCNVersion1 {
+			out, err = pcn.ToFileFormat()
+		} else {
+			out, err = pcn.ToV2()
+		}
 	}
+	if err != nil {
+		fmt.Printf("Could not re-encode stored PCN, handing it out as stored: %s", err)
+		return data
+	}
+	return out
 }
 
 func buildCsrResponse(buf *bytes.Buffer, name *pkix.Name, email []string, ca string, status Workflow, pubProof, broadcastProof blockchain.ValidationInfo, attrString string) csrResponse{
 	return csrResponse{string(buf.Bytes()), csrData{name.Country[0],
 		name.Province[0], name.Locality[0], name.Organization[0], name.OrganizationalUnit[0],
-		name.CommonName, email[0]},ca, status, pubProof, broadcastProof, attrString}
+		name.CommonName, email[0]},ca, status, pubProof, broadcastProof, attrString, ""}
 }
 
 func pemToCsr(s string) (*x509.CertificateRequest, error) {
@@ -477,27 +595,22 @@ func getAttrExtension(exts []pkix.Extension) (string, error) {
 
 /* 
 Given an array of dbEntires, construct a merkle tree. 
-dbEntries should contain the certificates the PM wishes to publish. 
+dbEntries should contain the certificates the PM wishes to publish. Also returns the leaves (the certificates followed by a timestamp).
 */
-func buildTree(data []dbEntry) (*merkle.InMemoryMerkleTree, error) {
-    err := errors.New("")
-    var tree *merkle.InMemoryMerkleTree
-	
-	logHasher, err := blockchain.InitHasher()
-    if err != nil {
-        fmt.Printf("Could Not Create Log Hasher: %v\n", err)
-        return nil, err
-    }
-
-    tree = merkle.NewInMemoryMerkleTree(logHasher)
+func buildTree(data []dbEntry) (*merkle.InMemoryMerkleTree, [][]byte, error) {
+    tree := merkle.NewInMemoryMerkleTree(batchHasher)
 
+	var leaves [][]byte
     for _,element := range data {
-		tree.AddLeaf([]byte(element.Value.Data))
+		leaves = append(leaves, []byte(element.Value.Data))
+	}
+	leaves = append(leaves, []byte(fmt.Sprintf("%8d", time.Now().Unix())))
+	for _,leaf := range leaves {
+		tree.AddLeaf(leaf)
 	}
-	tree.AddLeaf([]byte(fmt.Sprintf("%8d", time.Now().Unix())))
 	
 	tree.CurrentRoot()
-	return tree, nil
+	return tree, leaves, nil
 }
 
 /*
@@ -553,9 +666,13 @@ func markForRevocation(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("Could not create x509 struct from PEM data: %s\n", err)
 		return
 	}
-	rsaKey := cert.PublicKey.(*rsa.PublicKey)
-	sum := sha256.Sum256([]byte(fmt.Sprintf("%s%d", rsaKey.N.String(), rsaKey.E)))
-	key := sum[:]
+	key, err := entryKey(cert.PublicKey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		fmt.Printf("%s", err)
+		return
+	}
 
 	dbLock.Lock()
 	err = db.Update(func(tx *bolt.Tx) error {
@@ -631,10 +748,13 @@ func acceptSignRequest(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("...Valid\n")
 		//Convert PEM string to Certificate
 		cert := pcn.Certs[0]
-		var rsaKey *rsa.PublicKey
-		rsaKey = cert.PublicKey.(*rsa.PublicKey)
-		sum := sha256.Sum256([]byte(fmt.Sprintf("%s%d", rsaKey.N.String(), rsaKey.E)))
-		key := sum[:]
+		key, err := entryKey(cert.PublicKey)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", err)
+			fmt.Printf("%s", err)
+			return
+		}
 		var temp []byte
 		var value dbValue
 		// Obtain db lock
@@ -664,7 +784,11 @@ func acceptSignRequest(w http.ResponseWriter, r *http.Request) {
 			//Update Status to SIGNED
 			value.Status = SIGNED
 			value.Data = cert.Raw
-			value.PCN, err = pcn.ToFileFormat()
+			//Stored as v2, which keeps the batch proofs of the chain
+			if pcn.BatchProofs == nil {
+				pcn.BatchProofs = issuerBatchProofs(root, pcn)
+			}
+			value.PCN, err = pcn.ToV2()
 			if err != nil {
 				return err
 			}
@@ -734,15 +858,9 @@ func acceptRevocation(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Could not parse response pcn from signing app: %s\n", err)
 		return
 	}
-	cert, _, err := pemToCert(strings.Replace(pcn.ProofList.Revoke.Cert, "REVOKE\n", "", 1))
-	if err != nil {
-		fmt.Printf("Could not parse revoked cert from pcn: %s\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Could not parse revoked cert from pcn: %s\n", err)
-		return
-	}
 	//Check if the revoking entity has permission to revoke the cert being revoked 
-	if err = permissionToRevoke(pcn, cert); err == nil {
+	if statement, err := permissionToRevoke(pcn); err == nil {
+		cert := statement.Cert
 		//Check to see if the cert being revoked has been published.
 		if entry, err = isPublished(cert, ""); err == nil {
 			//If signingApp approved AND revoking entitiy has permission to revoke AND the cert being revoked is published	isPublished			
@@ -753,9 +871,12 @@ func acceptRevocation(w http.ResponseWriter, r *http.Request) {
 				
 				key := entry.Key
 				value := entry.Value
-				//Mark cert's entry in key value store as revoked.					
-				value.Status = REVOKED
-				value.PCN, err = pcn.ToFileFormat()
+				//Mark cert's entry in key value store as revoked, suspended or reinstated (pending publication)
+				if value.Status, err = acceptedStatus(value.Status, statement.Action); err != nil {
+					return err
+				}
+				//The entry keeps the cert's own PCN, the revoker's PCN is published with the statement
+				value.Statement, err = pcn.Encode()
 				if err != nil {
 					return err
 				}
@@ -778,7 +899,7 @@ func acceptRevocation(w http.ResponseWriter, r *http.Request) {
 			dbLock.Unlock()
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "Could not set status to REVOKED: %s", err)
+				fmt.Fprintf(w, "Could not accept revocation statement: %s", err)
 				fmt.Printf("%s\n", err)
 				return
 			}
@@ -796,10 +917,54 @@ func acceptRevocation(w http.ResponseWriter, r *http.Request) {
 	}	
 }
 
+//Status of an entry once a revocation statement for it is accepted (pending publication). Revocations are accepted for
+//published (or suspended, SUSPENDED_REVOKED) certs, suspensions for published certs and reinstatements for suspended certs only.
+func acceptedStatus(status Workflow, action string) (Workflow, error) {
+	switch action {
+	case blockchain.StatementSuspend:
+		if status & (PUBLISHED|REVOKED_PENDING) != 0 {
+			return SUSPENDED, nil
+		}
+	case blockchain.StatementReinstate:
+		if status == SUSPENDED_PUBLISHED {
+			return REINSTATED, nil
+		}
+	default:
+		if status & (PUBLISHED|REVOKED_PENDING) != 0 {
+			return REVOKED, nil
+		}
+		//Suspended certs are not usable again while the revocation is pending
+		if status == SUSPENDED_PUBLISHED {
+			return SUSPENDED_REVOKED, nil
+		}
+	}
+	return status, errors.New(fmt.Sprintf("Cannot accept %s statement for entry with status %d\n", action, status))
+}
+
+//Status of an entry once a revocation statement for it is published. Suspensions don't override revocations (published or
+//pending) or pending reinstatements, and only suspended certs are reinstated.
+func publishedStatus(status Workflow, action string) Workflow {
+	switch action {
+	case blockchain.StatementSuspend:
+		if status & (REVOKED|REVOKED_PUBLISHED|REINSTATED|REVOKED_CASCADED|SUSPENDED_REVOKED) == 0 {
+			return SUSPENDED_PUBLISHED
+		}
+	case blockchain.StatementReinstate:
+		if status & (SUSPENDED_PUBLISHED|REINSTATED) != 0 {
+			return PUBLISHED
+		}
+	default:
+		return REVOKED_PUBLISHED
+	}
+	return status
+}
+
 func csrHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path{
 	case "/csr/new": 
 		newCsr(w,r)
+	case "/csr/renew":
+		renewCsr(w,r)
 	case "/csr/post/signed":
 		acceptSignRequest(w,r)
 	case "/csr/get/signed":
@@ -807,7 +972,7 @@ func csrHandler(w http.ResponseWriter, r *http.Request) {
 	case "/csr/get/to_sign":
 		getCsr(w,r,true, CREATED)
 	case "/csr/get/my_csrs":
-		getCsr(w,r,false, CREATED|SIGNED|PUBLISHED|REVOKED_PUBLISHED)
+		getCsr(w,r,false, CREATED|SIGNED|PUBLISHED|REVOKED_PUBLISHED|SUSPENDED_PUBLISHED|REVOKED_CASCADED)
 	default:
 		w.WriteHeader(http.StatusNotFound);
 		fmt.Fprintf(w, "%s", "404 Page Not Found")
@@ -823,6 +988,8 @@ func revokeHandler(w http.ResponseWriter, r *http.Request) {
 		markForRevocation(w,r)
 	case "/revoke/get": 
 		getCsr(w, r, true, REVOKED_PENDING)
+	case "/revoke/get/suspended": 
+		getCsr(w, r, true, SUSPENDED_PUBLISHED)
 	default:
 		w.WriteHeader(http.StatusNotFound);
 		fmt.Fprintf(w, "%s", "404 Page Not Found")
@@ -873,10 +1040,14 @@ func newCsr(w http.ResponseWriter, r *http.Request) {
 	
 	// key = hash(RSA Pub Key)
 	csrBytes := csr.Raw
-	var key *rsa.PublicKey
-	key = csr.PublicKey.(*rsa.PublicKey)
-	sum := sha256.Sum256([]byte(fmt.Sprintf("%s%d", key.N.String(), key.E)))
-	entry := dbEntry{sum[:], dbValue{csrBytes, strings.ToLower(data.To), strings.ToLower(data.From), CREATED, blockchain.ValidationInfo{}, blockchain.ValidationInfo{}, nil}}
+	key, err := entryKey(csr.PublicKey)
+	if err != nil {
+		fmt.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	entry := dbEntry{key, dbValue{csrBytes, strings.ToLower(data.To), strings.ToLower(data.From), CREATED, blockchain.ValidationInfo{}, blockchain.ValidationInfo{}, nil, "", nil, nil, false}}
 	
 	valueString, err := json.Marshal(entry.Value)
 	if err != nil {
@@ -994,7 +1165,20 @@ func getCsr(w http.ResponseWriter, r *http.Request, signer bool, status Workflow
 				fmt.Fprintf(w, "%s", err)
 				return
 			}
+			//Renewals are pre-filled with the attributes of the renewed certificate
+			var renewed *x509.Certificate
+			if entry.Value.Renews != nil {
+				if renewed, err = renewedCert(&entry.Value); err != nil {
+					fmt.Printf("Could not get renewed certificate: %s", err)
+					w.WriteHeader(http.StatusInternalServerError);
+					fmt.Fprintf(w, "Could not get renewed certificate: %s", err)
+					return
+				}
+			}
 			attrString, err := getAttrExtension(csr.Extensions)
+			if err != nil && renewed != nil {
+				attrString, err = getAttrExtension(renewed.Extensions)
+			}
 			if err != nil {
 				fmt.Printf("Could not parse extension from stored CSR: %s", err)
 				w.WriteHeader(http.StatusInternalServerError);
@@ -1002,12 +1186,20 @@ func getCsr(w http.ResponseWriter, r *http.Request, signer bool, status Workflow
 			}
 			//Build CSR response
 			response := buildCsrResponse(buffer, &(csr.Subject), csr.EmailAddresses, entry.Value.To, entry.Value.Status, entry.Value.PubValidationInfo, entry.Value.BroadcastValidationInfo, attrString)
+			if renewed != nil {
+				response.Renews = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: renewed.Raw}))
+			}
 			csrDataResponses = append(csrDataResponses, &response)
 		} else {
+			//Entries created for revocations of foreign certs have no PCN
+			if len(entry.Value.PCN) == 0 {
+				continue
+			}
 			buffer := bytes.NewBufferString("")
 			//pem.Encode(buffer, &pem.Block{Type: "CERTIFICATE", Bytes: entry.Value.Data})
-			n ,err := buffer.Write(entry.Value.PCN)
-			if n != len(entry.Value.PCN) || err != nil {
+			pcn := outputPCN(entry.Value.PCN)
+			n ,err := buffer.Write(pcn)
+			if n != len(pcn) || err != nil {
 				fmt.Printf("Could not write PCN to buffer: %s", err)
 				w.WriteHeader(http.StatusInternalServerError);
 				fmt.Fprintf(w, "Could not write PCN to buffer: %s", err)
@@ -1080,17 +1272,24 @@ func batcher(stop, done chan bool) {
 								fmt.Printf("\tPub CSR Hash: %x\n", k)
 								// Add to certBatch
 								certBatch = append(certBatch, dbEntry{k, value})
-							} else  if (value.Status & REVOKED != 0) && strings.ToLower(value.From) == string(user) {
+							} else  if (value.Status & (REVOKED|SUSPENDED|REINSTATED|SUSPENDED_REVOKED) != 0) && strings.ToLower(value.From) == string(user) {
 								// Add to revokeBatch
 								fmt.Printf("\tRevoke CSR Hash: %x\n", k)
 								fmt.Printf("\tStatus: %v\n", value.Status)
-								revokeBatch = append(revokeBatch, blockchain.Revocation{value.Data, value.PubValidationInfo, blockchain.ValidationInfo{}, value.PCN})
+								//Entries revoked before statements were kept separately carry the revoker's PCN in PCN
+								statement := value.Statement
+								if statement == nil {
+									statement = value.PCN
+								}
+								revokeBatch = append(revokeBatch, blockchain.Revocation{value.Data, value.PubValidationInfo, value.BroadcastValidationInfo, statement})
 							}
 						}
 					}
 					return nil
 				})
 				dbLock.Unlock()
+				//Retry batches the availability store did not accept yet
+				uploadBatches()
 				if err == nil {
 					//Success
 
@@ -1100,7 +1299,7 @@ func batcher(stop, done chan bool) {
 					}
 
 					//Compute Merkle Tree
-					tree, err := buildTree(certBatch)
+					tree, leaves, err := buildTree(certBatch)
 					if err != nil {
 						fmt.Printf("%s\n", err)
 						continue
@@ -1123,9 +1322,15 @@ func batcher(stop, done chan bool) {
 						continue
 					}
 					
+					//Keep the published leaves available off-chain under the batch root
+					if err = queueBatch(&blockchain.Batch{tree.CurrentRoot().Hash(), leaves, batchStrategy}); err != nil {
+						fmt.Printf("Could not queue batch for the availability store: %s\n", err)
+					}
+					uploadBatches()
+
 					//Only writeback Validation Info when chaincode returns success
 					for index,_ := range certBatch {
-						certBatch[index].Value.PubValidationInfo = blockchain.ValidationInfo{int64(index), int64(-1), tree.LeafCount(), tree.CurrentRoot().Hash(), proofArray(tree.PathToCurrentRoot(int64(index)+1))}
+						certBatch[index].Value.PubValidationInfo = blockchain.ValidationInfo{int64(index), int64(-1), tree.LeafCount(), tree.CurrentRoot().Hash(), proofArray(tree.PathToCurrentRoot(int64(index)+1)), batchStrategy}
 					}
 					
 					dbLock.Lock()
@@ -1169,25 +1374,26 @@ func batcher(stop, done chan bool) {
 }
 
 //Handles Fabric Block Event
-func handleEvent(n uint64) {
+//Marks publications and revocation statements in fabric block n as PUBLISHED and REVOKED_PUBLISHED, SUSPENDED_PUBLISHED or
+//PUBLISHED again (reinstated). Handling a block more than once has no further effect.
+func handleEvent(n uint64) error {
 	var merkleRoots [][]byte
-	var revocations [][]byte
-	
-	logHasher, err := blockchain.InitHasher()
-    if err != nil {
-        fmt.Printf("Could Not Create Log Hasher: %v\n", err)
-        return
-    }
+	var revocations []*blockchain.RevocationStatement
 
-    blockMerkleTree := merkle.NewInMemoryMerkleTree(logHasher)
+	//The genesis block and the chaincode instantiation block (root certs) carry no publications
+	if n <= blockchain.BlockOffset {
+		return nil
+	}
+	
+    blockMerkleTree := merkle.NewInMemoryMerkleTree(blockHasher)
 	
 	//Get Block Information
 	sdkLock.Lock()
-	block, err := fSetup.GetBlock(uint64(0))
+	block, err := fSetup.GetBlock(n)
 	sdkLock.Unlock()
 	if err != nil {
 		fmt.Printf("Could not handle block event: %s\n", err)
-		return
+		return err
 	}
 
 	for index, valid := range block.Metadata.Metadata[2] {
@@ -1197,27 +1403,13 @@ func handleEvent(n uint64) {
 		}
 
 		for _, write := range block.Transactions[index].Writes {			
-			var revokeJson [][]byte //[]blockchain.ProofFile
-			var temp *blockchain.ProofFile
 			//Parse Merkle Roots and Revocations
 			rootString, err := url.QueryUnescape(write.KvRwSet.Writes[0].Key)
 			if err != nil {
 				fmt.Printf("Could not handle block event: %s", err)
-				return
-			}
-			if err = json.Unmarshal(write.KvRwSet.Writes[0].Value, &revokeJson); err != nil {
-				fmt.Printf("Could not handle block event: %s", err)
-				return
-			}
-
-			for _,r := range revokeJson {
-				if temp, err = blockchain.ParsePCN(r); err != nil{
-					fmt.Printf("Could not handle block event: %s", err)
-					return
-				}
-				fmt.Printf("%+v\n", temp)
-				revocations = append(revocations, []byte(strings.Replace(temp.ProofList.Revoke.Cert, "REVOKE\n", "", 1)))
+				return err
 			}
+			revocations = append(revocations, blockchain.LedgerRevocations(write.KvRwSet.Writes[0].Value)...)
 			fmt.Printf("Merkle Root: %x\n", rootString)
 			blockMerkleTree.AddLeaf([]byte(rootString))
 			merkleRoots = append(merkleRoots, []byte(rootString))
@@ -1225,6 +1417,8 @@ func handleEvent(n uint64) {
 	}
 	fmt.Printf("Block Merkle Tree Root: %x\n", blockMerkleTree.CurrentRoot().Hash())
 
+	//Published renewals whose renewed certificate is to be revoked
+	renewals := map[string]dbValue{}
 	//Start Write Transaction
 	dbLock.Lock()
 	err = db.Update(func(tx *bolt.Tx) error {
@@ -1239,7 +1433,8 @@ func handleEvent(n uint64) {
 				inner := root.Bucket(user).Cursor()
 				//Iterate over all CSRs for user
 				for k,v := inner.First(); k != nil; k,v = inner.Next() {
-					//Convert JSON string to dbValue
+					//Convert JSON string to dbValue (reset so fields missing from older entries are not carried over)
+					value = dbValue{}
 					if err := json.Unmarshal(v, &value); err != nil {
 						return err
 					}
@@ -1249,7 +1444,7 @@ func handleEvent(n uint64) {
 						//Update DB entry with published info						
 						value.Status = PUBLISHED
 						value.PubValidationInfo.BlockIndex = int64(n)
-						value.BroadcastValidationInfo = blockchain.ValidationInfo{int64(merkleRootLeafIndex), int64(n - blockchain.BlockOffset), blockMerkleTree.LeafCount(), blockMerkleTree.CurrentRoot().Hash(), proofArray(blockMerkleTree.PathToCurrentRoot(int64(merkleRootLeafIndex)+1))}
+						value.BroadcastValidationInfo = blockchain.ValidationInfo{int64(merkleRootLeafIndex), int64(n - blockchain.BlockOffset), blockMerkleTree.LeafCount(), blockMerkleTree.CurrentRoot().Hash(), proofArray(blockMerkleTree.PathToCurrentRoot(int64(merkleRootLeafIndex)+1)), blockStrategy}
 						//Create PCNS						
 						hashes = append(hashes, proofArray(blockMerkleTree.PathToCurrentRoot(int64(merkleRootLeafIndex)+1))...)
 						hashes = append(hashes, blockMerkleTree.CurrentRoot().Hash())
@@ -1257,8 +1452,14 @@ func handleEvent(n uint64) {
 						if err != nil {
 							return err
 						}
-						temp.AddMerkleProof(&blockchain.ValidationInfo{int64(merkleRootLeafIndex), int64(n - blockchain.BlockOffset), blockMerkleTree.LeafCount(), nil, hashes})
-						value.PCN, err = temp.ToFileFormat()
+						if err = temp.AddMerkleProof(&blockchain.ValidationInfo{int64(merkleRootLeafIndex), int64(n - blockchain.BlockOffset), blockMerkleTree.LeafCount(), nil, hashes, blockStrategy}); err != nil {
+							return err
+						}
+						//The proof under the batch root, entries signed before PCNs were stored as v2 are converted
+						batchProof := value.PubValidationInfo
+						batchProof.BlockIndex = int64(n - blockchain.BlockOffset)
+						temp.AddBatchProof(&batchProof)
+						value.PCN, err = temp.ToV2()
 						if err != nil {
 							return err
 						} 
@@ -1269,6 +1470,9 @@ func handleEvent(n uint64) {
 						if err = root.Bucket(user).Put(k,valueString); err != nil {
 							return err
 						}
+						if value.Renews != nil && value.RevokeRenewed {
+							renewals[string(k)] = value
+						}
 					}
 				}
 			}
@@ -1278,20 +1482,23 @@ func handleEvent(n uint64) {
 	dbLock.Unlock()
 	if err != nil {
 		fmt.Printf("Could not handle block event: %s", err)
-		return
+		return err
+	}
+	for _, renewal := range renewals {
+		if err = scheduleRevocation(&renewal); err != nil {
+			fmt.Printf("Could not mark renewed certificate for revocation: %s", err)
+		}
 	}
 
-	//Add all revocations to local state
-	for _,revocation := range revocations {
-		cert, _, err := pemToCert(string(revocation))
+	//Add all revocations, suspensions and reinstatements to local state
+	for _,statement := range revocations {
+		cert := statement.Cert
+		key, err := entryKey(cert.PublicKey)
 		if err != nil {
-			fmt.Printf("Error Processing Revocation\n")			
-			return
+			//Only certs with RSA keys are stored
+			fmt.Printf("Skipping %s of %s: %s", statement.Action, cert.Subject.CommonName, err)
+			continue
 		}
-		var rsaKey *rsa.PublicKey
-		rsaKey = cert.PublicKey.(*rsa.PublicKey)
-		sum := sha256.Sum256([]byte(fmt.Sprintf("%s%d", rsaKey.N.String(), rsaKey.E)))
-		key := sum[:]	
 
 		dbLock.Lock()
 		err = db.Update(func(tx *bolt.Tx) error {
@@ -1303,8 +1510,12 @@ func handleEvent(n uint64) {
 			resp := bucket.Get(key)
 			// Cert managed by another PM, Create new entry in PM's key value store
 			if resp == nil {
+				if statement.Action == blockchain.StatementReinstate {
+					//Nothing to lift
+					return nil
+				}
 				fmt.Printf("User managed by another PM, Create new entry in PM's key value store\n")
-				value := dbValue{cert.Raw, cert.Issuer.CommonName, cert.Subject.CommonName, REVOKED_PUBLISHED, blockchain.ValidationInfo{}, blockchain.ValidationInfo{}, nil}
+				value := dbValue{cert.Raw, cert.Issuer.CommonName, cert.Subject.CommonName, publishedStatus(0, statement.Action), blockchain.ValidationInfo{}, blockchain.ValidationInfo{}, nil, "", nil, nil, false}
 				jsonStr, err := json.Marshal(value)
 				if err != nil {
 					return err
@@ -1314,7 +1525,8 @@ func handleEvent(n uint64) {
 					return err
 				}
 
-				bucket, err:= root.CreateBucketIfNotExists([]byte(strings.ToLower(cert.Subject.CommonName)))
+				//Update CA's entry
+				bucket, err:= root.CreateBucketIfNotExists([]byte(strings.ToLower(cert.Issuer.CommonName)))
 				if err != nil {
 					return err
 				}
@@ -1329,7 +1541,7 @@ func handleEvent(n uint64) {
 					if err := json.Unmarshal(resp, &value); err != nil {
 						return err
 					}
-					value.Status = REVOKED_PUBLISHED
+					value.Status = publishedStatus(value.Status, statement.Action)
 					jsonStr, err := json.Marshal(value)
 					if err != nil {
 						return err
@@ -1340,28 +1552,35 @@ func handleEvent(n uint64) {
 					}
 				}	
 			} else {
-				// Cert managed by this PM, Update PM's key value store					
+				// Cert managed by this PM (or mirrored from a federated PM), Update PM's key value store
 				//Update subject's entry				
 				fmt.Printf("User managed by this PM, Update PM's key value store\n")
 				var value dbValue
 				if err := json.Unmarshal(resp, &value); err != nil {
 					return err
 				}
-				value.Status = REVOKED_PUBLISHED
-				jsonStr, err := json.Marshal(value)
+				value.Status = publishedStatus(value.Status, statement.Action)
+				caBucket, err := root.CreateBucketIfNotExists([]byte(strings.ToLower(cert.Issuer.CommonName)))
 				if err != nil {
 					return err
 				}
-				err = bucket.Put(key, jsonStr)
+				//Entries only created for a suspension of a cert managed by another PM go away with the suspension
+				if value.Status == PUBLISHED && value.PCN == nil && len(value.PubValidationInfo.MerkleRoot) == 0 {
+					if err = bucket.Delete(key); err != nil {
+						return err
+					}
+					return caBucket.Delete(key)
+				}
+				jsonStr, err := json.Marshal(value)
 				if err != nil {
 					return err
 				}
-				//Update CA's entry
-				bucket = root.Bucket([]byte(strings.ToLower(cert.Issuer.CommonName)))
+				err = bucket.Put(key, jsonStr)
 				if err != nil {
 					return err
 				}
-				err = bucket.Put(key, jsonStr)
+				//Update CA's entry
+				err = caBucket.Put(key, jsonStr)
 				if err != nil {
 					return err
 				}
@@ -1371,12 +1590,201 @@ func handleEvent(n uint64) {
 		dbLock.Unlock()
 		if err != nil {
 			fmt.Printf("Could not handle block event: %s", err)
+			return err
+		}
+
+		if cascadeRevocations && statement.Action == blockchain.StatementRevoke {
+			marked, err := cascadeRevocation(cert)
+			if err != nil {
+				fmt.Printf("Could not cascade revocation of %s: %s\n", cert.Subject.CommonName, err)
+				return err
+			}
+			if marked != 0 {
+				fmt.Printf("Cascaded revocation of %s to %d certificates\n", cert.Subject.CommonName, marked)
+			}
+		}
+	}
+	return nil
+}
+
+//Marks every cert in the data store descending from revoked (issued by it, or by a cert issued by it, ...) as
+//REVOKED_CASCADED. Certs revoked themselves stay REVOKED_PUBLISHED. Returns the number of descendants found.
+func cascadeRevocation(revoked *x509.Certificate) (int, error) {
+	type entryRef struct {
+		user []byte
+		key []byte
+	}
+	found := 0
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	err := db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("USERS"))
+		//Entries are stored under the requestor and the CA, collect every copy of each cert
+		refs := make(map[string][]entryRef)
+		certs := make(map[string]*x509.Certificate)
+		outter := root.Cursor()
+		for user,_ := outter.First(); user != nil; user,_ = outter.Next() {
+			inner := root.Bucket(user).Cursor()
+			for k,v := inner.First(); k != nil; k,v = inner.Next() {
+				var value dbValue
+				if err := json.Unmarshal(v, &value); err != nil {
+					return err
+				}
+				//CREATED entries hold the CSR
+				if value.Status == CREATED {
+					continue
+				}
+				refs[string(k)] = append(refs[string(k)], entryRef{append([]byte{}, user...), append([]byte{}, k...)})
+				if certs[string(k)] == nil {
+					cert, err := x509.ParseCertificate(value.Data)
+					if err != nil {
+						return err
+					}
+					certs[string(k)] = cert
+				}
+			}
+		}
+
+		//Walk down from the revoked cert
+		issuers := []*x509.Certificate{revoked}
+		seen := make(map[string]bool)
+		for len(issuers) != 0 {
+			issuer := issuers[0]
+			issuers = issuers[1:]
+			for k, cert := range certs {
+				if seen[k] || bytes.Equal(cert.Raw, issuer.Raw) || !bytes.Equal(cert.RawIssuer, issuer.RawSubject) || cert.CheckSignatureFrom(issuer) != nil {
+					continue
+				}
+				seen[k] = true
+				issuers = append(issuers, cert)
+				found++
+				for _, ref := range refs[k] {
+					bucket := root.Bucket(ref.user)
+					var value dbValue
+					if err := json.Unmarshal(bucket.Get(ref.key), &value); err != nil {
+						return err
+					}
+					if value.Status & (REVOKED_PUBLISHED|REVOKED_CASCADED) != 0 {
+						continue
+					}
+					value.Status = REVOKED_CASCADED
+					valueString, err := json.Marshal(value)
+					if err != nil {
+						return err
+					}
+					if err = bucket.Put(ref.key, valueString); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+//Block the block listener resumes from, the block after the last processed one
+func resumeHeight() uint64 {
+	nextBlockLock.Lock()
+	defer nextBlockLock.Unlock()
+	return nextBlock
+}
+
+//Handles every block from the next unprocessed one up to n, in order, persisting each as the last processed block. Blocks
+//already processed are ignored. A block that still fails after blockAttempts attempts is not skipped: nothing after it
+//is processed and it is retried from the next block event (or the catch up on restart).
+func deliverBlock(n uint64) {
+	var err error
+	for attempt := 1; attempt <= blockAttempts; attempt++ {
+		if attempt > 1 {
+			//Back off without holding nextBlockLock
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		if err = processBlocks(n); err == nil {
 			return
 		}
 	}
+	fmt.Printf("Could not process Block %d after %d attempts, retrying on the next block event: %s\n", resumeHeight(), blockAttempts, err)
+}
+
+//Handles blocks nextBlock to n, stops at the first block that fails
+func processBlocks(n uint64) error {
+	nextBlockLock.Lock()
+	defer nextBlockLock.Unlock()
+	if n < nextBlock {
+		fmt.Printf("Block %d already processed\n", n)
+		return nil
+	}
+	for nextBlock <= n {
+		fmt.Printf("Processing Block %d\n", nextBlock)
+		if err := handleEvent(nextBlock); err != nil {
+			return err
+		}
+		if err := setLastBlock(nextBlock); err != nil {
+			fmt.Printf("Could not persist last processed block: %s\n", err)
+		}
+		nextBlock++
+	}
+	return nil
+}
+
+//Processes every block committed since the last processed block (e.g. while the PM was offline)
+func catchUp() error {
+	sdkLock.Lock()
+	bci, err := fSetup.GetLedgerInfo()
+	sdkLock.Unlock()
+	if err != nil {
+		return err
+	}
+	height := bci.BCI.GetHeight()
+	from := resumeHeight()
+	if from < height {
+		fmt.Printf("Catching up on Blocks %d to %d\n", from, height-1)
+		deliverBlock(height-1)
+	}
+	return nil
+}
+
+//Reports the state of the block listener
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := blockListener.Health()
+	healthStr, err := json.Marshal(health)
+	if err != nil {
+		fmt.Fprintf(w, "Could not marshal health: %s\n", err)
+		return
+	}
+	if !health.Connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(healthStr)
 }
 
 func main() {
+	federationPath := flag.String("federation", "", "Federation config (JSON) listing the PMs whose published certificates are mirrored")
+	flag.StringVar(&availabilityUrl, "availability_url", "", "Availability store every published batch is uploaded to (e.g. http://store:8082), disabled if empty")
+	flag.StringVar(&batchStrategy, "hash_strategy", blockchain.DefaultHashStrategy, fmt.Sprintf("Hash strategy of the batch trees the PM publishes (%s)", strings.Join(blockchain.HashStrategies(), ", ")))
+	flag.BoolVar(&cascadeRevocations, "cascade", false, "When a revocation is published, also mark every known certificate below the revoked one as revoked (REVOKED_CASCADED)")
+	flag.StringVar(&blockStrategy, "block_hash_strategy", blockchain.DefaultHashStrategy, "Hash strategy of the relay's block trees, must match the relay's -hash_strategy")
+	flag.IntVar(&pcnVersion, "pcn_version", blockchain.PCNVersion2, "Format of the PCNs handed out on /csr/get: 2, or 1 for signing apps that only read v1 PCNs (PCNs are stored as v2 either way)")
+	flag.Parse()
+
+	if pcnVersion != blockchain.PCNVersion1 && pcnVersion != blockchain.PCNVersion2 {
+		fmt.Printf("Unsupported PCN version %d\n", pcnVersion)
+		return
+	}
+
+	var err error
+	if batchHasher, err = blockchain.NewHasher(batchStrategy); err != nil {
+		fmt.Printf("%s", err)
+		return
+	}
+	if blockHasher, err = blockchain.NewHasher(blockStrategy); err != nil {
+		fmt.Printf("%s", err)
+		return
+	}
+	batchStrategy = blockchain.RecordedHashStrategy(batchStrategy)
+	blockStrategy = blockchain.RecordedHashStrategy(blockStrategy)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
@@ -1384,6 +1792,8 @@ func main() {
 	bathcerStopped := make(chan bool)
 	stopBlockListener := make(chan bool)
 	blockListenerStopped := make(chan bool)
+	stopMirror := make(chan bool)
+	mirrorStopped := make(chan bool)
 
 	if err := initFabricContext(); err != nil {
 		fmt.Printf("Could Not init fabric context: %s", err)
@@ -1405,11 +1815,25 @@ func main() {
 		dbLock.Unlock()
 	}()
 
+	if err := initFederation(*federationPath); err != nil {
+		fmt.Printf("Could Not init federation: %s", err)
+		return
+	}
+
 	// Start Batcher
 	go batcher(stopBatcher, bathcerStopped)
 
-	// Start Block Listener
-	go blockchain.BlockListener(&sdkLock, &fSetup, handleEvent, stopBlockListener, blockListenerStopped)
+	// Start mirroring federated PMs
+	go mirror(stopMirror, mirrorStopped)
+
+	// Catch up on blocks missed while offline, then start Block Listener from the next block
+	blockListener = blockchain.NewBlockListener(&sdkLock, &fSetup, deliverBlock, resumeHeight)
+	go func() {
+		if err := catchUp(); err != nil {
+			fmt.Printf("Could not catch up on missed blocks: %s\n", err)
+		}
+		blockListener.Run(stopBlockListener, blockListenerStopped)
+	}()
 
 	//Run Cleanup Code on Ctrl + c
 	go func(){
@@ -1421,6 +1845,11 @@ func main() {
 		<-bathcerStopped
 		fmt.Printf("...Batcher Routine Stopped\n")
 
+		fmt.Printf("Signaling Federation Mirror Routine to Stop...\n")
+		close(stopMirror)
+		<-mirrorStopped
+		fmt.Printf("...Federation Mirror Routine Stopped\n")
+
 		fmt.Printf("Signaling Block Listener Routine to Stop...\n")
 		close(stopBlockListener)
 		<-blockListenerStopped
@@ -1453,6 +1882,8 @@ func main() {
 	serveMux.HandleFunc("/csr/", csrHandler)
 	serveMux.HandleFunc("/revoke/", revokeHandler)
 	serveMux.HandleFunc("/getAttr", getAttributes)
+	serveMux.HandleFunc("/health", healthHandler)
+	serveMux.HandleFunc("/federation/", federationHandler)
 	fmt.Println("Listening on Port 8080")
 	log.Fatal(http.ListenAndServeTLS(":8080", "certs/gpchain-webserver.crt", "certs/gpchain-webserver.key", serveMux))
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"bytes"
+	"errors"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/sha256"
+	"encoding/pem"
+	"encoding/json"
+
+	"blockchain-service/relay/relayWire"
+)
+
+//Reads the relay's public key from a PEM certificate (e.g. relay/certs/realy1.crt)
+func loadRelayKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found in relay certificate file\n")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Relay certificate does not contain an RSA key\n")
+	}
+	return key, nil
+}
+
+//Verified relay chain, persisted to dir/chain (one file per block) and dir/bloomFilter.txt
+type chainStore struct {
+	dir string
+	key *rsa.PublicKey
+	relayURL string // Base url of the relay's block request api, e.g. http://relay:8081 or http://relay:8081/mychannel
+	fullChain bool // Backfill from block 0 when the store is empty instead of starting at the first received block
+	jump bool // Skip gaps with a log jump proof from the relay when the received block commits to the block log
+	blocks map[uint64]*relayWire.RelayBlockMessage
+	first uint64 // Lowest stored index, the chain is only verified back to here
+	head *relayWire.RelayBlockMessage
+	filterIndex uint64 // Index of the relay block the stored bloom filter belongs to
+	hasFilter bool
+	pendingBlooms map[uint64]*relayWire.BloomMessage // Bloom messages that arrived before their relay block
+	checkpoint *relayWire.CheckpointMessage // Latest verified checkpoint
+}
+
+func (cs *chainStore) blockFile(index uint64) string {
+	return filepath.Join(cs.dir, "chain", fmt.Sprintf("%020d.json", index))
+}
+
+func (cs *chainStore) bloomFile() string {
+	return filepath.Join(cs.dir, "bloomFilter.txt")
+}
+
+//Proof that a block stored after a gap descends from the block before the gap
+func (cs *chainStore) jumpFile(index uint64) string {
+	return filepath.Join(cs.dir, "chain", fmt.Sprintf("%020d.jump", index))
+}
+
+func (cs *chainStore) checkpointFile() string {
+	return filepath.Join(cs.dir, "checkpoint.json")
+}
+
+//Writes data to path via a temporary file so a crash never leaves a partial file
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//Loads and re-verifies the chain stored by a previous run
+func openChainStore(dir string, key *rsa.PublicKey, relayURL string, fullChain, jump bool) (*chainStore, error) {
+	cs := &chainStore{dir: dir, key: key, relayURL: strings.TrimRight(relayURL, "/"), fullChain: fullChain, jump: jump,
+		blocks: make(map[uint64]*relayWire.RelayBlockMessage), pendingBlooms: make(map[uint64]*relayWire.BloomMessage)}
+	if err := os.MkdirAll(filepath.Join(dir, "chain"), 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "chain"))
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*relayWire.RelayBlockMessage
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "chain", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var msg relayWire.RelayBlockMessage
+		if err = json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Name(), err)
+		}
+		msgs = append(msgs, &msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Block.Index < msgs[j].Block.Index
+	})
+	for _, msg := range msgs {
+		if err = msg.Verify(key); err != nil {
+			return nil, fmt.Errorf("Stored chain is invalid: %s", err)
+		}
+		if cs.head == nil {
+			cs.first = msg.Block.Index
+		} else if msg.Block.Index == cs.head.Block.Index+1 {
+			if err = cs.checkLink(msg); err != nil {
+				return nil, fmt.Errorf("Stored chain is invalid: %s", err)
+			}
+		} else if err = cs.checkStoredJump(msg); err != nil {
+			return nil, fmt.Errorf("Stored chain is invalid: %s", err)
+		}
+		cs.blocks[msg.Block.Index] = msg
+		cs.head = msg
+	}
+
+	//Only keep the stored filter if it still matches the chain
+	if data, err := ioutil.ReadFile(cs.bloomFile()); err == nil {
+		var bloomMsg relayWire.BloomMessage
+		if err = json.Unmarshal(data, &bloomMsg); err == nil && cs.checkBloom(&bloomMsg) == nil {
+			cs.filterIndex = bloomMsg.Index
+			cs.hasFilter = true
+		} else {
+			fmt.Printf("Ignoring stored bloom filter, it does not match the stored chain\n")
+		}
+	}
+
+	//Only keep the stored checkpoint if it still matches the chain
+	if data, err := ioutil.ReadFile(cs.checkpointFile()); err == nil {
+		var checkpointMsg relayWire.CheckpointMessage
+		if err = json.Unmarshal(data, &checkpointMsg); err == nil && cs.checkCheckpoint(&checkpointMsg) == nil {
+			cs.checkpoint = &checkpointMsg
+		} else {
+			fmt.Printf("Ignoring stored checkpoint, it does not match the stored chain\n")
+		}
+	}
+
+	if cs.head != nil {
+		fmt.Printf("Loaded relay blocks %d to %d from %s\n", cs.first, cs.head.Block.Index, dir)
+	}
+	return cs, nil
+}
+
+//Checks msg directly follows the current head
+func (cs *chainStore) checkLink(msg *relayWire.RelayBlockMessage) error {
+	return msg.Block.VerifyLink(&cs.head.Block)
+}
+
+//Checks the jump proof stored for a block that follows a gap
+func (cs *chainStore) checkStoredJump(msg *relayWire.RelayBlockMessage) error {
+	data, err := ioutil.ReadFile(cs.jumpFile(msg.Block.Index))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Gap before relay block %d without a log jump proof\n", msg.Block.Index))
+	}
+	var jump relayWire.LogJump
+	if err = json.Unmarshal(data, &jump); err != nil {
+		return err
+	}
+	return msg.Block.VerifyJump(&cs.head.Block, &jump)
+}
+
+//Appends a verified block to the chain and writes it to disk. With a jump proof the block may follow a gap after the head.
+func (cs *chainStore) append(msg *relayWire.RelayBlockMessage, jump *relayWire.LogJump) error {
+	if cs.head != nil && jump != nil {
+		if err := msg.Block.VerifyJump(&cs.head.Block, jump); err != nil {
+			return err
+		}
+		data, err := json.Marshal(jump)
+		if err != nil {
+			return err
+		}
+		if err = writeAtomic(cs.jumpFile(msg.Block.Index), data); err != nil {
+			return err
+		}
+	} else if cs.head != nil {
+		if err := cs.checkLink(msg); err != nil {
+			return err
+		}
+	} else if msg.Block.Index != 0 {
+		fmt.Printf("Starting chain at relay block %d, earlier blocks are not verified\n", msg.Block.Index)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err = writeAtomic(cs.blockFile(msg.Block.Index), data); err != nil {
+		return err
+	}
+	if cs.head == nil {
+		cs.first = msg.Block.Index
+	}
+	cs.blocks[msg.Block.Index] = msg
+	cs.head = msg
+	fmt.Printf("Stored relay block %d\n", msg.Block.Index)
+
+	//A bloom message may have arrived before its block
+	for index := range cs.pendingBlooms {
+		if index < msg.Block.Index {
+			delete(cs.pendingBlooms, index)
+		}
+	}
+	if bloomMsg, ok := cs.pendingBlooms[msg.Block.Index]; ok {
+		delete(cs.pendingBlooms, msg.Block.Index)
+		if err = cs.HandleBloom(bloomMsg); err != nil {
+			fmt.Printf("Rejected bloom filter: %s\n", err)
+		}
+	}
+	return nil
+}
+
+//Requests relay block index from the relay's block request api
+func (cs *chainStore) fetch(index uint64) (*relayWire.RelayBlockMessage, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/blocks?blockNumber=%d", cs.relayURL, index))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var msg relayWire.RelayBlockMessage
+	if err = json.Unmarshal(body, &msg); err != nil {
+		return nil, errors.New(fmt.Sprintf("Unexpected response from relay: %s\n", strings.TrimSpace(string(body))))
+	}
+	if msg.Block.Index != index {
+		return nil, errors.New(fmt.Sprintf("Requested relay block %d, got %d\n", index, msg.Block.Index))
+	}
+	if err = msg.Verify(cs.key); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+//Fetches and appends relay blocks start to stop (exclusive)
+func (cs *chainStore) backfill(start, stop uint64) error {
+	for i := start; i < stop; i++ {
+		fmt.Printf("Backfilling relay block %d\n", i)
+		msg, err := cs.fetch(i)
+		if err != nil {
+			return fmt.Errorf("Could not backfill relay block %d: %s", i, err)
+		}
+		if err = cs.append(msg, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Requests the proof that the head is an ancestor of relay block index from the relay's block request api
+func (cs *chainStore) fetchJump(index uint64) (*relayWire.LogJump, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/jump?from=%d&to=%d", cs.relayURL, cs.head.Block.Index, index))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var jump relayWire.LogJump
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &jump) != nil {
+		return nil, errors.New(fmt.Sprintf("Unexpected response from relay: %s\n", strings.TrimSpace(string(body))))
+	}
+	return &jump, nil
+}
+
+//Verifies a relay block message received from the broker and adds it to the chain, backfilling any gap
+func (cs *chainStore) HandleBlock(msg *relayWire.RelayBlockMessage) error {
+	if err := msg.Verify(cs.key); err != nil {
+		return err
+	}
+	index := msg.Block.Index
+
+	//Retained messages are redelivered on every reconnect
+	if stored, ok := cs.blocks[index]; ok {
+		if !bytes.Equal(stored.BlockHash, msg.BlockHash) {
+			return errors.New(fmt.Sprintf("Relay block %d conflicts with the stored block, possible fork\n", index))
+		}
+		return nil
+	}
+	if cs.head != nil && index < cs.head.Block.Index {
+		return errors.New(fmt.Sprintf("Relay block %d is older than the stored chain (%d to %d)\n", index, cs.first, cs.head.Block.Index))
+	}
+
+	//Gap between the head and the received block, skipped with a single log proof if the block commits to the block log
+	if cs.head != nil && index > cs.head.Block.Index+1 {
+		fmt.Printf("Gap detected: have relay block %d, received %d\n", cs.head.Block.Index, index)
+		if cs.jump && len(msg.Block.LogRoot) != 0 {
+			jump, err := cs.fetchJump(index)
+			if err == nil {
+				if err = cs.append(msg, jump); err == nil {
+					fmt.Printf("Skipped relay blocks %d to %d with a log jump\n", jump.From+1, index-1)
+					return nil
+				}
+			}
+			fmt.Printf("Could not skip the gap, backfilling: %s\n", err)
+		}
+		if err := cs.backfill(cs.head.Block.Index+1, index); err != nil {
+			return err
+		}
+	} else if cs.head == nil && cs.fullChain && index > 0 {
+		if err := cs.backfill(0, index); err != nil {
+			return err
+		}
+	}
+	return cs.append(msg, nil)
+}
+
+//Checks the filter hashes to the BloomFilterHash of the relay block it claims to belong to
+func (cs *chainStore) checkBloom(bloomMsg *relayWire.BloomMessage) error {
+	msg, ok := cs.blocks[bloomMsg.Index]
+	if !ok {
+		return errors.New(fmt.Sprintf("Relay block %d is not stored\n", bloomMsg.Index))
+	}
+	filterHash := sha256.Sum256(bloomMsg.Filter)
+	if !bytes.Equal(filterHash[:], msg.Block.BloomFilterHash) {
+		return errors.New(fmt.Sprintf("Bloom filter does not match the filter hash of relay block %d\n", bloomMsg.Index))
+	}
+	if bloomMsg.Epoch != msg.Block.Epoch {
+		return errors.New(fmt.Sprintf("Bloom filter epoch %d does not match relay block %d epoch %d\n", bloomMsg.Epoch, bloomMsg.Index, msg.Block.Epoch))
+	}
+	return nil
+}
+
+//Verifies a bloom message and stores it if it is newer than the stored filter
+func (cs *chainStore) HandleBloom(bloomMsg *relayWire.BloomMessage) error {
+	if _, ok := cs.blocks[bloomMsg.Index]; !ok {
+		if cs.head == nil || bloomMsg.Index > cs.head.Block.Index {
+			fmt.Printf("Holding bloom filter for relay block %d until the block arrives\n", bloomMsg.Index)
+			cs.pendingBlooms[bloomMsg.Index] = bloomMsg
+			return nil
+		}
+		return errors.New(fmt.Sprintf("Relay block %d is not stored\n", bloomMsg.Index))
+	}
+	if err := cs.checkBloom(bloomMsg); err != nil {
+		return err
+	}
+	if cs.hasFilter && bloomMsg.Index <= cs.filterIndex {
+		return nil
+	}
+	data, err := json.Marshal(bloomMsg)
+	if err != nil {
+		return err
+	}
+	if err = writeAtomic(cs.bloomFile(), data); err != nil {
+		return err
+	}
+	cs.filterIndex = bloomMsg.Index
+	cs.hasFilter = true
+	fmt.Printf("Stored bloom filter for relay block %d (epoch %d)\n", bloomMsg.Index, bloomMsg.Epoch)
+	return nil
+}
+
+//Reads a checkpoint message (JSON or binary) from a file or from a url such as http://relay:8081/checkpoint
+func loadCheckpoint(source string) (*relayWire.CheckpointMessage, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else if data, err = ioutil.ReadFile(source); err != nil {
+		return nil, err
+	}
+	var msg relayWire.CheckpointMessage
+	if relayWire.IsBinary(data) {
+		err = msg.UnmarshalBinary(data)
+	} else {
+		err = json.Unmarshal(data, &msg)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not parse checkpoint: %s\n", strings.TrimSpace(string(data))))
+	}
+	return &msg, nil
+}
+
+//Verifies a checkpoint and checks it agrees with the stored chain
+func (cs *chainStore) checkCheckpoint(msg *relayWire.CheckpointMessage) error {
+	if err := msg.Verify(cs.key); err != nil {
+		return err
+	}
+	if stored, ok := cs.blocks[msg.Checkpoint.Index]; ok && !bytes.Equal(stored.BlockHash, msg.Checkpoint.BlockHash) {
+		return errors.New(fmt.Sprintf("Checkpoint %d conflicts with the stored block, possible fork\n", msg.Checkpoint.Index))
+	}
+	return nil
+}
+
+func (cs *chainStore) storeCheckpoint(msg *relayWire.CheckpointMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err = writeAtomic(cs.checkpointFile(), data); err != nil {
+		return err
+	}
+	cs.checkpoint = msg
+	fmt.Printf("Stored checkpoint at relay block %d\n", msg.Checkpoint.Index)
+	return nil
+}
+
+//Starts an empty chain at a trusted checkpoint, the chain is then verified from the checkpointed block onwards instead of
+//from relay block 0. If a chain is already stored the checkpoint is only checked against it.
+func (cs *chainStore) Bootstrap(msg *relayWire.CheckpointMessage) error {
+	if cs.head != nil {
+		return cs.HandleCheckpoint(msg)
+	}
+	if err := msg.Verify(cs.key); err != nil {
+		return err
+	}
+	fmt.Printf("Bootstrapping from checkpoint at relay block %d\n", msg.Checkpoint.Index)
+	if err := cs.append(&msg.Block, nil); err != nil {
+		return err
+	}
+	return cs.storeCheckpoint(msg)
+}
+
+//Verifies a checkpoint received from the relay and stores it if it is newer than the stored checkpoint
+func (cs *chainStore) HandleCheckpoint(msg *relayWire.CheckpointMessage) error {
+	if err := cs.checkCheckpoint(msg); err != nil {
+		return err
+	}
+	if cs.checkpoint != nil && msg.Checkpoint.Index <= cs.checkpoint.Checkpoint.Index {
+		return nil
+	}
+	return cs.storeCheckpoint(msg)
+}
@@ -4,37 +4,182 @@ import (
 	"fmt"
 	"os"
 	"flag"
+	"time"
+	"errors"
+	"encoding"
+	"encoding/json"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"blockchain-service/relay/relayWire"
+	"blockchain-service/relay/broadcast"
 )
 
+//Builds the TLS config used to connect to a broker (e.g. the relay's embedded broker)
+func tlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("Could not parse broker CA file\n")
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+//Decodes a relay message in either the binary or the JSON encoding
+func decodeMessage(data []byte, v interface{}) error {
+	if relayWire.IsBinary(data) {
+		return v.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+	return json.Unmarshal(data, v)
+}
+
 func main() {
-	topic := flag.String("topic", "", "")
+	topicPrefix := flag.String("topic_prefix", "relay1", "Topic prefix of the relay chain, subscribes to <prefix>-relayblocks, <prefix>-bloomfilters and <prefix>-checkpoints")
 	id := flag.String("id", "", "")
+	broker := flag.String("broker", "localhost:1883", "Broker address, default is localhost:1883")
+	username := flag.String("username", "", "Username used to authenticate with the broker")
+	password := flag.String("password", "", "Password used to authenticate with the broker")
+	useTLS := flag.Bool("tls", false, "Connect to the broker using TLS")
+	caFile := flag.String("ca", "", "CA certificate used to verify the broker")
+	certFile := flag.String("cert", "", "Client certificate used to authenticate with the broker")
+	keyFile := flag.String("key", "", "Client key used to authenticate with the broker")
+	qos := flag.Uint("qos", 1, "MQTT QoS of the subscription (0, 1 or 2)")
+	relayCert := flag.String("relay_cert", "realy1.crt", "Certificate of the relay, used to verify relay block signatures")
+	relayURL := flag.String("relay_url", "http://localhost:8081", "Block request api of the relay used to backfill gaps (append /<channelID> for other channels)")
+	dataDir := flag.String("data_dir", "relay-chain", "Directory the verified chain and bloom filter are stored in")
+	fullChain := flag.Bool("full_chain", false, "Backfill from relay block 0 when no chain is stored, instead of starting at the first received block")
+	transport := flag.String("transport", "mqtt", "How relay data is received: mqtt, multicast or spool")
+	multicastAddr := flag.String("multicast_addr", "239.0.0.1:9999", "UDP multicast group (or unicast address) to listen on")
+	multicastIface := flag.String("multicast_iface", "", "Interface to join the multicast group on")
+	spoolDir := flag.String("spool_dir", "spool", "Directory to read spooled relay messages from")
+	spoolRemove := flag.Bool("spool_remove", false, "Delete spool files once they have been read")
+	useBinary := flag.Bool("binary", false, "Subscribe to the binary topics (<prefix>-relayblocks-bin, <prefix>-bloomfilters-bin) instead of the JSON topics")
+	jump := flag.Bool("jump", true, "Skip gaps with a single log proof from the relay (/jump) instead of fetching every missing block, if the relay commits blocks to its block log")
+	checkpoint := flag.String("checkpoint", "", "Trusted checkpoint file (or url, e.g. http://localhost:8081/checkpoint) to start the chain at when no chain is stored")
 	flag.Parse()
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker("tcp://localhost:1883")
-	opts.SetClientID(*id)
-	opts.SetCleanSession(false)
+	relayKey, err := loadRelayKey(*relayCert)
+	if err != nil {
+		fmt.Printf("Could not load relay certificate: %s\n", err)
+		return
+	}
+
+	store, err := openChainStore(*dataDir, relayKey, *relayURL, *fullChain, *jump)
+	if err != nil {
+		fmt.Printf("Could not open chain store: %s\n", err)
+		return
+	}
+	if *checkpoint != "" {
+		checkpointMsg, err := loadCheckpoint(*checkpoint)
+		if err != nil {
+			fmt.Printf("Could not load checkpoint: %s\n", err)
+			return
+		}
+		if err = store.Bootstrap(checkpointMsg); err != nil {
+			fmt.Printf("Could not bootstrap from checkpoint: %s\n", err)
+			return
+		}
+	}
+
+	blockTopic := *topicPrefix + "-relayblocks"
+	bloomTopic := *topicPrefix + "-bloomfilters"
+	checkpointTopic := *topicPrefix + "-checkpoints"
+	if *useBinary {
+		blockTopic += "-bin"
+		bloomTopic += "-bin"
+		checkpointTopic += "-bin"
+	}
 
 	receivingChannel := make(chan [2]string)
 
-	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-		receivingChannel <- [2]string{msg.Topic(), string(msg.Payload())}
-	})
+	switch *transport {
+	case "mqtt":
+		opts := mqtt.NewClientOptions()
+		if *useTLS {
+			config, err := tlsConfig(*caFile, *certFile, *keyFile)
+			if err != nil {
+				fmt.Printf("Could not create TLS config: %s\n", err)
+				return
+			}
+			opts.AddBroker("ssl://" + *broker)
+			opts.SetTLSConfig(config)
+		} else {
+			opts.AddBroker("tcp://" + *broker)
+		}
+		opts.SetClientID(*id)
+		opts.SetCleanSession(false)
+		if *username != "" {
+			opts.SetUsername(*username)
+			opts.SetPassword(*password)
+		}
+
+		opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+			receivingChannel <- [2]string{msg.Topic(), string(msg.Payload())}
+		})
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Printf("Couldn't Connect: %s\n", token.Error())
+		//Subscribe on every (re)connect, the broker may have lost the session while the connection was down
+		opts.SetAutoReconnect(true)
+		opts.SetOnConnectHandler(func(client mqtt.Client) {
+			fmt.Printf("Connected, subscribing to %s, %s and %s\n", blockTopic, bloomTopic, checkpointTopic)
+			topics := map[string]byte{blockTopic: byte(*qos), bloomTopic: byte(*qos), checkpointTopic: byte(*qos)}
+			if token := client.SubscribeMultiple(topics, nil); token.Wait() && token.Error() != nil {
+				fmt.Println(token.Error())
+				os.Exit(1)
+			}
+		})
+		opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			fmt.Printf("Lost connection to broker: %s\n", err)
+		})
+
+		client := mqtt.NewClient(opts)
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			fmt.Printf("Couldn't Connect: %s\n", token.Error())
+			return
+		}
+		defer client.Disconnect(uint(250))
+	case "multicast", "spool":
+		var listener broadcast.Listener
+		if *transport == "multicast" {
+			listener, err = broadcast.ListenMulticast(*multicastAddr, *multicastIface, 30*time.Second)
+		} else {
+			listener, err = broadcast.ListenSpool(*spoolDir, 5*time.Second, *spoolRemove)
+		}
+		if err != nil {
+			fmt.Printf("Could not start %s listener: %s\n", *transport, err)
+			return
+		}
+		defer listener.Close()
+		fmt.Printf("Listening for %s, %s and %s on %s\n", blockTopic, bloomTopic, checkpointTopic, *transport)
+
+		//One way transports carry every topic of the relay, the loop below ignores the others
+		go func() {
+			for msg := range listener.Messages() {
+				receivingChannel <- [2]string{msg.Topic, string(msg.Payload)}
+			}
+			close(receivingChannel)
+		}()
+	default:
+		fmt.Printf("Unknown transport %s\n", *transport)
 		return
 	}
-	defer client.Disconnect(uint(250))
-	
-	if token := client.Subscribe(*topic, byte(0), nil); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		os.Exit(1)
-	}
 
+	//Messages are handled one at a time, so the store is only used from this routine
 	for true {
 		fmt.Printf("Waiting...\n")
 		incoming, isOpen := <-receivingChannel
@@ -42,6 +187,39 @@ func main() {
 			fmt.Println("Channel Closed")
 			return
 		}
-		fmt.Printf("RECEIVED TOPIC: %s MESSAGE: %s\n", incoming[0], incoming[1])
+
+		//Both topics may carry either encoding, binary messages start with the relayWire header
+		payload := []byte(incoming[1])
+		switch incoming[0] {
+		case blockTopic:
+			var msg relayWire.RelayBlockMessage
+			if err := decodeMessage(payload, &msg); err != nil {
+				fmt.Printf("Could not parse relay block message: %s\n", err)
+				continue
+			}
+			if err := store.HandleBlock(&msg); err != nil {
+				fmt.Printf("Rejected relay block %d: %s\n", msg.Block.Index, err)
+			}
+		case bloomTopic:
+			var bloomMsg relayWire.BloomMessage
+			if err := decodeMessage(payload, &bloomMsg); err != nil {
+				fmt.Printf("Could not parse bloom message: %s\n", err)
+				continue
+			}
+			if err := store.HandleBloom(&bloomMsg); err != nil {
+				fmt.Printf("Rejected bloom filter for relay block %d: %s\n", bloomMsg.Index, err)
+			}
+		case checkpointTopic:
+			var checkpointMsg relayWire.CheckpointMessage
+			if err := decodeMessage(payload, &checkpointMsg); err != nil {
+				fmt.Printf("Could not parse checkpoint message: %s\n", err)
+				continue
+			}
+			if err := store.HandleCheckpoint(&checkpointMsg); err != nil {
+				fmt.Printf("Rejected checkpoint at relay block %d: %s\n", checkpointMsg.Checkpoint.Index, err)
+			}
+		default:
+			fmt.Printf("Ignoring message on topic %s\n", incoming[0])
+		}
 	}
-}
\ No newline at end of file
+}
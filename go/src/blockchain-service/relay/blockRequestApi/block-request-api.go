@@ -3,16 +3,13 @@ package blockRequestApi
 import (
 	"fmt"
 	"sync"
-	"bytes"
 	"path"
 	"crypto"
 	"strconv"
 	"net/http"
 	"crypto/rsa"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/json"
-	"github.com/willf/bloom"
 	"blockchain-service/blockchain"
 	"blockchain-service/relay/relayTypes"
 )
@@ -33,56 +30,53 @@ const (
 	p = 0.000001
 )
 
-var sdkLock *sync.Mutex
-var fSetup *blockchain.FabricSetup
-var rsaKey *rsa.PrivateKey
+//Fabric channel served by the block request api
+type Channel struct {
+	ChannelID string
+	SdkLock *sync.Mutex //Must acquire before using FSetup
+	FSetup *blockchain.FabricSetup
+	Listener *blockchain.BlockListener // Block listener of the channel, reported on /health
+}
 
-func createChain(previousBlock *relayTypes.RelayBlock, filter *bloom.BloomFilter, current, stop uint64) (*relayTypes.RelayBlock, error) {
-	var currentBlock relayTypes.RelayBlock
-	currentBlock.Index = current
-	if previousBlock != nil {
-		currentBlock.PreviousBlockHash = previousBlock.Hash()
-	} else {
-		currentBlock.PreviousBlockHash = []byte("")
-	}
+var rsaKey *rsa.PrivateKey
+var epochLength uint64
+var header relayTypes.HeaderConfig
+var checkpointInterval uint64
 
-	blockMerkleTree, revocations, err  := relayTypes.ProcessBlock(current + blockchain.BlockOffset, sdkLock, fSetup)
+//Rebuilds the relay chain from the ledger up to relay block stop. The returned builder holds the state after stop.
+func (c Channel) createChain(stop uint64) (*relayTypes.ChainBuilder, *relayTypes.RelayBlock, error) {
+	logHasher, err := header.Hasher()
 	if err != nil {
-		fmt.Printf("Could not update relay state: %s\n", err)
-		return nil, err
+		return nil, nil, err
 	}
-
-	blockRoot := blockMerkleTree.CurrentRoot().Hash()
-	currentBlock.BlockMerkleRoot = blockRoot
-
-	//Add Revocation to Bloom Filter
-	if revocations != nil {
-		for _,revocation := range *revocations {
-			sum := sha256.Sum256(revocation)
-			filter.Add(sum[:])
+	builder := relayTypes.NewChainBuilder(header, relayTypes.NewRevocationSet(n, p, epochLength), logHasher)
+	for true {
+		processed, err  := relayTypes.ProcessBlock(builder.Index() + blockchain.BlockOffset, c.SdkLock, c.FSetup, logHasher)
+		if err != nil {
+			fmt.Printf("Could not update relay state: %s\n", err)
+			return nil, nil, err
 		}
-
-		//Convert Bloom Filter to []byte
-		filterBuffer := bytes.NewBuffer([]byte{})
-		_, err = filter.WriteTo(filterBuffer)
+		relayBlk, _, err := builder.Next(processed)
 		if err != nil {
-			fmt.Printf("Error: Could not write bloom filter: %v\n", err)
-			return nil, err
+			return nil, nil, err
+		}
+		if relayBlk.Index == stop {
+			return builder, relayBlk, nil
 		}
-		filterBufferHash := sha256.Sum256(filterBuffer.Bytes())
-		currentBlock.BloomFilterHash = filterBufferHash[:]
-	} else {
-		currentBlock.BloomFilterHash = []byte("")
-	}
-	
-	if current == stop {
-		return &currentBlock, nil
 	}
+	return nil, nil, nil
+}
 
-	return createChain(&currentBlock, filter, current+1, stop)
+//Signs relayBlk and wraps it in a relay block message
+func signBlock(relayBlk *relayTypes.RelayBlock) (*relayTypes.RelayBlockMessage, error) {
+	signedRelayBlock, err := rsaKey.Sign(rand.Reader, relayBlk.Hash(), signerOpt{crypto.SHA256})
+	if err != nil {
+		return nil, err
+	}
+	return &relayTypes.RelayBlockMessage{*relayBlk, [][]byte{signedRelayBlock}, relayBlk.Hash()}, nil
 }
 
-func getRelayBlock(w http.ResponseWriter, r *http.Request) {
+func (c Channel) getRelayBlock(w http.ResponseWriter, r *http.Request) {
 	blkNumStr := r.URL.Query()["blockNumber"]
 	if len(blkNumStr) == 0 {
 		fmt.Fprintf(w, "Block Number not Provided!\n")
@@ -100,22 +94,18 @@ func getRelayBlock(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Could not parse provided block number to type uint64\n")
 		return
 	}
-	filter := bloom.NewWithEstimates(n, p)
-	relayBlk, err := createChain(nil, filter, uint64(0), blkNum)
+	_, relayBlk, err := c.createChain(blkNum)
 	if err != nil {
 		fmt.Fprintf(w, "Could compute relayblock: %s\n", err)
 		return
 	}
 
 	// RSA sig of block
-	signedRelayBlock, err := rsaKey.Sign(rand.Reader, relayBlk.Hash(), signerOpt{crypto.SHA256}) 
+	relayBlkMsg, err := signBlock(relayBlk)
 	if err != nil {
 		fmt.Printf("Could not sign relay block: %s\n", err)
 		return
 	}
-	
-	// Create Realy Block Message
-	relayBlkMsg := relayTypes.RelayBlockMessage{*relayBlk, [][]byte{signedRelayBlock}, relayBlk.Hash()}
 	relayBlkMsgStr, err := json.Marshal(relayBlkMsg)
 	if err != nil {
 		fmt.Printf("Could not marshal relay block message: %s\n", err)
@@ -126,8 +116,83 @@ func getRelayBlock(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func getCurrentHeight(w http.ResponseWriter, r *http.Request) {
-	bci, err := fSetup.GetLedgerInfo()
+//Serves the checkpoint at relay block blockNumber, or the latest checkpoint if no block number is given
+func (c Channel) getCheckpoint(w http.ResponseWriter, r *http.Request) {
+	var blkNum uint64
+	blkNumStr := r.URL.Query()["blockNumber"]
+	if len(blkNumStr) != 0 {
+		isNum, err := path.Match("[0-9]*", blkNumStr[0])
+		if !isNum || err != nil {
+			fmt.Fprintf(w, "Block Number is not a Number!\n")
+			return
+		}
+		if blkNum, err = strconv.ParseUint(blkNumStr[0], 10, 64); err != nil {
+			fmt.Fprintf(w, "Could not parse provided block number to type uint64\n")
+			return
+		}
+	} else {
+		if checkpointInterval == 0 {
+			fmt.Fprintf(w, "Checkpoints are disabled, provide a Block Number!\n")
+			return
+		}
+		c.SdkLock.Lock()
+		bci, err := c.FSetup.GetLedgerInfo()
+		c.SdkLock.Unlock()
+		if err != nil || bci.BCI.GetHeight() < 2 {
+			fmt.Fprintf(w, "Could not get max height!\n")
+			return
+		}
+		height := bci.BCI.GetHeight() - 2
+		blkNum = height - height%checkpointInterval
+	}
+
+	builder, relayBlk, err := c.createChain(blkNum)
+	if err != nil {
+		fmt.Fprintf(w, "Could compute relayblock: %s\n", err)
+		return
+	}
+	checkpoint, err := builder.Checkpoint()
+	if err != nil {
+		fmt.Fprintf(w, "Could not create checkpoint: %s\n", err)
+		return
+	}
+	relayBlkMsg, err := signBlock(relayBlk)
+	if err != nil {
+		fmt.Printf("Could not sign relay block: %s\n", err)
+		return
+	}
+	signedCheckpoint, err := rsaKey.Sign(rand.Reader, checkpoint.Hash(), signerOpt{crypto.SHA256})
+	if err != nil {
+		fmt.Printf("Could not sign checkpoint: %s\n", err)
+		return
+	}
+	checkpointMsg := relayTypes.CheckpointMessage{*checkpoint, *relayBlkMsg, [][]byte{signedCheckpoint}, checkpoint.Hash()}
+	checkpointMsgStr, err := json.Marshal(checkpointMsg)
+	if err != nil {
+		fmt.Printf("Could not marshal checkpoint message: %s\n", err)
+		return
+	}
+	fmt.Fprintf(w, string(checkpointMsgStr))
+}
+
+//Reports the state of the channel's block listener
+func (c Channel) getHealth(w http.ResponseWriter, r *http.Request) {
+	health := c.Listener.Health()
+	healthStr, err := json.Marshal(health)
+	if err != nil {
+		fmt.Fprintf(w, "Could not marshal health: %s\n", err)
+		return
+	}
+	if !health.Connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(healthStr)
+}
+
+func (c Channel) getCurrentHeight(w http.ResponseWriter, r *http.Request) {
+	c.SdkLock.Lock()
+	bci, err := c.FSetup.GetLedgerInfo()
+	c.SdkLock.Unlock()
 	if err != nil {
 		fmt.Fprintf(w, "Could not get max height!\n")
 		return
@@ -136,20 +201,39 @@ func getCurrentHeight(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func StartBlockRequestListener(m *sync.Mutex, f *blockchain.FabricSetup, key rsa.PrivateKey, stop, done chan bool) {
-	sdkLock = m
-	fSetup = f
+//Serves blocks, checkpoint, currentHeight, health, consistency and jump under /<channelID>/ for every channel. The first
+//channel is also served without the prefix (/blocks etc.) so single channel deployments keep their urls.
+func StartBlockRequestListener(addr string, channels []Channel, key rsa.PrivateKey, revocationEpochLength uint64, headerConfig relayTypes.HeaderConfig, checkpointEvery uint64, stop, done chan bool) {
 	rsaKey = &key
+	epochLength = revocationEpochLength
+	header = headerConfig
+	checkpointInterval = checkpointEvery
 	defer func () {
 		done <- true
 	}()
 
 	go func() {
 		httpServeMux := http.NewServeMux()
-		httpServeMux.HandleFunc("/blocks", getRelayBlock)
-		httpServeMux.HandleFunc("/currentHeight", getCurrentHeight)
-		fmt.Printf("Block Request Listener Started on Port :8081\n")
-		http.ListenAndServe(":8081", httpServeMux)
+		for i, c := range channels {
+			httpServeMux.HandleFunc("/"+c.ChannelID+"/blocks", c.getRelayBlock)
+			httpServeMux.HandleFunc("/"+c.ChannelID+"/checkpoint", c.getCheckpoint)
+			httpServeMux.HandleFunc("/"+c.ChannelID+"/currentHeight", c.getCurrentHeight)
+			httpServeMux.HandleFunc("/"+c.ChannelID+"/health", c.getHealth)
+			httpServeMux.HandleFunc("/"+c.ChannelID+"/consistency", c.getConsistency)
+			httpServeMux.HandleFunc("/"+c.ChannelID+"/jump", c.getJump)
+			if i == 0 {
+				httpServeMux.HandleFunc("/blocks", c.getRelayBlock)
+				httpServeMux.HandleFunc("/checkpoint", c.getCheckpoint)
+				httpServeMux.HandleFunc("/currentHeight", c.getCurrentHeight)
+				httpServeMux.HandleFunc("/health", c.getHealth)
+				httpServeMux.HandleFunc("/consistency", c.getConsistency)
+				httpServeMux.HandleFunc("/jump", c.getJump)
+			}
+		}
+		fmt.Printf("Block Request Listener Started on %s\n", addr)
+		if err := http.ListenAndServe(addr, httpServeMux); err != nil {
+			fmt.Printf("Block Request Listener Stopped: %s\n", err)
+		}
 	}()
 
 	<-stop
@@ -0,0 +1,94 @@
+package blockRequestApi
+
+import (
+	"fmt"
+	"path"
+	"errors"
+	"strconv"
+	"net/http"
+	"encoding/json"
+)
+
+//Parses the uint64 query parameter name
+func uintParam(r *http.Request, name string) (uint64, error) {
+	values := r.URL.Query()[name]
+	if len(values) == 0 {
+		return 0, errors.New(fmt.Sprintf("%s not Provided!\n", name))
+	}
+	isNum, err := path.Match("[0-9]*", values[0])
+	if !isNum || err != nil {
+		return 0, errors.New(fmt.Sprintf("%s is not a Number!\n", name))
+	}
+	return strconv.ParseUint(values[0], 10, 64)
+}
+
+//Reads the from and to parameters of a log proof request, to must be at least 1
+func logRange(r *http.Request) (uint64, uint64, error) {
+	from, err := uintParam(r, "from")
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := uintParam(r, "to")
+	if err != nil {
+		return 0, 0, err
+	}
+	if to == 0 || from > to {
+		return 0, 0, errors.New(fmt.Sprintf("Invalid log range %d to %d\n", from, to))
+	}
+	return from, to, nil
+}
+
+//Serves the consistency proof between the block log at tree sizes from and to (/consistency?from=<m>&to=<n>). The log at
+//size n is the log relay block n commits to.
+func (c Channel) getConsistency(w http.ResponseWriter, r *http.Request) {
+	from, to, err := logRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	builder, _, err := c.createChain(to - 1)
+	if err != nil {
+		fmt.Fprintf(w, "Could compute relayblock: %s\n", err)
+		return
+	}
+	proof, err := builder.ConsistencyProof(from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	proofStr, err := json.Marshal(proof)
+	if err != nil {
+		fmt.Printf("Could not marshal consistency proof: %s\n", err)
+		return
+	}
+	w.Write(proofStr)
+}
+
+//Serves the proof that relay block from is an ancestor of relay block to (/jump?from=<m>&to=<n>), see relayWire.LogJump
+func (c Channel) getJump(w http.ResponseWriter, r *http.Request) {
+	from, to, err := logRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	builder, _, err := c.createChain(to - 1)
+	if err != nil {
+		fmt.Fprintf(w, "Could compute relayblock: %s\n", err)
+		return
+	}
+	jump, err := builder.Jump(from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	jumpStr, err := json.Marshal(jump)
+	if err != nil {
+		fmt.Printf("Could not marshal log jump: %s\n", err)
+		return
+	}
+	w.Write(jumpStr)
+}
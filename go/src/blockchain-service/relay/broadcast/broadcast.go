@@ -0,0 +1,73 @@
+package broadcast
+
+import (
+	"fmt"
+	"errors"
+	"encoding/binary"
+)
+
+//Transports the relay broadcasts on. Every transport carries the same (topic, payload) messages, so receivers handle them
+//the same way regardless of how they arrived. This package only depends on the standard library so receivers can use
+//the listeners without the fabric sdk. MQTT is provided by relayPublisher.Publisher, which implements Sender.
+
+type Message struct {
+	Topic string
+	Payload []byte
+}
+
+//Sends messages to receivers. Publish returns once the message has been handed to the transport (queued, written or sent),
+//there is no acknowledgement from receivers.
+type Sender interface {
+	Publish(topic string, payload []byte) error
+	Close()
+}
+
+//Receives messages from a transport
+type Listener interface {
+	Messages() <-chan Message
+	Close() error
+}
+
+//Publishes to several senders. Every sender gets the message even if an earlier one fails, the first error is returned.
+type Fanout []Sender
+
+func (f Fanout) Publish(topic string, payload []byte) error {
+	var firstErr error
+	for _, s := range f {
+		if err := s.Publish(topic, payload); err != nil {
+			fmt.Printf("Broadcast: Could not publish to topic %s: %s\n", topic, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (f Fanout) Close() {
+	for _, s := range f {
+		s.Close()
+	}
+}
+
+// envelope = [2 bytes topic length] + [topic] + [payload]
+func encodeEnvelope(topic string, payload []byte) ([]byte, error) {
+	if len(topic) > 0xffff {
+		return nil, errors.New("Topic too long\n")
+	}
+	data := make([]byte, 2, 2+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(data, uint16(len(topic)))
+	data = append(data, topic...)
+	return append(data, payload...), nil
+}
+
+func decodeEnvelope(data []byte) (Message, error) {
+	if len(data) < 2 {
+		return Message{}, errors.New("Truncated message\n")
+	}
+	topicLen := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+topicLen {
+		return Message{}, errors.New("Truncated message topic\n")
+	}
+	return Message{string(data[2:2+topicLen]), append([]byte{}, data[2+topicLen:]...)}, nil
+}
@@ -0,0 +1,405 @@
+package broadcast
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// UDP frame = [2 byte magic "GB"] + [1 byte version] + [1 byte kind] + [8 byte message ID] + [2 byte index]
+//           + [2 byte data fragment count] + [1 byte group size] + [1 byte reserved] + [2 byte fragment size]
+//           + [4 byte envelope length] + [chunk]
+//
+// The envelope is split into fragments of fragment size bytes. After every group of group size data fragments a parity
+// fragment (XOR of the group, short fragments zero padded) is sent, index is then the group number. A receiver can rebuild
+// one lost data fragment per group. Messages may be sent several times (Repeat), receivers drop duplicates by message ID.
+
+const frameVersion = 1
+const frameHeaderSize = 24
+
+const (
+	frameData = byte(0)
+	frameParity = byte(1)
+)
+
+var frameMagic = []byte("GB")
+
+type MulticastOptions struct {
+	Addr string // Multicast group (or unicast address for a one way link), e.g. 239.0.0.1:9999
+	Interface string // Interface to join the group on, empty for the system default
+	FragmentSize int // Bytes of the envelope per frame, default 1200 (fits a 1500 byte MTU)
+	GroupSize int // Data fragments per parity fragment, 0 disables parity
+	Repeat int // Number of times each message is sent, default 1
+	Pace time.Duration // Pause between frames, gives slow receivers time to drain their socket
+}
+
+func (opts *MulticastOptions) setDefaults() error {
+	if opts.FragmentSize == 0 {
+		opts.FragmentSize = 1200
+	}
+	if opts.FragmentSize < 1 || opts.FragmentSize > 0xffff-frameHeaderSize {
+		return errors.New(fmt.Sprintf("Invalid fragment size %d\n", opts.FragmentSize))
+	}
+	if opts.GroupSize < 0 || opts.GroupSize > 0xff {
+		return errors.New(fmt.Sprintf("Invalid parity group size %d\n", opts.GroupSize))
+	}
+	if opts.Repeat == 0 {
+		opts.Repeat = 1
+	}
+	return nil
+}
+
+type frameHeader struct {
+	kind byte
+	id uint64
+	index uint16
+	count uint16
+	groupSize uint8
+	fragmentSize uint16
+	length uint32
+}
+
+func (h *frameHeader) encode(chunk []byte) []byte {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(chunk))
+	copy(frame, frameMagic)
+	frame[2] = frameVersion
+	frame[3] = h.kind
+	binary.BigEndian.PutUint64(frame[4:], h.id)
+	binary.BigEndian.PutUint16(frame[12:], h.index)
+	binary.BigEndian.PutUint16(frame[14:], h.count)
+	frame[16] = h.groupSize
+	binary.BigEndian.PutUint16(frame[18:], h.fragmentSize)
+	binary.BigEndian.PutUint32(frame[20:], h.length)
+	return append(frame, chunk...)
+}
+
+func decodeFrame(frame []byte) (*frameHeader, []byte, error) {
+	if len(frame) < frameHeaderSize || !bytes.Equal(frame[:2], frameMagic) {
+		return nil, nil, errors.New("Not a broadcast frame\n")
+	}
+	if frame[2] != frameVersion {
+		return nil, nil, errors.New(fmt.Sprintf("Unsupported frame version %d\n", frame[2]))
+	}
+	h := &frameHeader{
+		kind:         frame[3],
+		id:           binary.BigEndian.Uint64(frame[4:]),
+		index:        binary.BigEndian.Uint16(frame[12:]),
+		count:        binary.BigEndian.Uint16(frame[14:]),
+		groupSize:    frame[16],
+		fragmentSize: binary.BigEndian.Uint16(frame[18:]),
+		length:       binary.BigEndian.Uint32(frame[20:]),
+	}
+	chunk := frame[frameHeaderSize:]
+	if h.fragmentSize == 0 || h.count == 0 || uint64(h.count)*uint64(h.fragmentSize) < uint64(h.length) ||
+		uint64(h.count-1)*uint64(h.fragmentSize) >= uint64(h.length) || len(chunk) > int(h.fragmentSize) {
+		return nil, nil, errors.New("Inconsistent frame header\n")
+	}
+	return h, chunk, nil
+}
+
+//XORs src into dst (dst is at least as long as src)
+func xorInto(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+//Splits an envelope into data and parity frames
+func fragment(id uint64, envelope []byte, fragmentSize, groupSize int) ([][]byte, error) {
+	count := (len(envelope) + fragmentSize - 1) / fragmentSize
+	if count == 0 {
+		count = 1
+	}
+	if count > 0xffff {
+		return nil, errors.New(fmt.Sprintf("Message too large (%d bytes) for fragment size %d\n", len(envelope), fragmentSize))
+	}
+	h := frameHeader{frameData, id, 0, uint16(count), uint8(groupSize), uint16(fragmentSize), uint32(len(envelope))}
+
+	var frames [][]byte
+	var parity []byte
+	for i := 0; i < count; i++ {
+		end := (i + 1) * fragmentSize
+		if end > len(envelope) {
+			end = len(envelope)
+		}
+		chunk := envelope[i*fragmentSize : end]
+		h.kind, h.index = frameData, uint16(i)
+		frames = append(frames, h.encode(chunk))
+
+		if groupSize == 0 {
+			continue
+		}
+		if parity == nil {
+			parity = make([]byte, fragmentSize)
+		}
+		xorInto(parity, chunk)
+		if (i+1)%groupSize == 0 || i == count-1 {
+			h.kind, h.index = frameParity, uint16(i/groupSize)
+			frames = append(frames, h.encode(parity))
+			parity = nil
+		}
+	}
+	return frames, nil
+}
+
+//Sends messages to a UDP multicast group
+type MulticastSender struct {
+	opts MulticastOptions
+	conn *net.UDPConn
+	lock sync.Mutex //Must acquire before using conn or nextID
+	nextID uint64
+}
+
+func NewMulticastSender(opts MulticastOptions) (*MulticastSender, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	//Random starting ID so receivers don't drop messages as duplicates after a relay restart
+	var idBytes [8]byte
+	if _, err = rand.Read(idBytes[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &MulticastSender{opts: opts, conn: conn, nextID: binary.BigEndian.Uint64(idBytes[:])}, nil
+}
+
+func (s *MulticastSender) Publish(topic string, payload []byte) error {
+	envelope, err := encodeEnvelope(topic, payload)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	frames, err := fragment(s.nextID, envelope, s.opts.FragmentSize, s.opts.GroupSize)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+
+	for r := 0; r < s.opts.Repeat; r++ {
+		for _, frame := range frames {
+			if _, err = s.conn.Write(frame); err != nil {
+				return err
+			}
+			if s.opts.Pace != 0 {
+				time.Sleep(s.opts.Pace)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MulticastSender) Close() {
+	s.conn.Close()
+}
+
+//Fragments of a message that is not complete yet
+type partialMessage struct {
+	header *frameHeader
+	data [][]byte
+	parity [][]byte
+	received int
+	started time.Time
+}
+
+//Rebuilds missing data fragments from parity where exactly one fragment of a group is missing
+func (pm *partialMessage) recover() {
+	groupSize := int(pm.header.groupSize)
+	if groupSize == 0 {
+		return
+	}
+	for g := range pm.parity {
+		if pm.parity[g] == nil {
+			continue
+		}
+		missing := -1
+		for i := g * groupSize; i < (g+1)*groupSize && i < len(pm.data); i++ {
+			if pm.data[i] == nil {
+				if missing != -1 {
+					missing = -2
+					break
+				}
+				missing = i
+			}
+		}
+		if missing < 0 {
+			continue
+		}
+		rebuilt := append([]byte{}, pm.parity[g]...)
+		for i := g * groupSize; i < (g+1)*groupSize && i < len(pm.data); i++ {
+			if i != missing {
+				xorInto(rebuilt, pm.data[i])
+			}
+		}
+		//Every fragment but the last is full size
+		size := int(pm.header.fragmentSize)
+		if missing == len(pm.data)-1 {
+			size = int(pm.header.length) - missing*int(pm.header.fragmentSize)
+		}
+		pm.data[missing] = rebuilt[:size]
+		pm.received++
+	}
+}
+
+func (pm *partialMessage) envelope() []byte {
+	var envelope []byte
+	for _, chunk := range pm.data {
+		envelope = append(envelope, chunk...)
+	}
+	return envelope
+}
+
+//Receives messages from a UDP multicast group, reassembling fragments and repairing losses with parity fragments
+type MulticastListener struct {
+	conn *net.UDPConn
+	timeout time.Duration
+	partial map[uint64]*partialMessage
+	delivered map[uint64]time.Time
+	messages chan Message
+}
+
+//Joins the multicast group addr (or listens on addr if it is not a multicast address). Incomplete messages are dropped
+//after timeout.
+func ListenMulticast(addr, iface string, timeout time.Duration) (*MulticastListener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var conn *net.UDPConn
+	if udpAddr.IP != nil && udpAddr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if iface != "" {
+			if ifi, err = net.InterfaceByName(iface); err != nil {
+				return nil, err
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp", ifi, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp", udpAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadBuffer(4 * 1024 * 1024)
+
+	l := &MulticastListener{conn, timeout, make(map[uint64]*partialMessage), make(map[uint64]time.Time), make(chan Message, 16)}
+	go l.run()
+	return l, nil
+}
+
+func (l *MulticastListener) Messages() <-chan Message {
+	return l.messages
+}
+
+func (l *MulticastListener) Close() error {
+	return l.conn.Close()
+}
+
+//Drops incomplete messages and forgets delivered IDs once they can no longer be repeated
+func (l *MulticastListener) expire(now time.Time) {
+	for id, pm := range l.partial {
+		if now.Sub(pm.started) > l.timeout {
+			fmt.Printf("Multicast: Dropping incomplete message %d (%d of %d fragments)\n", id, pm.received, len(pm.data))
+			delete(l.partial, id)
+		}
+	}
+	for id, t := range l.delivered {
+		if now.Sub(t) > l.timeout {
+			delete(l.delivered, id)
+		}
+	}
+}
+
+func (l *MulticastListener) run() {
+	defer close(l.messages)
+	buf := make([]byte, 0x10000)
+	lastExpire := time.Now()
+
+	for true {
+		n, _, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("Multicast: Listener stopped: %s\n", err)
+			return
+		}
+		now := time.Now()
+		if now.Sub(lastExpire) > l.timeout/2 {
+			l.expire(now)
+			lastExpire = now
+		}
+
+		h, chunk, err := decodeFrame(buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, ok := l.delivered[h.id]; ok {
+			continue
+		}
+
+		pm, ok := l.partial[h.id]
+		if !ok {
+			groups := 0
+			if h.groupSize != 0 {
+				groups = (int(h.count) + int(h.groupSize) - 1) / int(h.groupSize)
+			}
+			pm = &partialMessage{h, make([][]byte, h.count), make([][]byte, groups), 0, now}
+			l.partial[h.id] = pm
+		} else if h.count != pm.header.count || h.groupSize != pm.header.groupSize || h.fragmentSize != pm.header.fragmentSize || h.length != pm.header.length {
+			continue
+		}
+
+		switch h.kind {
+		case frameData:
+			if int(h.index) >= len(pm.data) || pm.data[h.index] != nil {
+				continue
+			}
+			//Every fragment but the last is full size
+			size := int(h.fragmentSize)
+			if int(h.index) == len(pm.data)-1 {
+				size = int(h.length) - int(h.index)*int(h.fragmentSize)
+			}
+			if len(chunk) != size {
+				continue
+			}
+			pm.data[h.index] = append([]byte{}, chunk...)
+			pm.received++
+		case frameParity:
+			if int(h.index) >= len(pm.parity) || pm.parity[h.index] != nil {
+				continue
+			}
+			pm.parity[h.index] = append(make([]byte, 0, h.fragmentSize), chunk...)[:h.fragmentSize]
+		default:
+			continue
+		}
+
+		if pm.received < len(pm.data) {
+			pm.recover()
+		}
+		if pm.received < len(pm.data) {
+			continue
+		}
+
+		delete(l.partial, h.id)
+		l.delivered[h.id] = now
+		msg, err := decodeEnvelope(pm.envelope())
+		if err != nil {
+			fmt.Printf("Multicast: Could not decode message %d: %s\n", h.id, err)
+			continue
+		}
+		l.messages <- msg
+	}
+}
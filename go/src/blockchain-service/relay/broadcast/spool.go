@@ -0,0 +1,162 @@
+package broadcast
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	"crypto/sha256"
+)
+
+// Spool file = [2 byte magic "GS"] + [1 byte version] + [envelope] + [32 byte SHA256 of everything before it]
+//
+// Files are named <unix nanoseconds>-<sequence>.gpmsg so sorting the names gives publish order. They are written to a
+// temporary name and renamed, so a reader (or a copy job feeding a data diode) never sees a partial file.
+
+const spoolVersion = 1
+const spoolSuffix = ".gpmsg"
+
+var spoolMagic = []byte("GS")
+
+//Writes every message to a directory, for sneakernet or data diode transfer
+type SpoolSender struct {
+	dir string
+	lock sync.Mutex //Must acquire before using seq
+	seq uint64
+}
+
+func NewSpoolSender(dir string) (*SpoolSender, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &SpoolSender{dir: dir}, nil
+}
+
+func (s *SpoolSender) Publish(topic string, payload []byte) error {
+	envelope, err := encodeEnvelope(topic, payload)
+	if err != nil {
+		return err
+	}
+	data := append(append(append([]byte{}, spoolMagic...), spoolVersion), envelope...)
+	sum := sha256.Sum256(data)
+	data = append(data, sum[:]...)
+
+	s.lock.Lock()
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d-%010d%s", time.Now().UnixNano(), s.seq, spoolSuffix))
+	s.seq++
+	s.lock.Unlock()
+
+	tmp := filepath.Join(s.dir, "."+filepath.Base(name)+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (s *SpoolSender) Close() {
+}
+
+func decodeSpoolFile(data []byte) (Message, error) {
+	if len(data) < 3+sha256.Size || !bytes.Equal(data[:2], spoolMagic) {
+		return Message{}, errors.New("Not a spool file\n")
+	}
+	if data[2] != spoolVersion {
+		return Message{}, errors.New(fmt.Sprintf("Unsupported spool version %d\n", data[2]))
+	}
+	body := data[:len(data)-sha256.Size]
+	sum := sha256.Sum256(body)
+	if !bytes.Equal(sum[:], data[len(body):]) {
+		return Message{}, errors.New("Spool file checksum mismatch\n")
+	}
+	return decodeEnvelope(body[3:])
+}
+
+//Reads messages from a spool directory in publish order, polling for new files
+type SpoolListener struct {
+	dir string
+	interval time.Duration
+	remove bool
+	last string // Name of the last file read, older names are skipped
+	messages chan Message
+	stop chan bool
+}
+
+//Polls dir every interval. If remove is set files are deleted once read, otherwise the directory is left untouched
+//(e.g. read only media) and only files newer than the last one read are delivered.
+func ListenSpool(dir string, interval time.Duration, remove bool) (*SpoolListener, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	l := &SpoolListener{dir, interval, remove, "", make(chan Message, 16), make(chan bool)}
+	go l.run()
+	return l, nil
+}
+
+func (l *SpoolListener) Messages() <-chan Message {
+	return l.messages
+}
+
+func (l *SpoolListener) Close() error {
+	close(l.stop)
+	return nil
+}
+
+func (l *SpoolListener) poll() {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		fmt.Printf("Spool: Could not read %s: %s\n", l.dir, err)
+		return
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), spoolSuffix) && file.Name() > l.last {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(l.dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Spool: Could not read %s: %s\n", name, err)
+			return
+		}
+		l.last = name
+		msg, err := decodeSpoolFile(data)
+		if err != nil {
+			fmt.Printf("Spool: Skipping %s: %s\n", name, err)
+		} else {
+			select {
+			case l.messages <- msg:
+			case <-l.stop:
+				return
+			}
+		}
+		if l.remove {
+			if err = os.Remove(path); err != nil {
+				fmt.Printf("Spool: Could not remove %s: %s\n", name, err)
+			}
+		}
+	}
+}
+
+func (l *SpoolListener) run() {
+	defer close(l.messages)
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for true {
+		l.poll()
+		select {
+		case <-ticker.C:
+		case <-l.stop:
+			return
+		}
+	}
+}
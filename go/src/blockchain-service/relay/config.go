@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"flag"
+	"errors"
+	"strings"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+
+	"blockchain-service/blockchain"
+)
+
+type channelConfig struct {
+	ChannelID string `yaml:"channelID"`
+	TopicPrefix string `yaml:"topicPrefix"` // Topics are <topicPrefix>-relayblocks and <topicPrefix>-bloomfilters
+}
+
+type embeddedBrokerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Addr string `yaml:"addr"`
+	LocalAddr string `yaml:"localAddr"`
+	Cert string `yaml:"cert"`
+	Key string `yaml:"key"`
+	ClientCA string `yaml:"clientCA"`
+	Users string `yaml:"users"`
+}
+
+type multicastConfig struct {
+	Addr string `yaml:"addr"` // Multicast group (or unicast address), e.g. 239.0.0.1:9999
+	Interface string `yaml:"interface"`
+	FragmentSize int `yaml:"fragmentSize"` // Bytes per frame
+	ParityGroup int `yaml:"parityGroup"` // Data fragments per parity fragment, 0 disables FEC
+	Repeat int `yaml:"repeat"` // Number of times each message is sent
+}
+
+type relayConfig struct {
+	RelayID string `yaml:"relayID"` // MQTT client ID and default topic prefix
+	Broker string `yaml:"broker"`
+	FabricConfig string `yaml:"fabricConfig"` // Fabric SDK config file
+	KeyPath string `yaml:"keyPath"` // RSA key used to sign relay blocks
+	HttpAddr string `yaml:"httpAddr"` // Address of the block request api
+	Qos uint `yaml:"qos"`
+	QueueDir string `yaml:"queueDir"`
+	RevocationEpoch uint64 `yaml:"revocationEpoch"`
+	BlockVersion uint `yaml:"blockVersion"` // Relay block header version (1 or 2)
+	BlockV2From uint64 `yaml:"blockV2From"` // With blockVersion 2, blocks before this index keep the v1 header
+	HashStrategy string `yaml:"hashStrategy"` // Strategy block merkle trees are built with, recorded in v2 headers
+	BlockLog bool `yaml:"blockLog"` // Commit v2 blocks to the log of relay block hashes
+	BlockLogFrom uint64 `yaml:"blockLogFrom"` // With blockLog, blocks before this index don't commit to the log
+	PublishBinary bool `yaml:"publishBinary"` // Also publish the binary encoding on <topicPrefix>-relayblocks-bin and <topicPrefix>-bloomfilters-bin
+	CheckpointInterval uint64 `yaml:"checkpointInterval"` // Publish a signed checkpoint on <topicPrefix>-checkpoints every N relay blocks, 0 disables
+	EmbeddedBroker embeddedBrokerConfig `yaml:"embeddedBroker"`
+	Transports []string `yaml:"transports"` // Any of mqtt, multicast, spool
+	Multicast multicastConfig `yaml:"multicast"`
+	SpoolDir string `yaml:"spoolDir"` // Directory the spool transport writes messages to
+	Channels []channelConfig `yaml:"channels"`
+}
+
+//Loads the relay config. Precedence (lowest to highest): flag defaults, config file (-config), flags set on the command line.
+func loadConfig() (*relayConfig, error) {
+	configPath := flag.String("config", "", "YAML config file, flags given on the command line override its values")
+	relayID := flag.String("relay_id", "relay1", "Relay ID, used as the MQTT client ID and default topic prefix")
+	channels := flag.String("channels", "mychannel", "Comma separated list of fabric channels to relay")
+	fabricConfig := flag.String("fabric_config", "config.1.yaml", "Fabric SDK config file")
+	keyPath := flag.String("key", "certs/key.pem", "RSA key used to sign relay blocks")
+	httpAddr := flag.String("http_addr", ":8081", "Address the block request api listens on")
+	broker := flag.String("broker", "localhost:1883", "Broker IP address, default is localhost:1883")
+	epochLength := flag.Uint64("revocation_epoch", 1000, "Number of relay blocks between purges of expired revocations, 0 disables purging")
+	embedded := flag.Bool("embedded_broker", false, "Run an MQTT broker inside the relay process instead of connecting to -broker")
+	embeddedAddr := flag.String("embedded_broker_addr", ":8883", "Address the embedded broker listens on for devices")
+	embeddedLocalAddr := flag.String("embedded_broker_local_addr", "127.0.0.1:1884", "Loopback address the relay publishes to the embedded broker on")
+	embeddedCert := flag.String("embedded_broker_cert", "", "TLS certificate of the embedded broker, plain TCP if empty")
+	embeddedKey := flag.String("embedded_broker_key", "", "TLS key of the embedded broker")
+	embeddedClientCA := flag.String("embedded_broker_client_ca", "", "CA used to authenticate device certificates, disables certificate authentication if empty")
+	embeddedUsers := flag.String("embedded_broker_users", "", "File of username:bcrypt-hash lines for username authentication")
+	qos := flag.Uint("qos", 1, "MQTT QoS used to publish relay blocks and bloom filters (0, 1 or 2)")
+	queueDir := flag.String("queue_dir", "queue", "Directory messages are persisted to until the broker acknowledges them")
+	blockVersion := flag.Uint("block_version", 1, "Relay block header version, 2 opts in to the v2 header (receivers must understand v2)")
+	blockV2From := flag.Uint64("block_v2_from", 0, "With -block_version 2, relay blocks before this index keep the v1 header (set to the current height when upgrading a relay that has broadcast blocks, 0 only for a new chain)")
+	blockLog := flag.Bool("block_log", true, "Commit v2 relay blocks to the Merkle log of relay block hashes, receivers can then skip blocks with a consistency proof")
+	blockLogFrom := flag.Uint64("block_log_from", 0, "With -block_log, relay blocks before this index don't commit to the log (set to the current height to upgrade without breaking stored chains)")
+	hashStrategy := flag.String("hash_strategy", blockchain.DefaultHashStrategy, fmt.Sprintf("Hash strategy of the block merkle trees (%s), anything but the default needs v2 headers on every block", strings.Join(blockchain.HashStrategies(), ", ")))
+	publishBinary := flag.Bool("publish_binary", true, "Also publish relay blocks and bloom filters in the binary encoding on the -bin topics")
+	checkpointInterval := flag.Uint64("checkpoint_interval", 100, "Publish a signed checkpoint every N relay blocks, devices can bootstrap from it instead of relay block 0 (0 disables)")
+	transports := flag.String("transports", "mqtt", "Comma separated list of broadcast transports: mqtt, multicast, spool")
+	multicastAddr := flag.String("multicast_addr", "239.0.0.1:9999", "UDP multicast group (or unicast address) the multicast transport sends to")
+	multicastIface := flag.String("multicast_iface", "", "Interface the multicast transport sends on")
+	multicastFragmentSize := flag.Int("multicast_fragment_size", 1200, "Bytes of message per UDP frame")
+	multicastParityGroup := flag.Int("multicast_parity_group", 4, "Data frames per parity frame, one lost frame per group can be rebuilt (0 disables)")
+	multicastRepeat := flag.Int("multicast_repeat", 1, "Number of times each message is sent")
+	spoolDir := flag.String("spool_dir", "spool", "Directory the spool transport writes messages to")
+	flag.Parse()
+
+	config := &relayConfig{
+		RelayID:            *relayID,
+		Broker:             *broker,
+		FabricConfig:       *fabricConfig,
+		KeyPath:            *keyPath,
+		HttpAddr:           *httpAddr,
+		Qos:                *qos,
+		QueueDir:           *queueDir,
+		RevocationEpoch:    *epochLength,
+		BlockVersion:       *blockVersion,
+		BlockV2From:        *blockV2From,
+		HashStrategy:       *hashStrategy,
+		BlockLog:           *blockLog,
+		BlockLogFrom:       *blockLogFrom,
+		PublishBinary:      *publishBinary,
+		CheckpointInterval: *checkpointInterval,
+		EmbeddedBroker:     embeddedBrokerConfig{*embedded, *embeddedAddr, *embeddedLocalAddr, *embeddedCert, *embeddedKey, *embeddedClientCA, *embeddedUsers},
+		Transports:         splitList(*transports),
+		Multicast:          multicastConfig{*multicastAddr, *multicastIface, *multicastFragmentSize, *multicastParityGroup, *multicastRepeat},
+		SpoolDir:           *spoolDir,
+	}
+	channelsFromFile := false
+	if *configPath != "" {
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %s", *configPath, err)
+		}
+		channelsFromFile = len(config.Channels) != 0
+	}
+
+	//Flags given on the command line take precedence over the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "relay_id": config.RelayID = *relayID
+		case "channels": channelsFromFile = false
+		case "fabric_config": config.FabricConfig = *fabricConfig
+		case "key": config.KeyPath = *keyPath
+		case "http_addr": config.HttpAddr = *httpAddr
+		case "broker": config.Broker = *broker
+		case "revocation_epoch": config.RevocationEpoch = *epochLength
+		case "embedded_broker": config.EmbeddedBroker.Enabled = *embedded
+		case "embedded_broker_addr": config.EmbeddedBroker.Addr = *embeddedAddr
+		case "embedded_broker_local_addr": config.EmbeddedBroker.LocalAddr = *embeddedLocalAddr
+		case "embedded_broker_cert": config.EmbeddedBroker.Cert = *embeddedCert
+		case "embedded_broker_key": config.EmbeddedBroker.Key = *embeddedKey
+		case "embedded_broker_client_ca": config.EmbeddedBroker.ClientCA = *embeddedClientCA
+		case "embedded_broker_users": config.EmbeddedBroker.Users = *embeddedUsers
+		case "qos": config.Qos = *qos
+		case "queue_dir": config.QueueDir = *queueDir
+		case "block_version": config.BlockVersion = *blockVersion
+		case "block_v2_from": config.BlockV2From = *blockV2From
+		case "hash_strategy": config.HashStrategy = *hashStrategy
+		case "block_log": config.BlockLog = *blockLog
+		case "block_log_from": config.BlockLogFrom = *blockLogFrom
+		case "publish_binary": config.PublishBinary = *publishBinary
+		case "checkpoint_interval": config.CheckpointInterval = *checkpointInterval
+		case "transports": config.Transports = splitList(*transports)
+		case "multicast_addr": config.Multicast.Addr = *multicastAddr
+		case "multicast_iface": config.Multicast.Interface = *multicastIface
+		case "multicast_fragment_size": config.Multicast.FragmentSize = *multicastFragmentSize
+		case "multicast_parity_group": config.Multicast.ParityGroup = *multicastParityGroup
+		case "multicast_repeat": config.Multicast.Repeat = *multicastRepeat
+		case "spool_dir": config.SpoolDir = *spoolDir
+		}
+	})
+	if !channelsFromFile {
+		config.Channels = nil
+		for _, channelID := range splitList(*channels) {
+			config.Channels = append(config.Channels, channelConfig{channelID, ""})
+		}
+	}
+
+	if config.BlockVersion != 1 && config.BlockVersion != 2 {
+		return nil, errors.New(fmt.Sprintf("Unsupported relay block version %d\n", config.BlockVersion))
+	}
+	if _, err := blockchain.NewHasher(config.HashStrategy); err != nil {
+		return nil, err
+	}
+	//v1 headers can't record the hash strategy, receivers assume the default for them
+	if blockchain.RecordedHashStrategy(config.HashStrategy) != "" && (config.BlockVersion != 2 || config.BlockV2From != 0) {
+		return nil, errors.New(fmt.Sprintf("Hash strategy %s needs -block_version 2 and -block_v2_from 0\n", config.HashStrategy))
+	}
+	if len(config.Transports) == 0 {
+		return nil, errors.New("No transports configured\n")
+	}
+	for _, transport := range config.Transports {
+		if transport != "mqtt" && transport != "multicast" && transport != "spool" {
+			return nil, errors.New(fmt.Sprintf("Unknown transport %s\n", transport))
+		}
+	}
+
+	if config.RelayID == "" {
+		return nil, errors.New("Relay ID must not be empty\n")
+	}
+	if len(config.Channels) == 0 {
+		return nil, errors.New("No channels configured\n")
+	}
+	seen := make(map[string]bool)
+	seenTopics := make(map[string]bool)
+	for i := range config.Channels {
+		channel := &config.Channels[i]
+		if seen[channel.ChannelID] {
+			return nil, errors.New(fmt.Sprintf("Channel %s configured more than once\n", channel.ChannelID))
+		}
+		seen[channel.ChannelID] = true
+		//A single channel keeps the original topic names (relay1-relayblocks), several channels get one namespace each
+		if channel.TopicPrefix == "" {
+			if len(config.Channels) == 1 {
+				channel.TopicPrefix = config.RelayID
+			} else {
+				channel.TopicPrefix = fmt.Sprintf("%s-%s", config.RelayID, channel.ChannelID)
+			}
+		}
+		if seenTopics[channel.TopicPrefix] {
+			return nil, errors.New(fmt.Sprintf("Topic prefix %s used by more than one channel\n", channel.TopicPrefix))
+		}
+		seenTopics[channel.TopicPrefix] = true
+	}
+	return config, nil
+}
+
+//Splits a comma separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
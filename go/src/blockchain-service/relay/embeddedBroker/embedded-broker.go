@@ -0,0 +1,193 @@
+package embeddedBroker
+
+import (
+	"os"
+	"fmt"
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+
+	"golang.org/x/crypto/bcrypt"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const externalListenerID = "external"
+const localListenerID = "local"
+
+type Config struct {
+	Address string // Address of the listener devices connect to (e.g. :8883)
+	LocalAddress string // Loopback address of the listener the relay's own publisher connects to
+	CertFile string // Broker TLS certificate, if empty the external listener is plain TCP
+	KeyFile string // Broker TLS key
+	ClientCAFile string // If set, clients presenting a certificate signed by this CA are authenticated by certificate
+	UsersFile string // File of "username:bcrypt hash" lines, clients without a certificate must match an entry
+}
+
+//MQTT broker run inside the relay process. Devices may subscribe to any topic, only the relay (connected through the
+//loopback listener with a per-process password) may publish.
+type Broker struct {
+	server *mqtt.Server
+	LocalUser string
+	LocalPassword string
+}
+
+type authHook struct {
+	mqtt.HookBase
+	users map[string][]byte
+	certAuth bool
+	localUser string
+	localPassword []byte
+}
+
+func (h *authHook) ID() string {
+	return "gpchain-auth"
+}
+
+func (h *authHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{mqtt.OnConnectAuthenticate, mqtt.OnACLCheck}, []byte{b})
+}
+
+func (h *authHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	//The relay's own publisher
+	if cl.Net.Listener == localListenerID {
+		return string(pk.Connect.Username) == h.localUser && subtle.ConstantTimeCompare(pk.Connect.Password, h.localPassword) == 1
+	}
+
+	//Certificate authentication, the chain was already verified against the client CA during the TLS handshake
+	if tlsConn, ok := cl.Net.Conn.(*tls.Conn); ok && h.certAuth {
+		if len(tlsConn.ConnectionState().PeerCertificates) != 0 {
+			return true
+		}
+	}
+
+	//Username authentication
+	hash, ok := h.users[string(pk.Connect.Username)]
+	if !ok {
+		fmt.Printf("Embedded Broker: Rejected unknown user %s\n", pk.Connect.Username)
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, pk.Connect.Password) == nil
+}
+
+func (h *authHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if !write {
+		return true
+	}
+	return cl.Net.Listener == localListenerID && string(cl.Properties.Username) == h.localUser
+}
+
+//Reads a users file. Each non empty line not starting with # is of the form username:bcrypt hash
+func loadUsers(path string) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	if path == "" {
+		return users, nil
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.Index(line, ":")
+		if sep <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid line in users file: %s\n", line))
+		}
+		users[line[:sep]] = []byte(line[sep+1:])
+	}
+	return users, scanner.Err()
+}
+
+func tlsConfig(cfg Config) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		if cfg.ClientCAFile != "" {
+			return nil, errors.New("Client certificate authentication requires a broker certificate\n")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile != "" {
+		caData, err := ioutil.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("Could not parse client CA file\n")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func Start(cfg Config) (*Broker, error) {
+	//Only the relay may use the local listener
+	host, _, err := net.SplitHostPort(cfg.LocalAddress)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New(fmt.Sprintf("Local listener must be bound to a loopback address, got %s\n", cfg.LocalAddress))
+	}
+
+	users, err := loadUsers(cfg.UsersFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load users file: %s", err)
+	}
+
+	externalTLS, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordBytes := make([]byte, 32)
+	if _, err = rand.Read(passwordBytes); err != nil {
+		return nil, err
+	}
+	broker := &Broker{mqtt.New(nil), "relay", hex.EncodeToString(passwordBytes)}
+
+	hook := &authHook{users: users, certAuth: cfg.ClientCAFile != "", localUser: broker.LocalUser, localPassword: []byte(broker.LocalPassword)}
+	if err = broker.server.AddHook(hook, nil); err != nil {
+		return nil, err
+	}
+
+	external := listeners.NewTCP(listeners.Config{ID: externalListenerID, Address: cfg.Address, TLSConfig: externalTLS})
+	if err = broker.server.AddListener(external); err != nil {
+		return nil, err
+	}
+	local := listeners.NewTCP(listeners.Config{ID: localListenerID, Address: cfg.LocalAddress})
+	if err = broker.server.AddListener(local); err != nil {
+		return nil, err
+	}
+
+	if err = broker.server.Serve(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Embedded Broker Listening on %s (TLS: %t, Cert Auth: %t, Users: %d)\n", cfg.Address, externalTLS != nil, hook.certAuth, len(users))
+	return broker, nil
+}
+
+func (b *Broker) Close() {
+	b.server.Close()
+}
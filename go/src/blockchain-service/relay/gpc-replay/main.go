@@ -0,0 +1,332 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"sync"
+	"bytes"
+	"strings"
+	"net/url"
+	"io/ioutil"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+
+	"blockchain-service/blockchain"
+	"blockchain-service/relay/relayTypes"
+	"blockchain-service/relay/relayWire"
+)
+
+// Replays the ledger to rebuild the relay and permission marshal state and reports where the current stores differ. Every
+// fabric block is read with FabricSetup.GetBlock and turned into its relay block with relayTypes.ProcessBlock, rebuilding the
+// relay chain and its revocation set. The relay's checkpoint file and bloom filter file are compared with the rebuilt chain.
+// With -pm_db the entries of a PM's data store are re-derived from the ledger (status, publication block, broadcast
+// validation info and the PCN upgrade made on publication) up to the last block the PM processed, -fix writes the derived
+// entries back. Use relay-audit to compare the broadcast relay blocks themselves.
+//
+// Exit Code 0: Stores match the ledger
+// Exit Code 1: Differences found
+// Exit Code 2: Error occurred
+
+//n : number of items in bloom filter, p : probability of false positives
+const (
+	n = uint(1000)
+	p = 0.000001
+)
+
+//Differences between the stores and the replayed ledger
+type report struct {
+	RelayBlocks uint64 `json:"relayBlocks"` // Relay blocks replayed
+	HeadHash []byte `json:"headHash"` // Hash of the last relay block
+	Revocations int `json:"revocations"` // Revoked and suspended certs in the rebuilt revocation set
+	RevocationDigest []byte `json:"revocationDigest"`
+	Relay []string `json:"relay"`
+	PMEntries int `json:"pmEntries,omitempty"`
+	PMLastBlock uint64 `json:"pmLastBlock,omitempty"`
+	PM []pmDiff `json:"pm,omitempty"`
+}
+
+type pmDiff struct {
+	User string `json:"user"`
+	Key string `json:"key"`
+	Status string `json:"status"`
+	Diffs []string `json:"diffs"`
+	Fixed bool `json:"fixed"`
+}
+
+//Batch roots published in fabric block n, in the order they are leaves of its block tree
+func blockRoots(n uint64, sdkLock *sync.Mutex, fSetup *blockchain.FabricSetup) ([][]byte, error) {
+	sdkLock.Lock()
+	block, err := fSetup.GetBlock(n)
+	sdkLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var roots [][]byte
+	for index, valid := range block.Metadata.Metadata[2] {
+		if valid != 0 {
+			continue
+		}
+		for _, write := range block.Transactions[index].Writes {
+			rootString, err := url.QueryUnescape(write.KvRwSet.Writes[0].Key)
+			if err != nil {
+				return nil, err
+			}
+			roots = append(roots, []byte(rootString))
+		}
+	}
+	return roots, nil
+}
+
+func loadJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+//Compares the relay's checkpoint with the checkpoint of the rebuilt chain at the same index
+func diffCheckpoint(got, want *relayWire.Checkpoint) []string {
+	var fields []string
+	if got.RelayID != want.RelayID {
+		fields = append(fields, fmt.Sprintf("relay ID (stored %s, ledger %s)", got.RelayID, want.RelayID))
+	}
+	if !bytes.Equal(got.BlockHash, want.BlockHash) {
+		fields = append(fields, "block hash")
+	}
+	if !bytes.Equal(got.RevocationDigest, want.RevocationDigest) {
+		fields = append(fields, "revocation digest")
+	}
+	if !bytes.Equal(got.TrustAnchorRoot, want.TrustAnchorRoot) {
+		fields = append(fields, "trust anchor root")
+	}
+	if got.Epoch != want.Epoch {
+		fields = append(fields, fmt.Sprintf("epoch (stored %d, ledger %d)", got.Epoch, want.Epoch))
+	}
+	return fields
+}
+
+func main() {
+	fabricConfig := flag.String("fabric_config", "config.1.yaml", "Fabric SDK config file")
+	channelID := flag.String("channel", "mychannel", "Fabric channel to replay")
+	relayID := flag.String("relay_id", "relay1", "Relay ID the relay was run with")
+	blockVersion := flag.Uint("block_version", 1, "Relay block header version the relay was run with")
+	blockV2From := flag.Uint64("block_v2_from", 0, "-block_v2_from the relay was run with")
+	epochLength := flag.Uint64("revocation_epoch", 1000, "-revocation_epoch the relay was run with")
+	hashStrategy := flag.String("hash_strategy", blockchain.DefaultHashStrategy, "-hash_strategy the relay was run with (the PM's -block_hash_strategy)")
+	blockLog := flag.Bool("block_log", true, "-block_log the relay was run with")
+	blockLogFrom := flag.Uint64("block_log_from", 0, "-block_log_from the relay was run with")
+	checkpointFile := flag.String("checkpoint", "", "Relay checkpoint file (checkpoint.json) to compare")
+	bloomFile := flag.String("bloom", "", "Relay bloom filter file (bloomFilter.txt) to compare")
+	pmDB := flag.String("pm_db", "", "Data store of a permission marshal to re-derive (data/data.db), the PM must be stopped")
+	fix := flag.Bool("fix", false, "Write the re-derived entries back to -pm_db")
+	reportFile := flag.String("report", "", "Also write the report as JSON to this file")
+	to := flag.Int64("to", -1, "Last relay block to replay, defaults to the current ledger height")
+	flag.Parse()
+
+	var checkpoint *relayWire.CheckpointMessage
+	if *checkpointFile != "" {
+		checkpoint = &relayWire.CheckpointMessage{}
+		if err := loadJSON(*checkpointFile, checkpoint); err != nil {
+			fmt.Printf("Could not load checkpoint: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	var bloom *relayWire.BloomMessage
+	if *bloomFile != "" {
+		bloom = &relayWire.BloomMessage{}
+		if err := loadJSON(*bloomFile, bloom); err != nil {
+			fmt.Printf("Could not load bloom filter: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if *fix && *pmDB == "" {
+		fmt.Printf("-fix needs -pm_db\n")
+		os.Exit(2)
+	}
+	//Entries the PM published after -to would look unpublished
+	if *pmDB != "" && *to >= 0 {
+		fmt.Printf("-pm_db needs the whole ledger, don't set -to\n")
+		os.Exit(2)
+	}
+
+	var db *bolt.DB
+	var entries []*pmEntry
+	var pmLastBlock uint64
+	var facts *ledgerFacts
+	if *pmDB != "" {
+		var err error
+		if db, err = openPM(*pmDB, *fix); err != nil {
+			fmt.Printf("Could not open PM data store %s: %s\n", *pmDB, err)
+			os.Exit(2)
+		}
+		defer db.Close()
+		if entries, pmLastBlock, err = loadPM(db); err != nil {
+			fmt.Printf("Could not load PM data store: %s\n", err)
+			os.Exit(2)
+		}
+		facts = newLedgerFacts(entries, *hashStrategy)
+	}
+
+	var sdkLock sync.Mutex
+	fSetup := blockchain.FabricSetup{
+		OrgAdmin:        "Admin",
+		OrgName:         "Org1",
+		ConfigFile:      *fabricConfig,
+		ChannelID:       *channelID,
+		UserName:        "Admin",
+	}
+	if err := fSetup.Initialize(); err != nil {
+		fmt.Printf("Unable to initialize the Fabric SDK: %v\n", err)
+		os.Exit(2)
+	}
+	defer fSetup.Close()
+	if err := fSetup.InitializeLedgerClient(); err != nil {
+		fmt.Printf("Unable to initialize ledger client: %v\n", err)
+		os.Exit(2)
+	}
+
+	bci, err := fSetup.GetLedgerInfo()
+	if err != nil {
+		fmt.Printf("Could not get ledger height: %s\n", err)
+		os.Exit(2)
+	}
+	if bci.BCI.GetHeight() < 1+blockchain.BlockOffset {
+		fmt.Printf("Ledger has no relay blocks yet\n")
+		os.Exit(0)
+	}
+	stop := bci.BCI.GetHeight() - 1 - blockchain.BlockOffset
+	if *to >= 0 && uint64(*to) < stop {
+		stop = uint64(*to)
+	}
+
+	header := relayTypes.HeaderConfig{*relayID, uint8(*blockVersion), *blockV2From, *hashStrategy, *blockLog, *blockLogFrom}
+	logHasher, err := header.Hasher()
+	if err != nil {
+		fmt.Printf("%s", err)
+		os.Exit(2)
+	}
+	revocations := relayTypes.NewRevocationSet(n, p, *epochLength)
+	builder := relayTypes.NewChainBuilder(header, revocations, logHasher)
+	r := &report{Relay: []string{}}
+	checkedCheckpoint, checkedBloom := false, false
+	for builder.Index() <= stop {
+		index := builder.Index()
+		fabricBlock := index + blockchain.BlockOffset
+		processed, err := relayTypes.ProcessBlock(fabricBlock, &sdkLock, &fSetup, logHasher)
+		if err != nil {
+			fmt.Printf("Relay block %d: could not process fabric block %d: %s\n", index, fabricBlock, err)
+			os.Exit(2)
+		}
+		block, filterBytes, err := builder.Next(processed)
+		if err != nil {
+			fmt.Printf("Relay block %d: ledger inconsistent: %s\n", index, err)
+			os.Exit(1)
+		}
+		r.HeadHash = block.Hash()
+
+		if facts != nil && index != 0 {
+			roots, err := blockRoots(fabricBlock, &sdkLock, &fSetup)
+			if err != nil {
+				fmt.Printf("Could not read fabric block %d: %s\n", fabricBlock, err)
+				os.Exit(2)
+			}
+			facts.addBlock(fabricBlock, roots, processed.Tree, *processed.Revocations)
+		}
+
+		if checkpoint != nil && checkpoint.Checkpoint.Index == index {
+			checkedCheckpoint = true
+			want, err := builder.Checkpoint()
+			if err != nil {
+				fmt.Printf("%s", err)
+				os.Exit(2)
+			}
+			if fields := diffCheckpoint(&checkpoint.Checkpoint, want); len(fields) != 0 {
+				r.Relay = append(r.Relay, fmt.Sprintf("checkpoint at relay block %d differs: %s", index, strings.Join(fields, ", ")))
+			}
+		}
+		if bloom != nil && bloom.Index == index {
+			checkedBloom = true
+			if !bytes.Equal(bloom.Filter, filterBytes) || bloom.Epoch != block.Epoch {
+				r.Relay = append(r.Relay, fmt.Sprintf("bloom filter of relay block %d differs (stored epoch %d, ledger %d)", index, bloom.Epoch, block.Epoch))
+			}
+		}
+	}
+	r.RelayBlocks = builder.Index()
+	r.Revocations = revocations.Len()
+	r.RevocationDigest = revocations.Digest()
+	if checkpoint != nil && !checkedCheckpoint {
+		r.Relay = append(r.Relay, fmt.Sprintf("checkpoint is at relay block %d, beyond the ledger (replayed to %d)", checkpoint.Checkpoint.Index, stop))
+	}
+	if bloom != nil && !checkedBloom {
+		r.Relay = append(r.Relay, fmt.Sprintf("bloom filter is for relay block %d, beyond the ledger (replayed to %d)", bloom.Index, stop))
+	}
+
+	if facts != nil {
+		r.PMEntries = len(entries)
+		r.PMLastBlock = pmLastBlock
+		last := pmLastBlock
+		if ledgerLast := stop + blockchain.BlockOffset; last > ledgerLast {
+			r.PM = append(r.PM, pmDiff{Diffs: []string{fmt.Sprintf("PM processed up to block %d, the ledger ends at %d", pmLastBlock, ledgerLast)}})
+			last = ledgerLast
+		}
+		var fixed []*pmEntry
+		for _, e := range entries {
+			derived, diffs := facts.derive(e, last)
+			if len(diffs) == 0 {
+				continue
+			}
+			d := pmDiff{e.user, fmt.Sprintf("%x", e.key), statusName(e.value.Status), diffs, false}
+			derivedStr, _ := json.Marshal(derived)
+			storedStr, _ := json.Marshal(e.value)
+			if *fix && !bytes.Equal(derivedStr, storedStr) {
+				fixed = append(fixed, &pmEntry{e.user, e.key, derived})
+				d.Fixed = true
+			}
+			r.PM = append(r.PM, d)
+		}
+		if len(fixed) != 0 {
+			if err = fixPM(db, fixed); err != nil {
+				fmt.Printf("Could not write back PM entries: %s\n", err)
+				os.Exit(2)
+			}
+		}
+	}
+
+	fmt.Printf("Replayed relay blocks 0 to %d: head %x, %d revocations, revocation digest %x\n", r.RelayBlocks-1, r.HeadHash, r.Revocations, r.RevocationDigest)
+	for _, diff := range r.Relay {
+		fmt.Printf("Relay: %s\n", diff)
+	}
+	if facts != nil {
+		fmt.Printf("PM: %d entries, last processed block %d\n", r.PMEntries, r.PMLastBlock)
+		for _, d := range r.PM {
+			if d.User == "" {
+				fmt.Printf("PM: %s\n", strings.Join(d.Diffs, ", "))
+				continue
+			}
+			fixedStr := ""
+			if d.Fixed {
+				fixedStr = " (fixed)"
+			}
+			fmt.Printf("PM: %s/%s (%s): %s%s\n", d.User, d.Key, d.Status, strings.Join(d.Diffs, ", "), fixedStr)
+		}
+	}
+	if *reportFile != "" {
+		reportStr, err := json.MarshalIndent(r, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*reportFile, reportStr, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Could not write report: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if len(r.Relay) != 0 || len(r.PM) != 0 {
+		os.Exit(1)
+	}
+}
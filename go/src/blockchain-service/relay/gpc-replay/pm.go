@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"encoding/json"
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/trillian/merkle"
+
+	"blockchain-service/blockchain"
+	"blockchain-service/permission-marshal/pmTypes"
+)
+
+//Entry of the PM's data store, stored under the requestor and under the CA
+type pmEntry struct {
+	user string
+	key []byte
+	value pmTypes.DBValue
+}
+
+//Where a batch root was published: fabric block, position in the block tree and the proof the PM derives from it
+type placement struct {
+	fabricBlock uint64
+	broadcast blockchain.ValidationInfo
+}
+
+//Revocation statement published on the ledger
+type ledgerStatement struct {
+	fabricBlock uint64
+	action string
+}
+
+//Ledger facts the PM's entries are derived from, collected while replaying
+type ledgerFacts struct {
+	roots map[string]bool // Batch roots referenced by the PM's entries
+	placements map[string]*placement // Batch root -> first block it was published in
+	statements map[string][]ledgerStatement // PM key of a cert -> revocation statements about it, in ledger order
+	blockStrategy string
+}
+
+func newLedgerFacts(entries []*pmEntry, blockStrategy string) *ledgerFacts {
+	facts := &ledgerFacts{make(map[string]bool), make(map[string]*placement), make(map[string][]ledgerStatement), blockchain.RecordedHashStrategy(blockStrategy)}
+	for _, e := range entries {
+		if len(e.value.PubValidationInfo.MerkleRoot) != 0 {
+			facts.roots[string(e.value.PubValidationInfo.MerkleRoot)] = true
+		}
+	}
+	return facts
+}
+
+//Records the batch roots of fabric block n (leaves of its block tree, in order) and its revocation statements
+func (lf *ledgerFacts) addBlock(n uint64, roots [][]byte, tree *merkle.InMemoryMerkleTree, statements []*blockchain.RevocationStatement) {
+	for index, root := range roots {
+		if !lf.roots[string(root)] || lf.placements[string(root)] != nil {
+			continue
+		}
+		var hashes [][]byte
+		for _, elem := range tree.PathToCurrentRoot(int64(index) + 1) {
+			hashes = append(hashes, elem.Value.Hash())
+		}
+		info := blockchain.ValidationInfo{int64(index), int64(n - blockchain.BlockOffset), tree.LeafCount(), tree.CurrentRoot().Hash(), hashes, lf.blockStrategy}
+		lf.placements[string(root)] = &placement{n, info}
+	}
+	for _, statement := range statements {
+		//The PM has no entry for certs without an RSA key and skips their statements too
+		key, err := pmTypes.EntryKey(statement.Cert.PublicKey)
+		if err != nil {
+			fmt.Printf("Skipping statement about %s: %s", statement.Cert.Subject.CommonName, err)
+			continue
+		}
+		lf.statements[string(key)] = append(lf.statements[string(key)], ledgerStatement{n, statement.Action})
+	}
+}
+
+//Status the ledger gives the cert with PM key key up to fabric block lastBlock, with the same transitions the relay's
+//revocation set makes: REVOKED_PUBLISHED, SUSPENDED_PUBLISHED or 0 if no statement is in effect. Also returns the block of
+//the last statement that changed it (0 if there is none).
+func (lf *ledgerFacts) statementStatus(key []byte, lastBlock uint64) (pmTypes.Workflow, uint64) {
+	var status pmTypes.Workflow
+	var changed uint64
+	for _, statement := range lf.statements[string(key)] {
+		if statement.fabricBlock > lastBlock {
+			break
+		}
+		switch {
+		case status == pmTypes.REVOKED_PUBLISHED:
+		case statement.action == blockchain.StatementRevoke:
+			status, changed = pmTypes.REVOKED_PUBLISHED, statement.fabricBlock
+		case statement.action == blockchain.StatementSuspend && status == 0:
+			status, changed = pmTypes.SUSPENDED_PUBLISHED, statement.fabricBlock
+		case statement.action == blockchain.StatementReinstate && status == pmTypes.SUSPENDED_PUBLISHED:
+			status, changed = 0, statement.fabricBlock
+		}
+	}
+	return status, changed
+}
+
+//Opens the PM's data store, read-only unless fix is set. The PM must not be running.
+func openPM(path string, fix bool) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: !fix})
+}
+
+//Loads every entry and the last fabric block the PM processed
+func loadPM(db *bolt.DB) ([]*pmEntry, uint64, error) {
+	var entries []*pmEntry
+	var lastBlock uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte("META")); meta != nil {
+			if last := meta.Get([]byte("lastBlock")); last != nil {
+				if len(last) != 8 {
+					return errors.New("Invalid last processed block in data store\n")
+				}
+				lastBlock = binary.BigEndian.Uint64(last)
+			}
+		}
+		root := tx.Bucket([]byte("USERS"))
+		if root == nil {
+			return errors.New("Data store has no USERS bucket\n")
+		}
+		outter := root.Cursor()
+		for user, _ := outter.First(); user != nil; user, _ = outter.Next() {
+			bucket := root.Bucket(user)
+			if bucket == nil {
+				continue
+			}
+			inner := bucket.Cursor()
+			for k, v := inner.First(); k != nil; k, v = inner.Next() {
+				e := &pmEntry{user: string(user), key: append([]byte{}, k...)}
+				if err := json.Unmarshal(v, &e.value); err != nil {
+					return errors.New(fmt.Sprintf("Entry %x of %s: %s\n", k, user, err))
+				}
+				entries = append(entries, e)
+			}
+		}
+		return nil
+	})
+	return entries, lastBlock, err
+}
+
+func sameInfo(a, b *blockchain.ValidationInfo) bool {
+	if a.LeafIndex != b.LeafIndex || a.BlockIndex != b.BlockIndex || a.NumLeaves != b.NumLeaves || !bytes.Equal(a.MerkleRoot, b.MerkleRoot) || a.HashStrategy != b.HashStrategy || len(a.Proof) != len(b.Proof) {
+		return false
+	}
+	for i := range a.Proof {
+		if !bytes.Equal(a.Proof[i], b.Proof[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//Block level proof the PM adds to the PCN on publication: the path with the block root appended
+func pcnBlockProof(p *placement) *blockchain.ValidationInfo {
+	hashes := append(append([][]byte{}, p.broadcast.Proof...), p.broadcast.MerkleRoot)
+	return &blockchain.ValidationInfo{p.broadcast.LeafIndex, p.broadcast.BlockIndex, p.broadcast.NumLeaves, nil, hashes, p.broadcast.HashStrategy}
+}
+
+//Re-derives the PM's view of an entry from the ledger up to fabric block lastBlock. Returns the derived value and the
+//differences to the stored one, problems that can't be derived from the ledger are reported but leave the value unchanged.
+func (lf *ledgerFacts) derive(e *pmEntry, lastBlock uint64) (pmTypes.DBValue, []string) {
+	stored := &e.value
+	derived := e.value
+	var diffs []string
+
+	if len(stored.PubValidationInfo.MerkleRoot) != 0 && stored.Status != pmTypes.CREATED {
+		if err := stored.PubValidationInfo.VerifyLeaf(stored.Data); err != nil {
+			diffs = append(diffs, fmt.Sprintf("batch proof does not verify: %s", strings.TrimSpace(err.Error())))
+		}
+	}
+
+	status, n := lf.statementStatus(e.key, lastBlock)
+	switch {
+	case status != 0:
+		//A revocation or reinstatement of a suspended cert may still be waiting for publication, and the PM does not
+		//suspend certs it revoked through a cascade
+		pending := status == pmTypes.SUSPENDED_PUBLISHED && stored.Status & (pmTypes.REVOKED|pmTypes.REINSTATED|pmTypes.REVOKED_CASCADED|pmTypes.SUSPENDED_REVOKED) != 0
+		if stored.Status != status && !pending {
+			diffs = append(diffs, fmt.Sprintf("status %s, %s in block %d", statusName(stored.Status), statusName(status), n))
+			derived.Status = status
+		}
+		return derived, diffs
+	case stored.Status == pmTypes.REVOKED_PUBLISHED || (stored.Status & (pmTypes.SUSPENDED_PUBLISHED|pmTypes.REINSTATED|pmTypes.SUSPENDED_REVOKED) != 0 && n == 0):
+		diffs = append(diffs, fmt.Sprintf("status %s, no such statement on the ledger", statusName(stored.Status)))
+		return derived, diffs
+	case stored.Status & (pmTypes.SUSPENDED_PUBLISHED|pmTypes.REINSTATED) != 0:
+		diffs = append(diffs, fmt.Sprintf("status %s, reinstated in block %d", statusName(stored.Status), n))
+		derived.Status = pmTypes.PUBLISHED
+	}
+
+	p := lf.placements[string(stored.PubValidationInfo.MerkleRoot)]
+	if p == nil || p.fabricBlock > lastBlock {
+		if derived.Status == pmTypes.PUBLISHED && stored.Origin == "" {
+			diffs = append(diffs, "status published, batch root not on the ledger")
+		}
+		return derived, diffs
+	}
+	if stored.Status == pmTypes.SIGNED {
+		diffs = append(diffs, fmt.Sprintf("status signed, batch root published in block %d", p.fabricBlock))
+		derived.Status = pmTypes.PUBLISHED
+	}
+	if derived.Status & (pmTypes.SIGNED|pmTypes.PUBLISHED) == 0 {
+		//Revocation or suspension requested locally (or cascaded from an ancestor), the publication fields stay as they were
+		return derived, diffs
+	}
+	if stored.PubValidationInfo.BlockIndex != int64(p.fabricBlock) {
+		if stored.Status == pmTypes.PUBLISHED {
+			diffs = append(diffs, fmt.Sprintf("publication block %d, ledger %d", stored.PubValidationInfo.BlockIndex, p.fabricBlock))
+		}
+		derived.PubValidationInfo.BlockIndex = int64(p.fabricBlock)
+	}
+	if !sameInfo(&stored.BroadcastValidationInfo, &p.broadcast) {
+		if stored.Status == pmTypes.PUBLISHED {
+			diffs = append(diffs, "broadcast validation info")
+		}
+		derived.BroadcastValidationInfo = p.broadcast
+	}
+
+	//Mirrored entries carry the PCN of their origin, foreign revocations none
+	if stored.PCN == nil {
+		return derived, diffs
+	}
+	pcn, err := blockchain.ParsePCN(stored.PCN)
+	if err == nil && pcn.ProofList == nil {
+		err = errors.New("no proof list")
+	}
+	if err != nil {
+		diffs = append(diffs, fmt.Sprintf("PCN does not parse: %s", strings.TrimSpace(err.Error())))
+		return derived, diffs
+	}
+	blockProof := pcnBlockProof(p)
+	switch len(pcn.ProofList.ProofList) {
+	case len(pcn.Certs) - 1:
+		if stored.Status == pmTypes.PUBLISHED {
+			diffs = append(diffs, "PCN not upgraded with the block proof")
+		}
+		if err = pcn.AddMerkleProof(blockProof); err != nil {
+			diffs = append(diffs, fmt.Sprintf("PCN can't be upgraded: %s", strings.TrimSpace(err.Error())))
+			return derived, diffs
+		}
+		batchProof := derived.PubValidationInfo
+		batchProof.BlockIndex = int64(p.fabricBlock - blockchain.BlockOffset)
+		pcn.AddBatchProof(&batchProof)
+	case len(pcn.Certs):
+		if sameInfo(&pcn.ProofList.ProofList[0], blockProof) {
+			return derived, diffs
+		}
+		diffs = append(diffs, "PCN block proof")
+		pcn.ProofList.ProofList[0] = *blockProof
+	default:
+		diffs = append(diffs, fmt.Sprintf("PCN has %d proofs for %d certificates", len(pcn.ProofList.ProofList), len(pcn.Certs)))
+		return derived, diffs
+	}
+	if derived.PCN, err = pcn.Encode(); err != nil {
+		diffs = append(diffs, fmt.Sprintf("PCN can't be encoded: %s", strings.TrimSpace(err.Error())))
+		derived.PCN = stored.PCN
+	}
+	return derived, diffs
+}
+
+func statusName(status pmTypes.Workflow) string {
+	switch status {
+	case pmTypes.CREATED: return "created"
+	case pmTypes.SIGNED: return "signed"
+	case pmTypes.PUBLISHED: return "published"
+	case pmTypes.REVOKED_PENDING: return "revoked_pending"
+	case pmTypes.REVOKED: return "revoked"
+	case pmTypes.REVOKED_PUBLISHED: return "revoked_published"
+	case pmTypes.SUSPENDED: return "suspended"
+	case pmTypes.SUSPENDED_PUBLISHED: return "suspended_published"
+	case pmTypes.REINSTATED: return "reinstated"
+	case pmTypes.REVOKED_CASCADED: return "revoked_cascaded"
+	case pmTypes.SUSPENDED_REVOKED: return "suspended_revoked"
+	}
+	return fmt.Sprintf("%d", status)
+}
+
+//Writes the derived values of the given entries back to the PM's data store
+func fixPM(db *bolt.DB, fixed []*pmEntry) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("USERS"))
+		for _, e := range fixed {
+			valueString, err := json.Marshal(e.value)
+			if err != nil {
+				return err
+			}
+			if err = root.Bucket([]byte(e.user)).Put(e.key, valueString); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -2,9 +2,8 @@ package main
 
 import (
 	"fmt"
-	"flag"
 	"sync"
-	"bytes"
+	"encoding"
 	"errors"
 	"strings"
 	"os"
@@ -15,41 +14,86 @@ import (
 //	"encoding/pem"
 	"encoding/base64"
 	"crypto"
-	"crypto/sha256"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/rand"
-	
-	"github.com/willf/bloom"
+
+	"github.com/google/trillian/merkle/hashers"
 	
 	"blockchain-service/blockchain"
 	
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-
 	"blockchain-service/relay/blockRequestApi"
+	"blockchain-service/relay/embeddedBroker"
+	"blockchain-service/relay/relayPublisher"
+	"blockchain-service/relay/broadcast"
 	"blockchain-service/relay/relayTypes"
 )
 
-var fSetup blockchain.FabricSetup //Must acquire sdkLock before using to be thread safe
-var sdkLock, relayLock, updatingLock sync.Mutex
-
 //n : number of items in bloom filter, p : probability of false positives, m : number of bits in the filter, k : number of hash functions
 var n = uint(1000)
 var p = 0.000001
 
-//////////////////////////////////Must acquire relayLock before using to be thread safe//////////////////////////////////
-var revocationList map[[32]byte]bool
-var filter = bloom.NewWithEstimates(n, p)
 var rsaKey *rsa.PrivateKey
-var publisher mqtt.Client
-var previousBlockHash = []byte("")
-var relayBlockIndex = uint64(0)
-/////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-
-var updating = false
+var publisher broadcast.Fanout // Every configured transport
+var mqttPublisher *relayPublisher.Publisher
+var localBroker *embeddedBroker.Broker
+
+//Relay chain for a single fabric channel
+type relayChain struct {
+	channelID string
+	blockTopic string
+	bloomTopic string
+	checkpointTopic string
+	header relayTypes.HeaderConfig
+	binaryTopics bool // Also publish the binary encoding on blockTopic-bin and bloomTopic-bin
+	bloomFile string
+	checkpointFile string
+	checkpointInterval uint64 // Publish a checkpoint every checkpointInterval relay blocks, 0 disables checkpoints
+	fSetup blockchain.FabricSetup //Must acquire sdkLock before using to be thread safe
+	sdkLock sync.Mutex
+	sequencer *sequencer
+	listener *blockchain.BlockListener
+	builder *relayTypes.ChainBuilder // Bloom filter, previous block hash and index of the next relay block. Only used by the sequencer.
+	stopBlockListener chan bool
+	blockListenerStopped chan bool
+}
 
-const bloomTopic = "relay1-bloomfilters"
-const blockTopic = "relay1-relayblocks"
+func newRelayChain(config *relayConfig, channel channelConfig, hasher hashers.LogHasher) *relayChain {
+	rc := &relayChain{
+		channelID:            channel.ChannelID,
+		blockTopic:           channel.TopicPrefix + "-relayblocks",
+		bloomTopic:           channel.TopicPrefix + "-bloomfilters",
+		checkpointTopic:      channel.TopicPrefix + "-checkpoints",
+		header:               relayTypes.HeaderConfig{config.RelayID, uint8(config.BlockVersion), config.BlockV2From, config.HashStrategy, config.BlockLog, config.BlockLogFrom},
+		binaryTopics:         config.PublishBinary,
+		bloomFile:            "bloomFilter.txt",
+		checkpointFile:       "checkpoint.json",
+		checkpointInterval:   config.CheckpointInterval,
+		stopBlockListener:    make(chan bool),
+		blockListenerStopped: make(chan bool),
+	}
+	if len(config.Channels) > 1 {
+		rc.bloomFile = fmt.Sprintf("bloomFilter-%s.txt", channel.ChannelID)
+		rc.checkpointFile = fmt.Sprintf("checkpoint-%s.json", channel.ChannelID)
+	}
+	rc.builder = relayTypes.NewChainBuilder(rc.header, relayTypes.NewRevocationSet(n, p, config.RevocationEpoch), hasher)
+	rc.sequencer = newSequencer(fabricLedger{&rc.sdkLock, &rc.fSetup, hasher}, rc.publishBlock, blockchain.BlockOffset, rc.stopBlockListener)
+	//The relay rebuilds its chain on every start, so the listener resumes from the sequencer (the init block after a restart)
+	rc.listener = blockchain.NewBlockListener(&rc.sdkLock, &rc.fSetup, rc.handleEvent, rc.sequencer.Next)
+	rc.fSetup = blockchain.FabricSetup{
+		OrgAdmin:        "Admin", 
+		OrgName:         "Org1", 
+		ConfigFile:      config.FabricConfig,
+		
+		// Channel parameters 
+		ChannelID:       channel.ChannelID,
+		ChannelConfig:   "../../../org1/basic-network/config/channel.tx",
+	
+		// User parameters
+		UserName:        "Admin",
+	}
+	return rc
+}
 
 //Implements crypto.SignerOpt interface (needed to sign realyBlock)
 type signerOpt struct {
@@ -90,276 +134,129 @@ func pemToKey(private []byte) (*rsa.PrivateKey, error) {
 	return key, nil
 }
 
-//Updates internal state of the relay (bloom filter, previousBlockHash)
-func update(n uint64, done chan bool) error {
-	relayLock.Lock()
-	myView := relayBlockIndex
-	relayLock.Unlock()
-
-	// If (n-blockchain.BlockOffset) != myView recurse (i.e. starting from the last known block, update internal state)
-	if (n-blockchain.BlockOffset) != myView {
-		update(n-1, done)
+//Queues the binary encoding of msg on the parallel binary topic. The JSON message is authoritative, so failures are only logged.
+func (rc *relayChain) publishBinary(topic string, msg encoding.BinaryMarshaler, jsonSize int) {
+	if !rc.binaryTopics {
+		return
 	}
-
-	// time.Sleep(10 * time.Second)
-	
-	fmt.Printf("Updater: Processing Fabric Block: %d, Relay Block: %d\n", n, n-blockchain.BlockOffset)
-
-	//Fetch block, build merkle tree for block, get list of revocations
-	blockMerkleTree, revocations, err := relayTypes.ProcessBlock(n, &sdkLock, &fSetup)
+	data, err := msg.MarshalBinary()
 	if err != nil {
-		fmt.Printf("Could not update relay state: %s\n", err)
-		return err
+		fmt.Printf("Could not encode binary message: %s\n", err)
+		return
 	}
+	if err = publisher.Publish(topic+"-bin", data); err != nil {
+		fmt.Printf("Could not publish binary message: %s\n", err)
+		return
+	}
+	fmt.Printf("Queued for topic: %s-bin (%d bytes, JSON %d bytes)\n", topic, len(data), jsonSize)
+}
 
-	relayLock.Lock()
-	
-	//Add Revocation to Bloom Filter
-	if revocations != nil {
-		for _,revocation := range *revocations {
-			sum := sha256.Sum256(revocation)
-			filter.Add(sum[:])
-		}
+//Signs and publishes the checkpoint of relay block relayBlkMsg, which must be the last block built
+func (rc *relayChain) publishCheckpoint(relayBlkMsg relayTypes.RelayBlockMessage) {
+	checkpoint, err := rc.builder.Checkpoint()
+	if err != nil {
+		fmt.Printf("Could not create checkpoint: %s\n", err)
+		return
 	}
-	blockRoot := blockMerkleTree.CurrentRoot().Hash()
-	var relayBlk relayTypes.RelayBlock
-	fmt.Printf("%d %d\n", n, blockchain.BlockOffset)
-	if n != blockchain.BlockOffset {	
-		//Convert Bloom Filter to []byte
-		filterBuffer := bytes.NewBuffer([]byte{})
-		_, err = filter.WriteTo(filterBuffer)
-		if err != nil {
-			fmt.Printf("Error: Could not write bloom filter: %v\n", err)
-			relayLock.Unlock()
-			return err
-		}
-		filterBufferHash := sha256.Sum256(filterBuffer.Bytes())
-	
-		//Create Relay Block Message
-		relayBlk = relayTypes.RelayBlock{relayBlockIndex, blockRoot, filterBufferHash[:], previousBlockHash}
-	} else {
-		relayBlk = relayTypes.RelayBlock{relayBlockIndex, blockRoot, []byte(""), []byte("")}
+	signedCheckpoint, err := rsaKey.Sign(rand.Reader, checkpoint.Hash(), signerOpt{crypto.SHA256})
+	if err != nil {
+		fmt.Printf("Could not sign checkpoint: %s\n", err)
+		return
+	}
+	checkpointMsg := relayTypes.CheckpointMessage{*checkpoint, relayBlkMsg, [][]byte{signedCheckpoint}, checkpoint.Hash()}
+	checkpointMsgStr, err := json.Marshal(checkpointMsg)
+	if err != nil {
+		fmt.Printf("Could not marshal checkpoint message: %s\n", err)
+		return
 	}
 
-	//fmt.Printf("Relay Block: %+v\n", relayBlk)
-
-	//Update Global Vars 
-	previousBlockHash = relayBlk.Hash()
-	relayBlockIndex++
-
-	relayLock.Unlock()
-	done <- true
-	return nil
+	fmt.Printf("Publishing Checkpoint at Relay Block: %d\n", checkpoint.Index)
+	if err = publisher.Publish(rc.checkpointTopic, checkpointMsgStr); err != nil {
+		fmt.Printf("Could not publish checkpoint message: %s\n", err)
+	} else {
+		fmt.Printf("Queued for topic: %s\n", rc.checkpointTopic)
+	}
+	rc.publishBinary(rc.checkpointTopic, &checkpointMsg, len(checkpointMsgStr))
+	if err = ioutil.WriteFile(rc.checkpointFile, checkpointMsgStr, 0644); err != nil {
+		fmt.Printf("Could not write checkpoint file: %s\n", err)
+	}
 }
 
-//Handle block event for fabric block n
-func handleEvent(n uint64) {
-	var myView uint64
-	done := make(chan bool)
-	
-	//Get current view of the relay (determiend by relayBlockIndex)
-	relayLock.Lock()
-	myView = relayBlockIndex
-	relayLock.Unlock()
-
-	fmt.Printf("HandleEvent Request for Fabric Block %d\n", n)
-
-	if n > blockchain.BlockOffset {
-		//Check if the updater needs to run, but isn't
-		updatingLock.Lock()
-		fmt.Printf("Handler %d: Have %d, Want: %d, Updating: %t\n", n, myView, n-blockchain.BlockOffset, updating)
-		if (n-blockchain.BlockOffset) != myView && !updating {
-		//Run the updater
-		fmt.Printf("Starting Updater\n")
-		updating = true
-		go update(n-1, done)
-		
-		go func() {
-			// fmt.Printf("Wait for %d to be %d\n", myView, (n-blockchain.BlockOffset))
-			end := ((n-blockchain.BlockOffset) - myView)
-			for i := uint64(0); i < end; i++ {
-				<-done
-			}
-			updatingLock.Lock()
-			updating = false;
-			fmt.Printf("Updating Done\n")
-			updatingLock.Unlock()
-		}()
-		}
-		updatingLock.Unlock()
-
-		relayLock.Lock()
-		myView = relayBlockIndex
-		relayLock.Unlock()
-
-		//Wait for update to complete (if needed)
-		for (n-blockchain.BlockOffset) != myView {
-			// fmt.Printf("Handler %d: Have %d, Want: %d\n", n, myView, n-blockchain.BlockOffset)
-			time.Sleep(10 * time.Millisecond)
-
-			relayLock.Lock()
-			myView = relayBlockIndex
-			relayLock.Unlock()
-		}
-
-		//Fetch block, build merkle tree for block, get list of revocations
-		blockMerkleTree, revocations, err := relayTypes.ProcessBlock(n, &sdkLock, &fSetup)
-		if err != nil {
-			fmt.Printf("Could not update relay state: %s\n", err)
-			return
-		}
-
-		relayLock.Lock()
-		//Add Revocation to Bloom Filter
-		if revocations != nil {
-			for _,revocation := range *revocations {
-				sum := sha256.Sum256(revocation)
-				revocationList[sum] = true
-				filter.Add(sum[:])
-			}
-		}
-		blockRoot := blockMerkleTree.CurrentRoot().Hash()
-
-		//Convert Bloom Filter to []byte
-		filterBuffer := bytes.NewBuffer([]byte{})
-		_, err = filter.WriteTo(filterBuffer)
-		if err != nil {
-			fmt.Printf("Error: Could not write bloom filter: %v\n", err)
-			relayLock.Unlock()
-			return
-		}
-		filterBufferHash := sha256.Sum256(filterBuffer.Bytes())
-
-		//Create Relay Block Message
-		relayBlk := relayTypes.RelayBlock{relayBlockIndex, blockRoot, filterBufferHash[:], previousBlockHash}
-
-		// RSA sig of block
-		signedRelayBlock, err := rsaKey.Sign(rand.Reader, relayBlk.Hash(), signerOpt{crypto.SHA256}) 
-		if err != nil {
-			fmt.Printf("Could not sign relay block: %s\n", err)
-			relayLock.Unlock()
-			return
-		}
+//Builds, signs and publishes the relay block for a processed fabric block (and its bloom filter and checkpoint). Only
+//called from the sequencer. Returns an error if the relay block could not be built, once built the block is sealed and
+//failures to publish are only logged (receivers backfill it from the block request api).
+func (rc *relayChain) publishBlock(processed *relayTypes.ProcessedBlock) error {
+	//Create Relay Block (adds revocations to the bloom filter, purging expired revocations at epoch boundaries)
+	relayBlk, filterBytes, err := rc.builder.Next(processed)
+	if err != nil {
+		return err
+	}
 
-		// Create Realy Block Message
-		relayBlkMsg := relayTypes.RelayBlockMessage{relayBlk, [][]byte{signedRelayBlock}, relayBlk.Hash()}
-		relayBlkMsgStr, err := json.Marshal(relayBlkMsg)
-		if err != nil {
-			fmt.Printf("Could not marshal relay block message: %s\n", err)
-			relayLock.Unlock()
-			return
-		}
+	// RSA sig of block
+	signedRelayBlock, err := rsaKey.Sign(rand.Reader, relayBlk.Hash(), signerOpt{crypto.SHA256}) 
+	if err != nil {
+		fmt.Printf("Could not sign relay block: %s\n", err)
+		return nil
+	}
 
-		//fmt.Printf("Relay Block: %+v\n", relayBlk)
-		fmt.Printf("Relay Block String: %s\n", relayBlkMsgStr)
+	// Create Realy Block Message
+	relayBlkMsg := relayTypes.RelayBlockMessage{*relayBlk, [][]byte{signedRelayBlock}, relayBlk.Hash()}
+	relayBlkMsgStr, err := json.Marshal(relayBlkMsg)
+	if err != nil {
+		fmt.Printf("Could not marshal relay block message: %s\n", err)
+		return nil
+	}
 
-		//fmt.Printf("Current Block Hash: %+v\n", relayBlk.Hash())
-		//fmt.Printf("Previous Block Hash: %+v\n", previousBlockHash)
+	//fmt.Printf("Relay Block: %+v\n", relayBlk)
+	fmt.Printf("Relay Block String: %s\n", relayBlkMsgStr)
+
+	fmt.Printf("Publishing Fabric Block: %d, Relay Block: %d\n", processed.Number, relayBlk.Index)
+	//Queue Relay Block Message. Once queued it is retried until the broker acknowledges it, if it can't be queued receivers
+	//backfill it from the block request api.
+	if err = publisher.Publish(rc.blockTopic, relayBlkMsgStr); err != nil {
+		fmt.Printf("Could not publish relay block message: %s\n", err)
+		return nil
+	}
+	fmt.Printf("Queued for topic: %s\n", rc.blockTopic)
+	rc.publishBinary(rc.blockTopic, &relayBlkMsg, len(relayBlkMsgStr))
 
+	//The init block has no bloom filter
+	if filterBytes != nil {
 		//Create Bloom Message
-		bloomMsg := relayTypes.BloomMessage{relayBlockIndex, filterBuffer.Bytes()}
+		bloomMsg := relayTypes.BloomMessage{relayBlk.Index, filterBytes, relayBlk.Epoch}
 		bloomMsgStr, err := json.Marshal(bloomMsg)
 		if err != nil {
 			fmt.Printf("Could not marshal bloom message: %s\n", err)
-			relayLock.Unlock()
-			return
+			return nil
 		} 
-		
-		fmt.Printf("Publishing Fabric Block: %d, Relay Block: %d\n", n, relayBlockIndex)
-		//Publish Relay Block Message
-		if token := publisher.Publish(blockTopic, byte(0), true, string(relayBlkMsgStr)); token.Error() != nil {
-			fmt.Printf("Could not publish relay block message: %s\n", err)
-			relayLock.Unlock()
-			return
-		}
-		fmt.Printf("Published to topic: %s\n", blockTopic)
 
-		//Publish Bloom Message
-		if token := publisher.Publish(bloomTopic, byte(0), true, string(bloomMsgStr)); token.Error() != nil {
+		//Queue Bloom Message. The relay block is already sealed at this point, a missing bloom message is superseded by the next one.
+		if err = publisher.Publish(rc.bloomTopic, bloomMsgStr); err != nil {
 			fmt.Printf("Could not publish bloom message: %s\n", err)
-			relayLock.Unlock()
-			return
+		} else {
+			fmt.Printf("Queued for topic: %s\n", rc.bloomTopic)
 		}
-		if err = ioutil.WriteFile("bloomFilter.txt", bloomMsgStr, 0644); err != nil {
+		rc.publishBinary(rc.bloomTopic, &bloomMsg, len(bloomMsgStr))
+		if err = ioutil.WriteFile(rc.bloomFile, bloomMsgStr, 0644); err != nil {
 			fmt.Printf("Could not write bloom filter file: %s\n", err)
-			return
 		}
-		fmt.Printf("Published to topic: %s\n", bloomTopic)
-
-
-		//Update Global Vars 
-		previousBlockHash = relayBlk.Hash()
-		relayBlockIndex++
-		relayLock.Unlock()
-	} else {
-		if n == 0{
-			fmt.Printf("Gensis Block\n")
-		} else if n > 0 {
-			fmt.Printf("Init Block\n")
-
-			blockMerkleTree, _, err := relayTypes.ProcessBlock(n, &sdkLock, &fSetup)
-			
-			relayLock.Lock()
-			blockRoot := blockMerkleTree.CurrentRoot().Hash()
-
-			//Create Relay Block Message
-			relayBlk := relayTypes.RelayBlock{relayBlockIndex, blockRoot, []byte(""), previousBlockHash}
-
-			// RSA sig of block
-			signedRelayBlock, err := rsaKey.Sign(rand.Reader, relayBlk.Hash(), signerOpt{crypto.SHA256}) 
-			if err != nil {
-				fmt.Printf("Could not sign relay block: %s\n", err)
-				relayLock.Unlock()
-				return
-			}
-
-			// Create Realy Block Message
-			relayBlkMsg := relayTypes.RelayBlockMessage{relayBlk, [][]byte{signedRelayBlock}, relayBlk.Hash()}
-			relayBlkMsgStr, err := json.Marshal(relayBlkMsg)
-			if err != nil {
-				fmt.Printf("Could not marshal relay block message: %s\n", err)
-				relayLock.Unlock()
-				return
-			}
-
-			fmt.Printf("Relay Block: %+v\n", relayBlk)
-
-			fmt.Printf("Current Block Hash: %+v\n", relayBlk.Hash())
-			fmt.Printf("Previous Block Hash: %+v\n", previousBlockHash)
-
-			fmt.Printf("Publishing Fabric Block: %d, Relay Block: %d\n", n, relayBlockIndex)
-			//Publish Relay Block Message
-			if token := publisher.Publish(blockTopic, byte(0), true, string(relayBlkMsgStr)); token.Error() != nil {
-				fmt.Printf("Could not publish relay block message: %s\n", err)
-				relayLock.Unlock()
-				return
-			}
-			fmt.Printf("Published to topic: %s\n", blockTopic)
+	}
 
-			//Update Global Vars 
-			previousBlockHash = relayBlk.Hash()
-			relayBlockIndex++
-			relayLock.Unlock()
-		}
+	if rc.checkpointInterval != 0 && relayBlk.Index != 0 && relayBlk.Index%rc.checkpointInterval == 0 {
+		rc.publishCheckpoint(relayBlkMsg)
 	}
+	return nil
 }
 
-func initSKD() error {
-	fSetup = blockchain.FabricSetup{
-		OrgAdmin:        "Admin", 
-		OrgName:         "Org1", 
-		ConfigFile:      "config.1.yaml",
-		
-		// Channel parameters 
-		ChannelID:       "mychannel",
-		ChannelConfig:   "../../../org1/basic-network/config/channel.tx",
-	
-		// User parameters
-		UserName:        "Admin",
-	}
+//Handle block event for fabric block n. Events are handed to the sequencer, which applies blocks in order.
+func (rc *relayChain) handleEvent(n uint64) {
+	fmt.Printf("HandleEvent Request for Channel %s, Fabric Block %d\n", rc.channelID, n)
+	rc.sequencer.Notify(n)
+}
 
-	fmt.Printf("Initializing Fabric SDK...\n")
-	err := fSetup.Initialize()
+func (rc *relayChain) initSKD() error {
+	fmt.Printf("Initializing Fabric SDK for Channel %s...\n", rc.channelID)
+	err := rc.fSetup.Initialize()
 	if err != nil{
 		fmt.Printf("...Unable to initialize the Fabric SDK: %v\n", err)
 		return err
@@ -367,14 +264,14 @@ func initSKD() error {
 	fmt.Printf("...Fabric SDK Initialized\n")
 	fmt.Printf("Initializing Ledger Client...\n")
 	
-	if err = fSetup.InitializeLedgerClient(); err != nil {
+	if err = rc.fSetup.InitializeLedgerClient(); err != nil {
 		fmt.Printf("...Unable to initialize ledger client: \nError: %v\n", err)
 		return err
 	}
 	fmt.Printf("...Ledger Client Initialized\n")
 	fmt.Printf("Initializing Event Client...\n")
 	
-	if err = fSetup.InitializeEventClient(); err != nil {
+	if err = rc.fSetup.InitializeEventClient(); err != nil {
 		fmt.Printf("...Unable to initialize event client: \nError: %v\n", err)
 		return err
 	}
@@ -382,35 +279,37 @@ func initSKD() error {
 	return nil
 }
 
-func initPublisher(brokerIP string) error {
+func initPublisher(clientID, brokerIP, username, password string, qos byte, queueDir string) error {
+	var err error
 	fmt.Printf("Initializing MQTT Publisher...\n")
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker("tcp://"+brokerIP)
-	opts.SetClientID("relay1")
-	opts.SetCleanSession(false)
-	publisher = mqtt.NewClient(opts)
-
-	token := publisher.Connect()
-	return token.Error()
+	mqttPublisher, err = relayPublisher.New(relayPublisher.Options{
+		Broker:        "tcp://"+brokerIP,
+		ClientID:      clientID,
+		Username:      username,
+		Password:      password,
+		QoS:           qos,
+		QueueDir:      queueDir,
+		Timeout:       10 * time.Second,
+		RetryInterval: 5 * time.Second,
+	})
+	return err
 }
 
 func main() {
-	broker := flag.String("broker", "localhost:1883", "Broker IP address, default is localhost:1883")
-	flag.Parse()
-	fmt.Printf("Starting Relay with broker: %s\n", *broker)
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("Could not load config: %s\n", err)
+		return
+	}
+	fmt.Printf("Starting Relay %s with broker: %s\n", config.RelayID, config.Broker)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
-	stopBlockListener := make(chan bool)
-	blockListenerStopped := make(chan bool)
 	stopBlockRequestApi := make(chan bool)
 	blockRequestApiStopped := make(chan bool)
 
-	//Init revocationList
-	revocationList = make(map[[32]byte]bool)
-
 	//Get file descriptor for key.pem
-	keyFile, err := os.Open("certs/key.pem")
+	keyFile, err := os.Open(config.KeyPath)
 	if err != nil {
 		fmt.Printf("Could not open rsa key pair: %s\n", err)
 		return
@@ -429,55 +328,112 @@ func main() {
 		return
 	}
 
-	if err := initSKD(); err != nil {
-		fmt.Printf("Could not init fabric sdk: %s\n", err)
+	hasher, err := blockchain.NewHasher(config.HashStrategy)
+	if err != nil {
+		fmt.Printf("%s", err)
 		return
 	}
-	defer func() {
-		sdkLock.Lock()
-		fSetup.Close()
-		sdkLock.Unlock()
-	}()
 
-	if err := initPublisher(*broker); err != nil {
-		fmt.Printf("Could not init mqtt publisher client: %s\n", err)
-		return
+	//One relay chain (and fabric sdk) per channel
+	var chains []*relayChain
+	for _, channel := range config.Channels {
+		rc := newRelayChain(config, channel, hasher)
+		if err := rc.initSKD(); err != nil {
+			fmt.Printf("Could not init fabric sdk: %s\n", err)
+			return
+		}
+		defer func() {
+			fmt.Printf("Closing Fabric SDK for Channel %s...\n", rc.channelID)
+			rc.sdkLock.Lock()
+			rc.fSetup.Close()
+			rc.sdkLock.Unlock()
+			fmt.Printf("...Fabric SDK Closed\n")
+		}()
+		fmt.Printf("Channel %s: Publishing to %s and %s\n", rc.channelID, rc.blockTopic, rc.bloomTopic)
+		chains = append(chains, rc)
+	}
+
+	broker := config.Broker
+	var brokerUser, brokerPassword string
+	if config.EmbeddedBroker.Enabled {
+		fmt.Printf("Starting Embedded MQTT Broker...\n")
+		eb := config.EmbeddedBroker
+		localBroker, err = embeddedBroker.Start(embeddedBroker.Config{eb.Addr, eb.LocalAddr, eb.Cert, eb.Key, eb.ClientCA, eb.Users})
+		if err != nil {
+			fmt.Printf("Could not start embedded broker: %s\n", err)
+			return
+		}
+		defer func() {
+			fmt.Printf("Stopping Embedded MQTT Broker...\n")
+			localBroker.Close()
+			fmt.Printf("...Embedded MQTT Broker Stopped\n")
+		}()
+		fmt.Printf("...Embedded MQTT Broker Started\n\n")
+		broker = eb.LocalAddr
+		brokerUser, brokerPassword = localBroker.LocalUser, localBroker.LocalPassword
+	}
+
+	for _, transport := range config.Transports {
+		switch transport {
+		case "mqtt":
+			if err := initPublisher(config.RelayID, broker, brokerUser, brokerPassword, byte(config.Qos), config.QueueDir); err != nil {
+				fmt.Printf("Could not init mqtt publisher client: %s\n", err)
+				return
+			}
+			publisher = append(publisher, mqttPublisher)
+			fmt.Printf("...MQTT Publisher Initialized\n\n")
+		case "multicast":
+			mc := config.Multicast
+			sender, err := broadcast.NewMulticastSender(broadcast.MulticastOptions{Addr: mc.Addr, Interface: mc.Interface, FragmentSize: mc.FragmentSize, GroupSize: mc.ParityGroup, Repeat: mc.Repeat})
+			if err != nil {
+				fmt.Printf("Could not init multicast sender: %s\n", err)
+				return
+			}
+			publisher = append(publisher, sender)
+			fmt.Printf("Multicast Sender Initialized (%s)\n\n", mc.Addr)
+		case "spool":
+			sender, err := broadcast.NewSpoolSender(config.SpoolDir)
+			if err != nil {
+				fmt.Printf("Could not init spool sender: %s\n", err)
+				return
+			}
+			publisher = append(publisher, sender)
+			fmt.Printf("Spool Sender Initialized (%s)\n\n", config.SpoolDir)
+		}
 	}
 	defer func() {
-		relayLock.Lock()
-		publisher.Disconnect(uint(250))
-		relayLock.Unlock()
+		fmt.Printf("Closing Transports...\n")
+		if mqttPublisher != nil {
+			fmt.Printf("%d Unacknowledged MQTT Messages Left in Queue\n", mqttPublisher.Pending())
+		}
+		publisher.Close()
+		fmt.Printf("...Transports Closed\n")
 	}()
-	fmt.Printf("...MQTT Publisher Initialized\n\n")
 
-	//Run Cleanup Code on Ctrl + c
+	//Stop every channel on Ctrl + c. main waits for them and cleans up through its deferred calls, so shutdown has a single path.
 	go func(){
 		<-c
 		fmt.Printf("\nShutting Down...\n")
-
-		fmt.Printf("Signaling Block Listener Routine to Stop...\n")
-		close(stopBlockListener)
-		<-blockListenerStopped
-		fmt.Printf("...Block Listener Routine Stopped\n")
-		
-		fmt.Printf("Closing Fabric SDK...\n")
-		sdkLock.Lock()
-		fSetup.Close()
-		sdkLock.Unlock()
-		fmt.Printf("...Fabric SDK Closed\n")
-		
-		fmt.Printf("Disconnecting MQTT Publisher...\n")
-		relayLock.Lock()
-		publisher.Disconnect(uint(250))
-		relayLock.Unlock()
-		fmt.Printf("...MQTT Publisher Disconnected\n")
-		
-		fmt.Printf("...Shutdown Complete\n")
-		os.Exit(1)
+		for _, rc := range chains {
+			fmt.Printf("Signaling Block Listener Routine for Channel %s to Stop...\n", rc.channelID)
+			close(rc.stopBlockListener)
+		}
 	}()
 
-	go blockRequestApi.StartBlockRequestListener(&sdkLock, &fSetup, *rsaKey, stopBlockRequestApi, blockRequestApiStopped)
+	var apiChannels []blockRequestApi.Channel
+	for _, rc := range chains {
+		apiChannels = append(apiChannels, blockRequestApi.Channel{rc.channelID, &rc.sdkLock, &rc.fSetup, rc.listener})
+	}
+	go blockRequestApi.StartBlockRequestListener(config.HttpAddr, apiChannels, *rsaKey, config.RevocationEpoch, chains[0].header, config.CheckpointInterval, stopBlockRequestApi, blockRequestApiStopped)
 
-	//On block publish, handleEvent is run in a new thread
-	blockchain.BlockListener(&sdkLock, &fSetup, handleEvent, stopBlockListener, blockListenerStopped)
+	//Block events are delivered in order to handleEvent, which hands them to the channel's sequencer
+	for _, rc := range chains {
+		go rc.sequencer.Run()
+		go rc.listener.Run(rc.stopBlockListener, rc.blockListenerStopped)
+	}
+	for _, rc := range chains {
+		<-rc.blockListenerStopped
+		<-rc.sequencer.stopped
+		fmt.Printf("...Block Listener Routine for Channel %s Stopped\n", rc.channelID)
+	}
 }
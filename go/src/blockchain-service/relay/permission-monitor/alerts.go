@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+
+	"blockchain-service/relay/relayPublisher"
+)
+
+//Rules an alert can be raised by
+const (
+	rulePolicyDenied = "policy_denied" // The policy evaluator denied the cert's chain
+	ruleUnchained = "unchained" // The cert does not chain to a trust anchor of the ledger's init block
+	ruleRootGrant = "root_grant" // The cert grants an attribute at most rootDepth levels below Root
+	ruleOffHours = "off_hours" // The cert was issued outside business hours
+	ruleIssuerVolume = "issuer_volume" // The issuer published more certs within the volume window than allowed
+	ruleUnavailable = "batch_unavailable" // No source could provide the leaves of a published batch root
+	ruleInvalidLeaf = "invalid_leaf" // A published leaf is not a certificate
+)
+
+type alert struct {
+	Rule string `json:"rule"`
+	Channel string `json:"channel"`
+	Block uint64 `json:"block"` // Fabric block the batch root was published in
+	Root string `json:"root"` // Batch root (hex)
+	Source string `json:"source,omitempty"` // Where the batch was fetched from
+	Subject string `json:"subject,omitempty"`
+	Issuer string `json:"issuer,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	Detail string `json:"detail"`
+	Time time.Time `json:"time"`
+}
+
+//Delivers alerts to every configured webhook (HTTP POST of the JSON alert) and MQTT topic. Webhooks are retried a few
+//times, MQTT alerts are queued on disk until the broker acknowledges them.
+type alerter struct {
+	webhooks []string
+	client *http.Client
+	retries int
+	publisher *relayPublisher.Publisher
+	topic string
+}
+
+func newAlerter(config *monitorConfig) (*alerter, error) {
+	a := &alerter{webhooks: config.Webhooks, client: &http.Client{Timeout: 10 * time.Second}, retries: 3, topic: config.Mqtt.Topic}
+	if config.Mqtt.Broker != "" {
+		if config.Mqtt.Topic == "" {
+			return nil, errors.New("MQTT alerts need a topic\n")
+		}
+		var err error
+		fmt.Printf("Initializing MQTT Publisher...\n")
+		a.publisher, err = relayPublisher.New(relayPublisher.Options{
+			Broker:        "tcp://"+config.Mqtt.Broker,
+			ClientID:      config.Mqtt.ClientID,
+			Username:      config.Mqtt.Username,
+			Password:      config.Mqtt.Password,
+			QoS:           1,
+			QueueDir:      config.Mqtt.QueueDir,
+			Timeout:       10 * time.Second,
+			RetryInterval: 5 * time.Second,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *alerter) send(al *alert) {
+	al.Time = time.Now()
+	fmt.Printf("ALERT %s: block %d, root %s: %s\n", al.Rule, al.Block, al.Root, al.Detail)
+	alertStr, err := json.Marshal(al)
+	if err != nil {
+		fmt.Printf("Could not marshal alert: %s\n", err)
+		return
+	}
+	for _, url := range a.webhooks {
+		if err = a.post(url, alertStr); err != nil {
+			fmt.Printf("Could not deliver alert to %s: %s\n", url, err)
+		}
+	}
+	if a.publisher != nil {
+		if err = a.publisher.Publish(a.topic, alertStr); err != nil {
+			fmt.Printf("Could not queue alert for MQTT: %s\n", err)
+		}
+	}
+}
+
+func (a *alerter) post(url string, body []byte) error {
+	var err error
+	for attempt := 0; attempt < a.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		var resp *http.Response
+		resp, err = a.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		err = errors.New(fmt.Sprintf("Webhook returned %s: %s\n", resp.Status, respBody))
+	}
+	return err
+}
+
+func (a *alerter) Close() {
+	if a.publisher != nil {
+		fmt.Printf("%d Unacknowledged MQTT Alerts Left in Queue\n", a.publisher.Pending())
+		a.publisher.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"flag"
+	"time"
+	"errors"
+	"strings"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+//Permission marshal whose federation feed batches are fetched from
+type pmConfig struct {
+	Name string `yaml:"name"`
+	Url string `yaml:"url"` // e.g. https://pm1:8080
+	Cert string `yaml:"cert"` // Certificate the PM signs its feed with (its webserver cert), also trusted for TLS
+}
+
+type mqttConfig struct {
+	Broker string `yaml:"broker"` // Alerts are published to this broker if set
+	ClientID string `yaml:"clientID"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Topic string `yaml:"topic"`
+	QueueDir string `yaml:"queueDir"`
+}
+
+type monitorConfig struct {
+	FabricConfig string `yaml:"fabricConfig"` // Fabric SDK config file
+	ChannelID string `yaml:"channelID"`
+	DataDir string `yaml:"dataDir"` // Cursor, volume counters and the certs seen so far
+	AvailabilityUrl string `yaml:"availabilityUrl"` // Availability store batches are fetched from first, disabled if empty
+	PMs []pmConfig `yaml:"pms"` // PMs batches are fetched from if the availability store does not have them
+	FetchTimeout int `yaml:"fetchTimeout"` // Seconds to wait for a batch to become available before alerting
+	PolicyEval string `yaml:"policyEval"` // Policy evaluator binary
+	PolicyBook string `yaml:"policyBook"`
+	RootDepth int `yaml:"rootDepth"` // Alert on grants at most this many levels below Root, -1 disables
+	BusinessHours businessHours `yaml:"businessHours"` // Alert on certs issued outside these hours, disabled without days
+	VolumeWindow string `yaml:"volumeWindow"` // e.g. 1h
+	VolumeLimit int `yaml:"volumeLimit"` // Alert when an issuer publishes more certs within the window, 0 disables
+	Webhooks []string `yaml:"webhooks"` // URLs alerts are POSTed to
+	Mqtt mqttConfig `yaml:"mqtt"`
+	volumeWindow time.Duration
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+//Loads the monitor config. Precedence (lowest to highest): flag defaults, config file (-config), flags set on the command line.
+func loadConfig() (*monitorConfig, error) {
+	configPath := flag.String("config", "", "YAML config file, flags given on the command line override its values")
+	fabricConfig := flag.String("fabric_config", "config.1.yaml", "Fabric SDK config file")
+	channelID := flag.String("channel", "mychannel", "Fabric channel the permission marshals publish to")
+	dataDir := flag.String("data_dir", "monitor-data", "Directory the monitor keeps its state in")
+	availabilityUrl := flag.String("availability_url", "", "Availability store batches are fetched from, e.g. http://localhost:8090")
+	fetchTimeout := flag.Int("fetch_timeout", 300, "Seconds to wait for a published batch to become available before alerting")
+	policyEval := flag.String("policy_eval", "./policy-eval/policy-eval", "Policy evaluator binary")
+	policyBook := flag.String("pb", "./policy-eval/pb.txt", "Policy book")
+	rootDepth := flag.Int("root_depth", 1, "Alert on new grants at most this many levels below Root, -1 disables")
+	volumeWindow := flag.String("volume_window", "1h", "Window issuer volume is counted over")
+	volumeLimit := flag.Int("volume_limit", 50, "Alert when an issuer publishes more certs within -volume_window, 0 disables")
+	webhooks := flag.String("webhooks", "", "Comma separated list of URLs alerts are POSTed to")
+	mqttBroker := flag.String("mqtt_broker", "", "MQTT broker alerts are published to, e.g. localhost:1883 (disabled if empty)")
+	mqttTopic := flag.String("mqtt_topic", "gpchain-alerts", "MQTT topic alerts are published on")
+	flag.Parse()
+
+	config := &monitorConfig{
+		FabricConfig:    *fabricConfig,
+		ChannelID:       *channelID,
+		DataDir:         *dataDir,
+		AvailabilityUrl: *availabilityUrl,
+		FetchTimeout:    *fetchTimeout,
+		PolicyEval:      *policyEval,
+		PolicyBook:      *policyBook,
+		RootDepth:       *rootDepth,
+		VolumeWindow:    *volumeWindow,
+		VolumeLimit:     *volumeLimit,
+		Webhooks:        splitList(*webhooks),
+		Mqtt:            mqttConfig{Broker: *mqttBroker, ClientID: "permission-monitor", Topic: *mqttTopic, QueueDir: "monitor-queue"},
+	}
+	if *configPath != "" {
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %s", *configPath, err)
+		}
+	}
+
+	//Flags given on the command line take precedence over the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "fabric_config": config.FabricConfig = *fabricConfig
+		case "channel": config.ChannelID = *channelID
+		case "data_dir": config.DataDir = *dataDir
+		case "availability_url": config.AvailabilityUrl = *availabilityUrl
+		case "fetch_timeout": config.FetchTimeout = *fetchTimeout
+		case "policy_eval": config.PolicyEval = *policyEval
+		case "pb": config.PolicyBook = *policyBook
+		case "root_depth": config.RootDepth = *rootDepth
+		case "volume_window": config.VolumeWindow = *volumeWindow
+		case "volume_limit": config.VolumeLimit = *volumeLimit
+		case "webhooks": config.Webhooks = splitList(*webhooks)
+		case "mqtt_broker": config.Mqtt.Broker = *mqttBroker
+		case "mqtt_topic": config.Mqtt.Topic = *mqttTopic
+		}
+	})
+
+	if config.AvailabilityUrl == "" && len(config.PMs) == 0 {
+		return nil, errors.New("No batch sources configured, set an availability store or permission marshals\n")
+	}
+	if config.FetchTimeout < 0 {
+		return nil, errors.New("Fetch timeout must not be negative\n")
+	}
+	var err error
+	if config.volumeWindow, err = time.ParseDuration(config.VolumeWindow); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid volume window: %s\n", err))
+	}
+	if config.VolumeLimit > 0 && config.volumeWindow <= 0 {
+		return nil, errors.New("Volume window must be positive\n")
+	}
+	if len(config.BusinessHours.Days) != 0 {
+		if err = config.BusinessHours.init(); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Webhooks) == 0 && config.Mqtt.Broker == "" {
+		fmt.Printf("No webhooks or MQTT broker configured, alerts are only logged\n")
+	}
+	return config, nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"strings"
+	"net/url"
+	"net/http"
+	"os/signal"
+	"io/ioutil"
+	"crypto/x509"
+	"encoding/json"
+	"path/filepath"
+
+	"blockchain-service/blockchain"
+)
+
+// Certificate transparency style monitor of the permission chain. It tails the ledger and fetches the leaves of every batch
+// root a permission marshal publishes from the availability store (or the PMs' federation feeds), then checks every new cert:
+//
+// policy_denied      the policy evaluator denies the cert's chain
+// unchained          the cert does not chain to a root cert of the ledger's init block
+// root_grant         the cert grants an attribute at most rootDepth levels below Root (or is a new Root cert)
+// off_hours          the cert's NotBefore is outside business hours
+// issuer_volume      the issuer published more than volumeLimit certs within volumeWindow (by ledger time)
+// batch_unavailable  no source provided the batch within fetchTimeout
+// invalid_leaf       a published leaf is not a certificate
+//
+// Alerts are POSTed as JSON to the configured webhooks and published on the MQTT topic. The next block to check and the
+// volume counters are kept in <data_dir>/state.json, so the monitor resumes where it stopped.
+
+type monitorState struct {
+	NextBlock uint64 `json:"nextBlock"`
+	Volume *volumeTracker `json:"volume"`
+}
+
+type monitor struct {
+	config *monitorConfig
+	sdkLock sync.Mutex //Must acquire before using fSetup
+	fSetup blockchain.FabricSetup
+	stateLock sync.Mutex //Must acquire before using state
+	state monitorState
+	certs *certIndex
+	sources []batchSource
+	alerts *alerter
+	stop chan bool
+}
+
+func (m *monitor) statePath() string {
+	return filepath.Join(m.config.DataDir, "state.json")
+}
+
+func (m *monitor) loadState() error {
+	m.state = monitorState{0, &volumeTracker{}}
+	data, err := ioutil.ReadFile(m.statePath())
+	if err == nil {
+		if err = json.Unmarshal(data, &m.state); err != nil {
+			return fmt.Errorf("%s: %s", m.statePath(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if m.state.Volume == nil {
+		m.state.Volume = &volumeTracker{}
+	}
+	if m.state.Volume.Published == nil {
+		m.state.Volume.Published = make(map[string][]time.Time)
+	}
+	if m.state.Volume.Exceeded == nil {
+		m.state.Volume.Exceeded = make(map[string]bool)
+	}
+	m.state.Volume.Window = m.config.volumeWindow
+	m.state.Volume.Limit = m.config.VolumeLimit
+	return nil
+}
+
+func (m *monitor) saveState() error {
+	data, err := json.Marshal(&m.state)
+	if err != nil {
+		return err
+	}
+	tmp := m.statePath() + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.statePath())
+}
+
+func (m *monitor) nextBlock() uint64 {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.state.NextBlock
+}
+
+//Sleeps for d, reports false if the monitor is stopping
+func (m *monitor) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-m.stop:
+		return false
+	}
+}
+
+//Fetches fabric block n, retrying until it succeeds or the monitor stops
+func (m *monitor) getBlock(n uint64) *blockchain.Block {
+	for true {
+		m.sdkLock.Lock()
+		block, err := m.fSetup.GetBlock(n)
+		m.sdkLock.Unlock()
+		if err == nil {
+			return block
+		}
+		fmt.Printf("Could not get block %d: %s\n", n, err)
+		if !m.sleep(5 * time.Second) {
+			return nil
+		}
+	}
+	return nil
+}
+
+//Handles fabric block n. Blocks are delivered in order by the block listener.
+func (m *monitor) handleEvent(n uint64) {
+	if n < m.nextBlock() {
+		return
+	}
+	var published time.Time
+	if n >= blockchain.BlockOffset {
+		block := m.getBlock(n)
+		if block == nil {
+			return
+		}
+		published = block.Timestamp
+		for index, valid := range block.Metadata.Metadata[2] {
+			if valid != 0 {
+				continue
+			}
+			for _, write := range block.Transactions[index].Writes {
+				key, err := url.QueryUnescape(write.KvRwSet.Writes[0].Key)
+				if err != nil {
+					fmt.Printf("Block %d: Could not decode key: %s\n", n, err)
+					continue
+				}
+				if n == blockchain.BlockOffset {
+					m.loadAnchors(n, key, write.KvRwSet.Writes[0].Value)
+					continue
+				}
+				if !m.checkBatch(n, block.Timestamp, []byte(key)) {
+					return
+				}
+			}
+		}
+	}
+
+	m.stateLock.Lock()
+	m.state.NextBlock = n + 1
+	if !published.IsZero() {
+		m.state.Volume.purge(published)
+	}
+	err := m.saveState()
+	m.stateLock.Unlock()
+	if err != nil {
+		fmt.Printf("Could not save monitor state: %s\n", err)
+	}
+}
+
+//Trusts the root certs written when the chaincode was instantiated
+func (m *monitor) loadAnchors(n uint64, key string, value []byte) {
+	if key != "rootCerts" {
+		fmt.Printf("Block %d: Invalid init block, key should be \"rootCerts\"\n", n)
+		return
+	}
+	var certs [][]byte
+	if err := json.Unmarshal(value, &certs); err != nil {
+		fmt.Printf("Block %d: Could not parse root certs: %s\n", n, err)
+		return
+	}
+	for _, raw := range certs {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			fmt.Printf("Block %d: Could not parse root cert: %s\n", n, err)
+			continue
+		}
+		if err = m.certs.store(cert, true); err != nil {
+			fmt.Printf("Could not store root cert of %s: %s\n", cert.Subject.CommonName, err)
+			continue
+		}
+		fmt.Printf("Trust anchor: %s\n", cert.Subject.CommonName)
+	}
+}
+
+//Asks every source for the batch until one has it or the fetch timeout passes
+func (m *monitor) fetchBatch(n uint64, root []byte) (*fetchedBatch, bool) {
+	deadline := time.Now().Add(time.Duration(m.config.FetchTimeout) * time.Second)
+	for true {
+		for _, source := range m.sources {
+			batch, err := source.fetch(n, root)
+			if err != nil {
+				fmt.Printf("Block %d: Could not fetch batch %x: %s\n", n, root, err)
+				continue
+			}
+			if batch != nil {
+				return batch, true
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, true
+		}
+		if !m.sleep(10 * time.Second) {
+			return nil, false
+		}
+	}
+	return nil, true
+}
+
+//Checks every cert of the batch published under root in block n, reports false if the monitor is stopping
+func (m *monitor) checkBatch(n uint64, published time.Time, root []byte) bool {
+	rootHex := fmt.Sprintf("%x", root)
+	batch, ok := m.fetchBatch(n, root)
+	if !ok {
+		return false
+	}
+	if batch == nil {
+		m.alerts.send(&alert{Rule: ruleUnavailable, Channel: m.config.ChannelID, Block: n, Root: rootHex, Detail: fmt.Sprintf("No source provided the batch within %d seconds", m.config.FetchTimeout)})
+		return true
+	}
+	fmt.Printf("Block %d: Checking %d certs of batch %s from %s\n", n, len(batch.certs), rootHex, batch.source)
+	for _, leaf := range batch.invalid {
+		m.alerts.send(&alert{Rule: ruleInvalidLeaf, Channel: m.config.ChannelID, Block: n, Root: rootHex, Source: batch.source, Detail: fmt.Sprintf("Leaf of %d bytes is not a certificate", len(leaf))})
+	}
+
+	//Certs of the batch may issue each other
+	for _, pc := range batch.certs {
+		if err := m.certs.store(pc.cert, false); err != nil {
+			fmt.Printf("Could not store cert of %s: %s\n", pc.cert.Subject.CommonName, err)
+		}
+	}
+	for _, pc := range batch.certs {
+		m.checkCert(n, published, rootHex, batch.source, pc)
+	}
+	return true
+}
+
+func (m *monitor) checkCert(n uint64, published time.Time, root, source string, pc publishedCert) {
+	cert := pc.cert
+	notBefore := cert.NotBefore
+	newAlert := func(rule, detail string) *alert {
+		return &alert{rule, m.config.ChannelID, n, root, source, cert.Subject.CommonName, cert.Issuer.CommonName, cert.SerialNumber.String(), "", &notBefore, detail, time.Time{}}
+	}
+
+	//Check the chain the PM published with the cert, or rebuild it from the certs seen so far
+	chain := pc.chain
+	var err error
+	if chain != nil {
+		//Issuers of a verified chain can complete the chains of certs fetched without a PCN
+		if err = m.certs.checkChain(chain); err == nil {
+			for _, issuer := range chain[1:] {
+				if err := m.certs.store(issuer, false); err != nil {
+					fmt.Printf("Could not store cert of %s: %s\n", issuer.Subject.CommonName, err)
+				}
+			}
+		}
+	} else {
+		chain, err = m.certs.chain(cert)
+	}
+	if err != nil {
+		m.alerts.send(newAlert(ruleUnchained, strings.TrimSpace(err.Error())))
+	} else if time.Now().After(cert.NotAfter) {
+		fmt.Printf("%s: Certificate expired, policy not evaluated\n", cert.Subject.CommonName)
+	} else if err = evaluatePolicy(m.config, chain); err != nil {
+		m.alerts.send(newAlert(rulePolicyDenied, strings.TrimSpace(err.Error())))
+	}
+
+	attr, canConfer, err := certAttribute(cert)
+	if err == nil && m.config.RootDepth >= 0 {
+		depth := len(strings.Split(attr, ".")) - 1
+		if attr == "Root" || (canConfer && depth <= m.config.RootDepth) {
+			al := newAlert(ruleRootGrant, fmt.Sprintf("Grants %s (can confer: %t)", attr, canConfer))
+			al.Attribute = attr
+			m.alerts.send(al)
+		}
+	}
+
+	if len(m.config.BusinessHours.Days) != 0 && !m.config.BusinessHours.contains(cert.NotBefore) {
+		m.alerts.send(newAlert(ruleOffHours, fmt.Sprintf("Issued %s, outside business hours", cert.NotBefore.In(m.config.BusinessHours.location).Format(time.RFC1123))))
+	}
+
+	if m.config.VolumeLimit > 0 {
+		m.stateLock.Lock()
+		count, exceeded := m.state.Volume.add(issuerKey(cert), published)
+		m.stateLock.Unlock()
+		if exceeded {
+			m.alerts.send(newAlert(ruleIssuerVolume, fmt.Sprintf("%s published %d certs within %s (limit %d)", cert.Issuer.CommonName, count, m.config.volumeWindow, m.config.VolumeLimit)))
+		}
+	}
+}
+
+func main() {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("Could not load config: %s\n", err)
+		os.Exit(1)
+	}
+	m := &monitor{config: config, stop: make(chan bool)}
+	m.fSetup = blockchain.FabricSetup{
+		OrgAdmin:        "Admin",
+		OrgName:         "Org1",
+		ConfigFile:      config.FabricConfig,
+		ChannelID:       config.ChannelID,
+		UserName:        "Admin",
+	}
+	if err = os.MkdirAll(config.DataDir, 0700); err != nil {
+		fmt.Printf("Could not create data directory: %s\n", err)
+		os.Exit(1)
+	}
+	if err = m.loadState(); err != nil {
+		fmt.Printf("Could not load monitor state: %s\n", err)
+		os.Exit(1)
+	}
+	if m.certs, err = loadCertIndex(config.DataDir); err != nil {
+		fmt.Printf("Could not load known certs: %s\n", err)
+		os.Exit(1)
+	}
+	if config.AvailabilityUrl != "" {
+		m.sources = append(m.sources, &storeSource{config.AvailabilityUrl, &http.Client{Timeout: 30 * time.Second}})
+	}
+	for _, pm := range config.PMs {
+		source, err := newPMSource(pm)
+		if err != nil {
+			fmt.Printf("Could not configure permission marshal %s: %s\n", pm.Name, err)
+			os.Exit(1)
+		}
+		m.sources = append(m.sources, source)
+	}
+	if m.alerts, err = newAlerter(config); err != nil {
+		fmt.Printf("Could not configure alerts: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Initializing Fabric SDK...\n")
+	if err = m.fSetup.Initialize(); err != nil {
+		fmt.Printf("Unable to initialize the Fabric SDK: %v\n", err)
+		os.Exit(1)
+	}
+	if err = m.fSetup.InitializeLedgerClient(); err != nil {
+		fmt.Printf("Unable to initialize ledger client: %v\n", err)
+		os.Exit(1)
+	}
+	if err = m.fSetup.InitializeEventClient(); err != nil {
+		fmt.Printf("Unable to initialize event client: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Monitoring channel %s from block %d\n", config.ChannelID, m.nextBlock())
+
+	listener := blockchain.NewBlockListener(&m.sdkLock, &m.fSetup, m.handleEvent, m.nextBlock)
+	listenerStopped := make(chan bool, 1)
+	go listener.Run(m.stop, listenerStopped)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	fmt.Printf("\nShutting Down...\n")
+	close(m.stop)
+	<-listenerStopped
+	m.sdkLock.Lock()
+	m.fSetup.Close()
+	m.sdkLock.Unlock()
+	m.alerts.Close()
+	fmt.Printf("...Shutdown Complete\n")
+}
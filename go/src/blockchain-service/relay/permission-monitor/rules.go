@@ -0,0 +1,267 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+	"unicode"
+	"io/ioutil"
+	"crypto/x509"
+	"crypto/sha256"
+	"encoding/pem"
+	"path/filepath"
+)
+
+//Certs the monitor has seen, used to rebuild the chain of certs fetched without their PCN. Anchors are the root certs of the
+//ledger's init block, every other published cert is kept as a possible issuer.
+type certIndex struct {
+	dir string
+	anchors map[[32]byte]bool
+	bySubject map[string][]*x509.Certificate
+}
+
+func loadCertIndex(dir string) (*certIndex, error) {
+	ci := &certIndex{dir, make(map[[32]byte]bool), make(map[string][]*x509.Certificate)}
+	for _, sub := range []string{"anchors", "certs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), ".pem") {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, sub, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return nil, errors.New(fmt.Sprintf("No PEM data found in %s\n", file.Name()))
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ci.add(cert, sub == "anchors")
+		}
+	}
+	return ci, nil
+}
+
+func (ci *certIndex) add(cert *x509.Certificate, anchor bool) {
+	sum := sha256.Sum256(cert.Raw)
+	if anchor {
+		ci.anchors[sum] = true
+	}
+	for _, known := range ci.bySubject[string(cert.RawSubject)] {
+		if bytes.Equal(known.Raw, cert.Raw) {
+			return
+		}
+	}
+	ci.bySubject[string(cert.RawSubject)] = append(ci.bySubject[string(cert.RawSubject)], cert)
+}
+
+//Adds cert to the index and persists it
+func (ci *certIndex) store(cert *x509.Certificate, anchor bool) error {
+	sum := sha256.Sum256(cert.Raw)
+	if ci.anchors[sum] || (!anchor && ci.known(cert)) {
+		return nil
+	}
+	sub := "certs"
+	if anchor {
+		sub = "anchors"
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := ioutil.WriteFile(filepath.Join(ci.dir, sub, fmt.Sprintf("%x.pem", sum)), data, 0600); err != nil {
+		return err
+	}
+	ci.add(cert, anchor)
+	return nil
+}
+
+func (ci *certIndex) known(cert *x509.Certificate) bool {
+	for _, known := range ci.bySubject[string(cert.RawSubject)] {
+		if bytes.Equal(known.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ci *certIndex) isAnchor(cert *x509.Certificate) bool {
+	return ci.anchors[sha256.Sum256(cert.Raw)]
+}
+
+//Builds the chain from cert to a trust anchor (cert first) out of the known certs
+func (ci *certIndex) chain(cert *x509.Certificate) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{cert}
+	for !ci.isAnchor(chain[len(chain)-1]) {
+		current := chain[len(chain)-1]
+		if len(chain) > 16 {
+			return nil, errors.New("Certificate chain is too long\n")
+		}
+		var issuer *x509.Certificate
+		for _, candidate := range ci.bySubject[string(current.RawIssuer)] {
+			if !bytes.Equal(candidate.Raw, current.Raw) && current.CheckSignatureFrom(candidate) == nil {
+				issuer = candidate
+				break
+			}
+		}
+		if issuer == nil {
+			return nil, errors.New(fmt.Sprintf("No known issuer of %s (issued by %s)\n", current.Subject.CommonName, current.Issuer.CommonName))
+		}
+		chain = append(chain, issuer)
+	}
+	return chain, nil
+}
+
+//Checks chain (cert first) is signed link by link and ends in a trust anchor
+func (ci *certIndex) checkChain(chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return errors.New(fmt.Sprintf("%s is not signed by %s: %s\n", chain[i].Subject.CommonName, chain[i+1].Subject.CommonName, err))
+		}
+	}
+	if !ci.isAnchor(chain[len(chain)-1]) {
+		return errors.New(fmt.Sprintf("Chain ends in %s, which is not a trust anchor\n", chain[len(chain)-1].Subject.CommonName))
+	}
+	return nil
+}
+
+//Attribute extension of a cert, parsed like the policy evaluator does
+func certAttribute(cert *x509.Certificate) (string, bool, error) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.String() == "1.3.6.1.5.5.7.10" {
+			attrArray := strings.Split(string(ext.Value), "_")
+			canConfer := len(attrArray) > 1 && attrArray[1] == "grants"
+			return strings.TrimFunc(attrArray[0], func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+			}), canConfer, nil
+		}
+	}
+	return "", false, errors.New(fmt.Sprintf("Certificate of %s does not have the attribute extension\n", cert.Subject.CommonName))
+}
+
+//Runs the policy evaluator on chain (cert first)
+func evaluatePolicy(config *monitorConfig, chain []*x509.Certificate) error {
+	var chainPem []byte
+	for _, cert := range chain {
+		chainPem = append(chainPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	tmp, err := ioutil.TempFile("", "monitor-chain-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(chainPem)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(config.PolicyEval, "-chain", tmp.Name(), "-pb", config.PolicyBook)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return errors.New(fmt.Sprintf("Could not run the policy evaluator: %s\n", err))
+		}
+		//The evaluator ends its output with the reason of the denial
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return errors.New(fmt.Sprintf("Denied: %s\n", lines[len(lines)-1]))
+	}
+	return nil
+}
+
+type businessHours struct {
+	Start int `yaml:"start"` // First hour of business (0-23)
+	End int `yaml:"end"` // Hour business ends (1-24)
+	Days []string `yaml:"days"` // Business days, e.g. [Mon, Tue, Wed, Thu, Fri]
+	Location string `yaml:"location"` // Time zone, e.g. Europe/Berlin, Local if empty
+	location *time.Location
+	days map[time.Weekday]bool
+}
+
+func (bh *businessHours) init() error {
+	if bh.Start < 0 || bh.End > 24 || bh.Start >= bh.End {
+		return errors.New(fmt.Sprintf("Invalid business hours %d to %d\n", bh.Start, bh.End))
+	}
+	var err error
+	if bh.location, err = time.LoadLocation(bh.Location); err != nil {
+		return err
+	}
+	bh.days = make(map[time.Weekday]bool)
+	for _, day := range bh.Days {
+		found := false
+		for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+			if strings.EqualFold(day, weekday.String()[:3]) || strings.EqualFold(day, weekday.String()) {
+				bh.days[weekday] = true
+				found = true
+			}
+		}
+		if !found {
+			return errors.New(fmt.Sprintf("Unknown business day %s\n", day))
+		}
+	}
+	return nil
+}
+
+func (bh *businessHours) contains(t time.Time) bool {
+	t = t.In(bh.location)
+	return bh.days[t.Weekday()] && t.Hour() >= bh.Start && t.Hour() < bh.End
+}
+
+//Counts the certs each issuer published within the volume window. An issuer is reported once when it exceeds the limit and
+//again only after its count dropped back below it.
+type volumeTracker struct {
+	Window time.Duration `json:"-"`
+	Limit int `json:"-"`
+	Published map[string][]time.Time `json:"published"` // Publication times within the window, per issuer
+	Exceeded map[string]bool `json:"exceeded"`
+}
+
+//Records a cert of issuer published at t, reports the count if the issuer just exceeded the limit
+func (vt *volumeTracker) add(issuer string, t time.Time) (int, bool) {
+	times := vt.Published[issuer]
+	cutoff := t.Add(-vt.Window)
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+	times = append(times, t)
+	vt.Published[issuer] = times
+	if len(times) <= vt.Limit {
+		delete(vt.Exceeded, issuer)
+		return len(times), false
+	}
+	if vt.Exceeded[issuer] {
+		return len(times), false
+	}
+	vt.Exceeded[issuer] = true
+	return len(times), true
+}
+
+//Forgets issuers without publications within the window before now
+func (vt *volumeTracker) purge(now time.Time) {
+	cutoff := now.Add(-vt.Window)
+	for issuer, times := range vt.Published {
+		if len(times) == 0 || times[len(times)-1].Before(cutoff) {
+			delete(vt.Published, issuer)
+			delete(vt.Exceeded, issuer)
+		}
+	}
+}
+
+//Key of the cert's issuer for volume tracking: its authority key ID, or the issuer name if it has none
+func issuerKey(cert *x509.Certificate) string {
+	if len(cert.AuthorityKeyId) != 0 {
+		return fmt.Sprintf("%x", cert.AuthorityKeyId)
+	}
+	return cert.Issuer.String()
+}
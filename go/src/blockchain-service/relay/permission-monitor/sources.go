@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/sha256"
+	"encoding/pem"
+	"encoding/json"
+
+	"blockchain-service/blockchain"
+)
+
+//Cert published in a batch
+type publishedCert struct {
+	cert *x509.Certificate
+	chain []*x509.Certificate // Chain from the cert's PCN (cert first), nil if the source only had the leaves
+}
+
+//Certs of a batch as provided by a source
+type fetchedBatch struct {
+	source string
+	certs []publishedCert
+	invalid [][]byte // Leaves that are not certificates
+}
+
+//Provides the leaves of a batch published under root in fabric block n. Returns nil if the source does not have the batch
+//(yet).
+type batchSource interface {
+	fetch(n uint64, root []byte) (*fetchedBatch, error)
+}
+
+//Availability store (permission-marshal/availability-store), which keeps every batch under its root
+type storeSource struct {
+	url string
+	client *http.Client
+}
+
+func (s *storeSource) fetch(n uint64, root []byte) (*fetchedBatch, error) {
+	resp, err := s.client.Get(fmt.Sprintf("%s/batches/%x", strings.TrimRight(s.url, "/"), root))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Batch request failed (%s): %s\n", resp.Status, body))
+	}
+
+	var batch blockchain.Batch
+	if err = json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(batch.Root, root) {
+		return nil, errors.New(fmt.Sprintf("Availability store returned batch %x for root %x\n", batch.Root, root))
+	}
+	if err = batch.Verify(); err != nil {
+		return nil, err
+	}
+
+	//The last leaf is the PM's timestamp
+	fetched := &fetchedBatch{source: s.url}
+	for _, leaf := range batch.Leaves[:len(batch.Leaves)-1] {
+		cert, err := x509.ParseCertificate(leaf)
+		if err != nil {
+			fetched.invalid = append(fetched.invalid, leaf)
+			continue
+		}
+		fetched.certs = append(fetched.certs, publishedCert{cert, nil})
+	}
+	return fetched, nil
+}
+
+//Federation feed types, see permission-marshal/federation.go
+type feedEntry struct {
+	Cert []byte `json:"cert"`
+	PCN []byte `json:"pcn"`
+	PubValidationInfo blockchain.ValidationInfo `json:"pubValidationInfo"`
+	BroadcastValidationInfo blockchain.ValidationInfo `json:"broadcastValidationInfo"`
+}
+
+type feed struct {
+	Origin string `json:"origin"`
+	Since uint64 `json:"since"`
+	Height uint64 `json:"height"`
+	Entries []feedEntry `json:"entries"`
+}
+
+type signedFeed struct {
+	Feed json.RawMessage `json:"feed"`
+	Signature []byte `json:"signature"`
+}
+
+//Permission marshal serving a signed federation feed (/federation/feed). The feed only lists certs that are still
+//published, so a batch fetched from a PM may miss certs revoked since.
+type pmSource struct {
+	name string
+	url string
+	key *rsa.PublicKey
+	client *http.Client
+}
+
+func newPMSource(config pmConfig) (*pmSource, error) {
+	if config.Name == "" || config.Url == "" {
+		return nil, errors.New("Permission marshals need a name and a url\n")
+	}
+	data, err := ioutil.ReadFile(config.Cert)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("No PEM data found in %s\n", config.Cert))
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s does not contain an RSA key\n", config.Cert))
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	roots.AddCert(cert)
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	return &pmSource{config.Name, config.Url, key, client}, nil
+}
+
+func (s *pmSource) fetch(n uint64, root []byte) (*fetchedBatch, error) {
+	resp, err := s.client.Get(fmt.Sprintf("%s/federation/feed?since=%d", strings.TrimRight(s.url, "/"), n))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Feed request failed (%s): %s\n", resp.Status, body))
+	}
+
+	var signed signedFeed
+	if err = json.Unmarshal(body, &signed); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(signed.Feed)
+	if err = rsa.VerifyPKCS1v15(s.key, crypto.SHA256, hash[:], signed.Signature); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid feed signature: %s\n", err))
+	}
+	var f feed
+	if err = json.Unmarshal(signed.Feed, &f); err != nil {
+		return nil, err
+	}
+	//The PM has not handled block n yet
+	if f.Since != n || f.Height <= n {
+		return nil, nil
+	}
+
+	fetched := &fetchedBatch{source: s.name}
+	for _, entry := range f.Entries {
+		info := &entry.PubValidationInfo
+		if info.BlockIndex != int64(n) || !bytes.Equal(info.MerkleRoot, root) {
+			continue
+		}
+		if err = info.VerifyLeaf(entry.Cert); err != nil {
+			return nil, errors.New(fmt.Sprintf("Feed entry is not included under root %x: %s", root, err))
+		}
+		cert, err := x509.ParseCertificate(entry.Cert)
+		if err != nil {
+			fetched.invalid = append(fetched.invalid, entry.Cert)
+			continue
+		}
+		published := publishedCert{cert, nil}
+		if pcn, err := blockchain.ParsePCN(entry.PCN); err == nil && len(pcn.Certs) != 0 && bytes.Equal(pcn.Certs[0].Raw, cert.Raw) {
+			published.chain = pcn.Certs
+		} else {
+			fmt.Printf("%s: Ignoring the PCN of %s\n", s.name, cert.Subject.CommonName)
+		}
+		fetched.certs = append(fetched.certs, published)
+	}
+	if len(fetched.certs) == 0 && len(fetched.invalid) == 0 {
+		return nil, nil
+	}
+	return fetched, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"sync"
+	"bytes"
+	"strings"
+	"io/ioutil"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/json"
+	"path/filepath"
+
+	"blockchain-service/blockchain"
+	"blockchain-service/relay/relayTypes"
+	"blockchain-service/relay/relayWire"
+)
+
+// Recomputes every relay block from the ledger and compares it with the relay blocks that were broadcast (as stored by
+// relay-receiver in <data_dir>/chain). Every fabric block is checked against its own header (data hash) and against the
+// previous block (previous hash) on the way.
+//
+// Exit Code 0: Broadcast chain matches the ledger
+// Exit Code 1: Divergence found
+// Exit Code 2: Error occurred
+
+//n : number of items in bloom filter, p : probability of false positives
+const (
+	n = uint(1000)
+	p = 0.000001
+)
+
+//Loads broadcast relay block messages (JSON or binary), keyed by index
+func loadBroadcast(dir string) (map[uint64]*relayWire.RelayBlockMessage, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make(map[uint64]*relayWire.RelayBlockMessage)
+	for _, file := range files {
+		//Receivers keep the log jump proof of a block stored after a gap next to it
+		if file.IsDir() || strings.HasSuffix(file.Name(), ".tmp") || strings.HasSuffix(file.Name(), ".jump") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var msg relayWire.RelayBlockMessage
+		if relayWire.IsBinary(data) {
+			err = msg.UnmarshalBinary(data)
+		} else {
+			err = json.Unmarshal(data, &msg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Name(), err)
+		}
+		if _, ok := msgs[msg.Block.Index]; ok {
+			return nil, fmt.Errorf("%s: relay block %d stored more than once", file.Name(), msg.Block.Index)
+		}
+		msgs[msg.Block.Index] = &msg
+	}
+	return msgs, nil
+}
+
+func loadRelayKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an RSA key", path)
+	}
+	return key, nil
+}
+
+//Lists the header fields that differ between the broadcast and the recomputed block
+func diff(got, want *relayWire.RelayBlock) []string {
+	var fields []string
+	if got.HeaderVersion() != want.HeaderVersion() {
+		fields = append(fields, fmt.Sprintf("version (broadcast %d, ledger %d)", got.HeaderVersion(), want.HeaderVersion()))
+	}
+	if !bytes.Equal(got.BlockMerkleRoot, want.BlockMerkleRoot) {
+		fields = append(fields, "merkle root")
+	}
+	if !bytes.Equal(got.BloomFilterHash, want.BloomFilterHash) {
+		fields = append(fields, "bloom filter hash")
+	}
+	if !bytes.Equal(got.PreviousBlockHash, want.PreviousBlockHash) {
+		fields = append(fields, "previous block hash")
+	}
+	if got.Epoch != want.Epoch || got.Rebuilt != want.Rebuilt {
+		fields = append(fields, fmt.Sprintf("epoch (broadcast %d/%t, ledger %d/%t)", got.Epoch, got.Rebuilt, want.Epoch, want.Rebuilt))
+	}
+	if got.FabricBlockNumber != want.FabricBlockNumber {
+		fields = append(fields, fmt.Sprintf("fabric block number (broadcast %d, ledger %d)", got.FabricBlockNumber, want.FabricBlockNumber))
+	}
+	if !bytes.Equal(got.FabricBlockHash, want.FabricBlockHash) {
+		fields = append(fields, "fabric block hash")
+	}
+	if got.Timestamp != want.Timestamp {
+		fields = append(fields, "timestamp")
+	}
+	if got.RelayID != want.RelayID {
+		fields = append(fields, fmt.Sprintf("relay ID (broadcast %s, ledger %s)", got.RelayID, want.RelayID))
+	}
+	if got.HashStrategy != want.HashStrategy {
+		fields = append(fields, fmt.Sprintf("hash strategy (broadcast %q, ledger %q)", got.HashStrategy, want.HashStrategy))
+	}
+	if !bytes.Equal(got.LogRoot, want.LogRoot) {
+		fields = append(fields, "log root")
+	}
+	return fields
+}
+
+func main() {
+	fabricConfig := flag.String("fabric_config", "config.1.yaml", "Fabric SDK config file")
+	channelID := flag.String("channel", "mychannel", "Fabric channel the relay chain was built from")
+	relayID := flag.String("relay_id", "relay1", "Relay ID the relay was run with")
+	blockVersion := flag.Uint("block_version", 1, "Relay block header version the relay was run with")
+	blockV2From := flag.Uint64("block_v2_from", 0, "-block_v2_from the relay was run with")
+	epochLength := flag.Uint64("revocation_epoch", 1000, "-revocation_epoch the relay was run with")
+	hashStrategy := flag.String("hash_strategy", blockchain.DefaultHashStrategy, "-hash_strategy the relay was run with")
+	blockLog := flag.Bool("block_log", true, "-block_log the relay was run with")
+	blockLogFrom := flag.Uint64("block_log_from", 0, "-block_log_from the relay was run with")
+	chainDir := flag.String("chain", "relay-chain/chain", "Directory of broadcast relay blocks (relay-receiver <data_dir>/chain)")
+	relayCert := flag.String("relay_cert", "", "Relay certificate, if set the signatures of the broadcast blocks are checked too")
+	to := flag.Int64("to", -1, "Last relay block to audit, defaults to the current ledger height")
+	flag.Parse()
+
+	broadcast, err := loadBroadcast(*chainDir)
+	if err != nil {
+		fmt.Printf("Could not load broadcast relay blocks: %s\n", err)
+		os.Exit(2)
+	}
+	var relayKey *rsa.PublicKey
+	if *relayCert != "" {
+		if relayKey, err = loadRelayKey(*relayCert); err != nil {
+			fmt.Printf("Could not load relay certificate: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	var sdkLock sync.Mutex
+	fSetup := blockchain.FabricSetup{
+		OrgAdmin:        "Admin",
+		OrgName:         "Org1",
+		ConfigFile:      *fabricConfig,
+		ChannelID:       *channelID,
+		UserName:        "Admin",
+	}
+	if err = fSetup.Initialize(); err != nil {
+		fmt.Printf("Unable to initialize the Fabric SDK: %v\n", err)
+		os.Exit(2)
+	}
+	defer fSetup.Close()
+	if err = fSetup.InitializeLedgerClient(); err != nil {
+		fmt.Printf("Unable to initialize ledger client: %v\n", err)
+		os.Exit(2)
+	}
+
+	stop := uint64(*to)
+	if *to < 0 {
+		bci, err := fSetup.GetLedgerInfo()
+		if err != nil {
+			fmt.Printf("Could not get ledger height: %s\n", err)
+			os.Exit(2)
+		}
+		if bci.BCI.GetHeight() < 2+blockchain.BlockOffset {
+			fmt.Printf("Ledger has no relay blocks yet\n")
+			os.Exit(0)
+		}
+		stop = bci.BCI.GetHeight() - 1 - blockchain.BlockOffset
+	}
+
+	header := relayTypes.HeaderConfig{*relayID, uint8(*blockVersion), *blockV2From, *hashStrategy, *blockLog, *blockLogFrom}
+	logHasher, err := header.Hasher()
+	if err != nil {
+		fmt.Printf("%s", err)
+		os.Exit(2)
+	}
+	builder := relayTypes.NewChainBuilder(header, relayTypes.NewRevocationSet(n, p, *epochLength), logHasher)
+	divergent, missing, matched := 0, 0, 0
+	for builder.Index() <= stop {
+		index := builder.Index()
+		processed, err := relayTypes.ProcessBlock(index+blockchain.BlockOffset, &sdkLock, &fSetup, logHasher)
+		if err != nil {
+			fmt.Printf("Relay block %d: could not process fabric block %d: %s\n", index, index+blockchain.BlockOffset, err)
+			os.Exit(1)
+		}
+		want, _, err := builder.Next(processed)
+		if err != nil {
+			fmt.Printf("Relay block %d: ledger inconsistent: %s\n", index, err)
+			os.Exit(1)
+		}
+
+		got, ok := broadcast[index]
+		if !ok {
+			missing++
+			continue
+		}
+		delete(broadcast, index)
+		if relayKey != nil {
+			if err = got.Verify(relayKey); err != nil {
+				fmt.Printf("Relay block %d: DIVERGES: %s", index, err)
+				divergent++
+				continue
+			}
+		}
+		if !bytes.Equal(got.Block.Hash(), want.Hash()) || !bytes.Equal(got.BlockHash, want.Hash()) {
+			fmt.Printf("Relay block %d: DIVERGES from fabric block %d: %s\n", index, processed.Number, strings.Join(diff(&got.Block, want), ", "))
+			divergent++
+			continue
+		}
+		matched++
+	}
+
+	for index := range broadcast {
+		fmt.Printf("Relay block %d: DIVERGES: broadcast but not on the ledger (audited up to %d)\n", index, stop)
+		divergent++
+	}
+
+	fmt.Printf("Audited relay blocks 0 to %d: %d match, %d diverge, %d not broadcast (or not stored)\n", stop, matched, divergent, missing)
+	if divergent != 0 {
+		os.Exit(1)
+	}
+}
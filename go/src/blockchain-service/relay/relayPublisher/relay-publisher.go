@@ -0,0 +1,241 @@
+package relayPublisher
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type Options struct {
+	Broker string // Broker URI, e.g. tcp://localhost:1883
+	ClientID string
+	Username string
+	Password string
+	QoS byte // 0, 1 or 2
+	QueueDir string // Directory the outbound queue is persisted to
+	Timeout time.Duration // How long to wait for the broker to acknowledge a publish before retrying
+	RetryInterval time.Duration // How long to wait between retries while the broker is unreachable
+}
+
+//Outbound message, persisted to the queue directory until the broker acknowledges it
+type message struct {
+	Seq uint64 `json:"seq"`
+	Topic string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+//Publishes retained messages in order. Every message is written to the queue directory before Publish returns and is only
+//removed once the broker has acknowledged it, so messages survive broker outages and relay restarts.
+type Publisher struct {
+	client mqtt.Client
+	opts Options
+	lock sync.Mutex //Must acquire before using pending or nextSeq
+	pending []*message
+	nextSeq uint64
+	wake chan bool
+	stop chan bool
+	done chan bool
+}
+
+func New(opts Options) (*Publisher, error) {
+	if opts.QoS > 2 {
+		return nil, errors.New(fmt.Sprintf("Invalid QoS: %d\n", opts.QoS))
+	}
+	if err := os.MkdirAll(opts.QueueDir, 0700); err != nil {
+		return nil, err
+	}
+	p := &Publisher{opts: opts, wake: make(chan bool, 1), stop: make(chan bool), done: make(chan bool)}
+	if err := p.load(); err != nil {
+		return nil, fmt.Errorf("Could not load publish queue: %s", err)
+	}
+	fmt.Printf("Loaded %d unacknowledged messages from %s\n", len(p.pending), opts.QueueDir)
+
+	mqttOpts := mqtt.NewClientOptions()
+	mqttOpts.AddBroker(opts.Broker)
+	mqttOpts.SetClientID(opts.ClientID)
+	mqttOpts.SetCleanSession(false)
+	if opts.Username != "" {
+		mqttOpts.SetUsername(opts.Username)
+		mqttOpts.SetPassword(opts.Password)
+	}
+	mqttOpts.SetAutoReconnect(true)
+	mqttOpts.SetOnConnectHandler(func(client mqtt.Client) {
+		fmt.Printf("Connected to broker %s\n", opts.Broker)
+		p.signal()
+	})
+	mqttOpts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		fmt.Printf("Lost connection to broker: %s\n", err)
+	})
+	p.client = mqtt.NewClient(mqttOpts)
+
+	//Messages queue until the first connection succeeds, after that the client reconnects by itself
+	go p.connect()
+	go p.run()
+	return p, nil
+}
+
+//Retries the initial connection to the broker every RetryInterval until it succeeds or the publisher is closed
+func (p *Publisher) connect() {
+	for true {
+		//Connect gives up after the client's connect timeout
+		token := p.client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return
+		}
+		fmt.Printf("Could not connect to broker %s: %s\n", p.opts.Broker, token.Error())
+		select {
+		case <-time.After(p.opts.RetryInterval):
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Publisher) signal() {
+	select {
+	case p.wake <- true:
+	default:
+	}
+}
+
+func (p *Publisher) fileName(m *message) string {
+	return filepath.Join(p.opts.QueueDir, fmt.Sprintf("%020d.json", m.Seq))
+}
+
+//Loads unacknowledged messages left over from a previous run
+func (p *Publisher) load() error {
+	files, err := ioutil.ReadDir(p.opts.QueueDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(p.opts.QueueDir, file.Name()))
+		if err != nil {
+			return err
+		}
+		var m message
+		if err = json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("%s: %s", file.Name(), err)
+		}
+		p.pending = append(p.pending, &m)
+	}
+	sort.Slice(p.pending, func(i, j int) bool {
+		return p.pending[i].Seq < p.pending[j].Seq
+	})
+	if len(p.pending) != 0 {
+		p.nextSeq = p.pending[len(p.pending)-1].Seq + 1
+	}
+	return nil
+}
+
+//Write file and flush it to disk before renaming it into place
+func writeFileSync(name string, data []byte) error {
+	tmp := name + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+//Persists a message to the outbound queue. Once Publish returns nil the message will be delivered to the broker eventually
+//(after any messages queued before it).
+func (p *Publisher) Publish(topic string, payload []byte) error {
+	p.lock.Lock()
+	m := &message{p.nextSeq, topic, payload}
+	data, err := json.Marshal(m)
+	if err != nil {
+		p.lock.Unlock()
+		return err
+	}
+	if err = writeFileSync(p.fileName(m), data); err != nil {
+		p.lock.Unlock()
+		return fmt.Errorf("Could not persist message: %s", err)
+	}
+	p.nextSeq++
+	p.pending = append(p.pending, m)
+	p.lock.Unlock()
+
+	p.signal()
+	return nil
+}
+
+//Number of messages waiting for the broker to acknowledge them
+func (p *Publisher) Pending() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.pending)
+}
+
+//Sends queued messages in order, retrying the head of the queue until the broker acknowledges it
+func (p *Publisher) run() {
+	defer func() {
+		p.done <- true
+	}()
+	retry := time.NewTicker(p.opts.RetryInterval)
+	defer retry.Stop()
+
+	for true {
+		p.lock.Lock()
+		var head *message
+		if len(p.pending) != 0 {
+			head = p.pending[0]
+		}
+		p.lock.Unlock()
+
+		if head != nil && p.client.IsConnectionOpen() {
+			token := p.client.Publish(head.Topic, p.opts.QoS, true, head.Payload)
+			if !token.WaitTimeout(p.opts.Timeout) {
+				fmt.Printf("Timed out publishing message %d to topic %s\n", head.Seq, head.Topic)
+			} else if token.Error() != nil {
+				fmt.Printf("Could not publish message %d to topic %s: %s\n", head.Seq, head.Topic, token.Error())
+			} else {
+				fmt.Printf("Published message %d to topic: %s\n", head.Seq, head.Topic)
+				if err := os.Remove(p.fileName(head)); err != nil && !os.IsNotExist(err) {
+					fmt.Printf("Could not remove acknowledged message %d: %s\n", head.Seq, err)
+				}
+				p.lock.Lock()
+				p.pending = p.pending[1:]
+				p.lock.Unlock()
+				continue
+			}
+		}
+
+		select {
+		case <-p.wake:
+		case <-retry.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+//Stops the publisher. Unacknowledged messages stay in the queue directory and are sent on the next start.
+func (p *Publisher) Close() {
+	close(p.stop)
+	<-p.done
+	p.client.Disconnect(uint(250))
+}
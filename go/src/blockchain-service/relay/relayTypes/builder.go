@@ -0,0 +1,140 @@
+package relayTypes
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+
+	"github.com/google/trillian/merkle"
+	"github.com/google/trillian/merkle/hashers"
+
+	"blockchain-service/blockchain"
+	"blockchain-service/relay/relayWire"
+)
+
+//Builds consecutive relay blocks from processed fabric blocks. The block request api and the auditor use it to rebuild the
+//relay chain exactly as the relay built it.
+type ChainBuilder struct {
+	header HeaderConfig
+	revocations *RevocationSet
+	index uint64 // Index of the next relay block
+	previousHash []byte // Hash of the last relay block
+	fabricHash []byte // Header hash of the last fabric block
+	trustAnchorRoot []byte // Merkle root of the root certs, set by the init block
+	logHasher hashers.LogHasher
+	log *merkle.InMemoryMerkleTree // Hashes of the relay blocks built so far
+}
+
+//logHasher builds the log of relay block hashes, it is the hasher of the block merkle trees
+func NewChainBuilder(header HeaderConfig, revocations *RevocationSet, logHasher hashers.LogHasher) *ChainBuilder {
+	return &ChainBuilder{header: header, revocations: revocations, previousHash: []byte(""), logHasher: logHasher, log: merkle.NewInMemoryMerkleTree(logHasher)}
+}
+
+//Index of the next relay block
+func (cb *ChainBuilder) Index() uint64 {
+	return cb.index
+}
+
+//Builds the next relay block from pb, which must be the fabric block following the last one. Returns the block and, for
+//all but the init block, the bloom filter bytes it commits to.
+func (cb *ChainBuilder) Next(pb *ProcessedBlock) (*RelayBlock, []byte, error) {
+	if pb.Number != cb.index+blockchain.BlockOffset {
+		return nil, nil, errors.New(fmt.Sprintf("Expected fabric block %d, got %d\n", cb.index+blockchain.BlockOffset, pb.Number))
+	}
+	if cb.fabricHash != nil && !bytes.Equal(pb.PreviousHash, cb.fabricHash) {
+		return nil, nil, errors.New(fmt.Sprintf("Fabric block %d does not link to fabric block %d\n", pb.Number, pb.Number-1))
+	}
+
+	relayBlk := cb.header.NewBlock(cb.index, pb)
+	relayBlk.PreviousBlockHash = cb.previousHash
+	if cb.header.LogAt(cb.index) {
+		relayBlk.LogRoot = cb.logRoot(cb.index)
+	}
+	var filterBytes []byte
+	if pb.Revocations != nil {
+		//Add Revocations to Bloom Filter (purging expired revocations at epoch boundaries)
+		rebuilt, err := cb.revocations.Apply(pb, cb.index)
+		if err != nil {
+			return nil, nil, err
+		}
+		var filterBufferHash []byte
+		if filterBytes, filterBufferHash, err = cb.revocations.FilterBytes(); err != nil {
+			return nil, nil, err
+		}
+		relayBlk.BloomFilterHash = filterBufferHash
+		relayBlk.Epoch = cb.revocations.Epoch
+		relayBlk.Rebuilt = rebuilt
+	} else {
+		relayBlk.BloomFilterHash = []byte("")
+		cb.trustAnchorRoot = relayBlk.BlockMerkleRoot
+	}
+
+	cb.previousHash = relayBlk.Hash()
+	cb.log.AddLeaf(cb.previousHash)
+	cb.fabricHash = pb.Hash
+	cb.index++
+	return &relayBlk, filterBytes, nil
+}
+
+//Returns the checkpoint of the last relay block built
+func (cb *ChainBuilder) Checkpoint() (*relayWire.Checkpoint, error) {
+	if cb.index == 0 {
+		return nil, errors.New("No relay block built yet\n")
+	}
+	return &relayWire.Checkpoint{
+		RelayID:          cb.header.RelayID,
+		Index:            cb.index - 1,
+		BlockHash:        cb.previousHash,
+		RevocationDigest: cb.revocations.Digest(),
+		TrustAnchorRoot:  cb.trustAnchorRoot,
+		Epoch:            cb.revocations.Epoch,
+	}, nil
+}
+
+//Root of the log over the hashes of the first size relay blocks
+func (cb *ChainBuilder) logRoot(size uint64) []byte {
+	if size == 0 {
+		return cb.logHasher.EmptyRoot()
+	}
+	return cb.log.RootAtSnapshot(int64(size)).Hash()
+}
+
+func logHashes(path []merkle.TreeEntryDescriptor) [][]byte {
+	hashes := [][]byte{}
+	for _, elem := range path {
+		hashes = append(hashes, elem.Value.Hash())
+	}
+	return hashes
+}
+
+//Proves the log over the first from relay blocks is a prefix of the log over the first to. Relay blocks up to to-1 must be built.
+func (cb *ChainBuilder) ConsistencyProof(from, to uint64) (*relayWire.ConsistencyProof, error) {
+	if from > to || to > cb.index {
+		return nil, errors.New(fmt.Sprintf("No consistency proof from %d to %d, the log has %d relay blocks\n", from, to, cb.index))
+	}
+	proof := &relayWire.ConsistencyProof{From: from, To: to, Hashes: [][]byte{}}
+	if from != 0 && from != to {
+		proof.Hashes = logHashes(cb.log.SnapshotConsistency(int64(from), int64(to)))
+	}
+	return proof, nil
+}
+
+//Proves relay block from is an ancestor of relay block to, which must commit to the log. Relay blocks up to to-1 must be built.
+func (cb *ChainBuilder) Jump(from, to uint64) (*relayWire.LogJump, error) {
+	if from >= to || to > cb.index {
+		return nil, errors.New(fmt.Sprintf("No log jump from %d to %d, the log has %d relay blocks\n", from, to, cb.index))
+	}
+	if !cb.header.LogAt(to) {
+		return nil, errors.New(fmt.Sprintf("Relay block %d does not commit to the block log\n", to))
+	}
+	jump := &relayWire.LogJump{From: from, To: to}
+	jump.Inclusion = relayWire.LogInclusionProof{from, to, logHashes(cb.log.PathToRootAtSnapshot(int64(from)+1, int64(to)))}
+	if cb.header.LogAt(from) {
+		consistency, err := cb.ConsistencyProof(from, to)
+		if err != nil {
+			return nil, err
+		}
+		jump.Consistency = consistency
+	}
+	return jump, nil
+}
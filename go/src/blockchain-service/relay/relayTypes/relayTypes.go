@@ -3,86 +3,93 @@ package relayTypes
 import (
 	"fmt"
 	"sync"
-	"bytes"
 	"errors"
-	"strings"
+	"time"
 	"net/url"
-	"crypto/sha256"
-	"encoding/binary"
 	"encoding/json"
 
-	"github.com/google/trillian"
     	"github.com/google/trillian/merkle"
 	"github.com/google/trillian/merkle/hashers"
 
 	"blockchain-service/blockchain"
+	"blockchain-service/relay/relayWire"
 )
 
-type BloomMessage struct {
-	Index uint64 `json:"index"` // Relay block index commiting to this bloom filter
-	Filter []byte `json:"filter"` // Byte repersenation of bloom filter
+//Message types are defined in relayWire (standard library only) so receivers can share them
+type BloomMessage = relayWire.BloomMessage
+type RelayBlock = relayWire.RelayBlock
+type RelayBlockMessage = relayWire.RelayBlockMessage
+type CheckpointMessage = relayWire.CheckpointMessage
+
+//Result of processing a single fabric block
+type ProcessedBlock struct {
+	Number uint64 // Fabric block number
+	Tree *merkle.InMemoryMerkleTree // Block level merkle tree
+	Revocations *[]*blockchain.RevocationStatement // Revocation statements (revocations, suspensions, reinstatements) in ledger order, nil for the chaincode instantiation block
+	Timestamp time.Time // Latest transaction timestamp in the fabric block
+	Hash []byte // Fabric block header hash
+	PreviousHash []byte // Header hash of the previous fabric block, as recorded in this block's header
 }
 
-type RelayBlock struct {
-	Index uint64 `json:"index"`
-	BlockMerkleRoot []byte `json:"root"` //Root of block merkle tree
-	BloomFilterHash []byte `json:"bloom"` // Hash of bloomfilter bytes
-	PreviousBlockHash []byte `json:"previous"`// Hash of previous relay block
+//Decides which header version relay blocks are built with
+type HeaderConfig struct {
+	RelayID string
+	Version uint8 // Header version of new blocks (relayWire.RelayBlockV1 or RelayBlockV2)
+	V2From uint64 // With Version 2, blocks before this index keep the v1 header so chains stored by v1 receivers stay valid
+	HashStrategy string // Strategy block merkle trees are built with (blockchain.HashStrategies), only v2 headers can record another than the default
+	Log bool // Commit v2 blocks to the log of relay block hashes (relayWire/log.go)
+	LogFrom uint64 // With Log, blocks before this index don't commit to the log so chains stored by receivers stay valid
 }
 
-type RelayBlockMessage struct {
-	Block RelayBlock `json:"block"`
-	SigList [][]byte `json:"siglist"` // RSA_SIG(SHA256(relayBlock))
-	BlockHash []byte `json:"blockhash"`
+//Reports whether relay block index commits to the log root
+func (hc HeaderConfig) LogAt(index uint64) bool {
+	return hc.Log && index >= hc.LogFrom && hc.VersionAt(index) >= relayWire.RelayBlockV2
 }
 
-// block bytes = [4 bytes for index] + [Merkle root as bytes] + [Bloom filter hash as bytes] + [Previous block hash as bytes]
-func (rb *RelayBlock) Bytes() []byte {
-	var blockData []byte
-	indexAsBytes := bytes.NewBuffer([]byte{})
-	binary.Write(indexAsBytes, binary.BigEndian, uint32(rb.Index))
-	blockData = append(blockData, indexAsBytes.Bytes()...)
-	blockData = append(blockData, rb.BlockMerkleRoot...)
-	blockData = append(blockData, rb.BloomFilterHash...)
-	blockData = append(blockData, rb.PreviousBlockHash...)
-	return blockData
+//Returns the hasher block merkle trees are built with
+func (hc HeaderConfig) Hasher() (hashers.LogHasher, error) {
+	return blockchain.NewHasher(hc.HashStrategy)
 }
 
-// block hash = sha256(block bytes)
-func (rb *RelayBlock) Hash() []byte {
-	sum := sha256.Sum256(rb.Bytes())
-	return sum[:]
+//Returns the header version of relay block index
+func (hc HeaderConfig) VersionAt(index uint64) uint8 {
+	if hc.Version >= relayWire.RelayBlockV2 && index >= hc.V2From {
+		return relayWire.RelayBlockV2
+	}
+	return relayWire.RelayBlockV1
+}
+
+//Returns relay block index for processed fabric block pb with the header fields set, the caller fills in the bloom filter
+//hash, previous block hash and epoch
+func (hc HeaderConfig) NewBlock(index uint64, pb *ProcessedBlock) RelayBlock {
+	block := RelayBlock{Index: index, BlockMerkleRoot: pb.Tree.CurrentRoot().Hash()}
+	if hc.VersionAt(index) >= relayWire.RelayBlockV2 {
+		block.Version = relayWire.RelayBlockV2
+		block.FabricBlockNumber = pb.Number
+		block.FabricBlockHash = pb.Hash
+		block.Timestamp = pb.Timestamp.UnixNano()
+		block.RelayID = hc.RelayID
+		block.HashStrategy = blockchain.RecordedHashStrategy(hc.HashStrategy)
+	}
+	return block
 }
 
-// Returns a block level merkle tree and a list of revocations for fabric block n
-func ProcessBlock(n uint64, sdkLock *sync.Mutex, fSetup *blockchain.FabricSetup) (*merkle.InMemoryMerkleTree, *[][]byte, error) {
+// Returns a block level merkle tree built with logHasher, a list of revocations and the block timestamp for fabric block n
+func ProcessBlock(n uint64, sdkLock *sync.Mutex, fSetup *blockchain.FabricSetup, logHasher hashers.LogHasher) (*ProcessedBlock, error) {
 	//Get Block Information
 	sdkLock.Lock()
 	block, err := fSetup.GetBlock(n)
 	sdkLock.Unlock()
 	if err != nil {
 		fmt.Printf("Could not handle block event: %s", err)
-		return nil, nil, err
+		return nil, err
 	}
 
-	var revocations [][]byte
+	var revocations []*blockchain.RevocationStatement
 	var blockMerkleTree *merkle.InMemoryMerkleTree
 
 	//If n == blockchain.BlockOffset, then the block being processed is the block published when the chaincode was instantiated. Else, standard block is being processed.
 	if n != blockchain.BlockOffset {
-		//Init hasher used by merkle tree
-		strategy, ok := trillian.HashStrategy_value[*blockchain.HashStrategyFlag]
-		if !ok {
-			fmt.Printf("Unknown hash strategy: %s", *blockchain.HashStrategyFlag)
-			return nil, nil, err
-		}
-
-		logHasher, err := hashers.NewLogHasher(trillian.HashStrategy(strategy))
-		if err != nil {
-			fmt.Printf("Could Not Create Log Hasher: %v\n", err)
-			return nil, nil, err
-		}
-
 		//Init merkle tree
 		blockMerkleTree = merkle.NewInMemoryMerkleTree(logHasher)
 
@@ -94,42 +101,23 @@ func ProcessBlock(n uint64, sdkLock *sync.Mutex, fSetup *blockchain.FabricSetup)
 			}
 
 			for _, write := range block.Transactions[index].Writes{			
-				var revokeJson [][]byte 
-				var temp *blockchain.ProofFile
 				//fmt.Printf("Write Set: %+v\n", write)
 				
 				//Parse Merkle Roots add to Block Merkle Tree
 				rootString, err := url.QueryUnescape(write.KvRwSet.Writes[0].Key)
 				if err != nil {
 					fmt.Printf("Could not handle block event: %s\n", err)
-					return nil, nil, err
+					return nil, err
 				}
 				fmt.Printf("relayTypes.go rootString = %s\n", rootString)
 				blockMerkleTree.AddLeaf([]byte(rootString))
 				
 				//Parse Revocations and add to list
-				if err = json.Unmarshal(write.KvRwSet.Writes[0].Value, &revokeJson); err != nil {
-					fmt.Printf("Could not handle block event: %s\n", err)
-					return nil, nil, err
-				}
-				
-				for _,r := range revokeJson {
-					if temp, err = blockchain.ParsePCN(r); err != nil{
-						fmt.Printf("Could not handle block event: %s", err)
-						return nil, nil, err
-					}
-					revocations = append(revocations, []byte(strings.Replace(temp.ProofList.Revoke.Cert, "REVOKE\n", "", 1)))
-				}
+				revocations = append(revocations, blockchain.LedgerRevocations(write.KvRwSet.Writes[0].Value)...)
 				
 			}
 		}
 	} else {
-		logHasher, err := blockchain.InitHasher()
-		if err != nil {
-			fmt.Printf("%s\n", err)
-			return nil, nil, err
-		}
-
 		blockMerkleTree = merkle.NewInMemoryMerkleTree(logHasher)
 
 		//fmt.Printf("%+v\n", block)
@@ -146,17 +134,17 @@ func ProcessBlock(n uint64, sdkLock *sync.Mutex, fSetup *blockchain.FabricSetup)
 				rootString, err := url.QueryUnescape(write.KvRwSet.Writes[0].Key)
 				if err != nil {
 					fmt.Printf("Could not handle block event: %s\n", err)
-					return nil, nil, err
+					return nil, err
 				}
 
 				if rootString != "rootCerts" {
 					fmt.Printf("Invalid Init Block!\n")
-					return nil, nil, errors.New("Block is not formatted correctly. Key should be \"rootCerts\"\n")
+					return nil, errors.New("Block is not formatted correctly. Key should be \"rootCerts\"\n")
 				}	 		
 
 				if err = json.Unmarshal(write.KvRwSet.Writes[0].Value, &certs); err != nil {
 					fmt.Printf("Could not handle block event: %s\n", err)
-					return nil, nil, err
+					return nil, err
 				}
 
 				for _,cert := range certs {
@@ -166,7 +154,7 @@ func ProcessBlock(n uint64, sdkLock *sync.Mutex, fSetup *blockchain.FabricSetup)
 		}
 	}
 	if n != blockchain.BlockOffset {
-		return blockMerkleTree, &revocations, nil
+		return &ProcessedBlock{n, blockMerkleTree, &revocations, block.Timestamp, block.Hash, block.Header.GetPreviousHash()}, nil
 	}
-	return blockMerkleTree, nil, nil
+	return &ProcessedBlock{n, blockMerkleTree, nil, block.Timestamp, block.Hash, block.Header.GetPreviousHash()}, nil
 }
@@ -0,0 +1,144 @@
+package relayTypes
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/willf/bloom"
+
+	"blockchain-service/blockchain"
+)
+
+//Revocation digest of a relay. Every revoked or suspended cert is tracked together with its NotAfter so that, once a cert
+//has expired (and could never validate anyway), it can be dropped from the bloom filter when the next epoch starts.
+type RevocationSet struct {
+	entries map[[32]byte]time.Time // Key of revoked or suspended cert (blockchain.RevocationStatement.Key) -> NotAfter of the cert
+	held map[[32]byte]bool // Suspended certs among entries, the only ones a reinstatement removes
+	filter *bloom.BloomFilter
+	n uint // Number of items the bloom filter is sized for
+	p float64 // False positive probability the bloom filter is sized for
+	epochLength uint64 // Number of relay blocks between purges, 0 disables purging
+	Epoch uint64 // Number of times the bloom filter has been rebuilt
+	digest []byte // Cumulative revocation digest, see Add
+}
+
+func NewRevocationSet(n uint, p float64, epochLength uint64) *RevocationSet {
+	return &RevocationSet{make(map[[32]byte]time.Time), make(map[[32]byte]bool), bloom.NewWithEstimates(n, p), n, p, epochLength, 0, make([]byte, sha256.Size)}
+}
+
+//Applies a revocation statement to the set and chains it into the digest:
+//digest = sha256(digest + statement digest), starting from 32 zero bytes. The statement digest of a v1 statement is
+//sha256(revoked cert), see blockchain.RevocationStatement.Digest.
+//Revocations and suspensions add the cert, revoking a suspended cert makes it permanent and a reinstatement removes a
+//suspended cert. Statements that don't change the set (e.g. reinstating a revoked cert) are only chained into the digest.
+//Returns true if a cert was removed, the bloom filter has to be rebuilt then.
+func (rs *RevocationSet) Add(statement *blockchain.RevocationStatement) bool {
+	sum := statement.Key()
+	statementDigest := statement.Digest()
+	digest := sha256.Sum256(append(append([]byte{}, rs.digest...), statementDigest[:]...))
+	rs.digest = digest[:]
+
+	_, listed := rs.entries[sum]
+	switch statement.Action {
+	case blockchain.StatementReinstate:
+		if !rs.held[sum] {
+			fmt.Printf("Ignoring reinstatement of %s, it is not suspended\n", statement.Cert.Subject.CommonName)
+			return false
+		}
+		delete(rs.entries, sum)
+		delete(rs.held, sum)
+		return true
+	case blockchain.StatementSuspend:
+		if listed {
+			//Already suspended, or revoked for good
+			return false
+		}
+		rs.held[sum] = true
+	default:
+		delete(rs.held, sum)
+		if listed {
+			return false
+		}
+	}
+	rs.entries[sum] = statement.Cert.NotAfter
+	rs.filter.Add(sum[:])
+	return false
+}
+
+//Digest of every revocation statement added so far, in ledger order. Unlike the bloom filter it is not affected by purges.
+func (rs *RevocationSet) Digest() []byte {
+	return append([]byte{}, rs.digest...)
+}
+
+func (rs *RevocationSet) Contains(sum [32]byte) bool {
+	_, ok := rs.entries[sum]
+	return ok
+}
+
+//Reports whether the cert is suspended rather than revoked
+func (rs *RevocationSet) Suspended(sum [32]byte) bool {
+	return rs.held[sum]
+}
+
+func (rs *RevocationSet) Len() int {
+	return len(rs.entries)
+}
+
+//Drops every revocation whose cert expired before cutoff, returns the number dropped
+func (rs *RevocationSet) purgeExpired(cutoff time.Time) int {
+	purged := 0
+	for sum, notAfter := range rs.entries {
+		if notAfter.Before(cutoff) {
+			delete(rs.entries, sum)
+			delete(rs.held, sum)
+			purged++
+		}
+	}
+	return purged
+}
+
+//Rebuilds the bloom filter from the remaining revocations and starts a new epoch
+func (rs *RevocationSet) rebuild() {
+	rs.filter = bloom.NewWithEstimates(rs.n, rs.p)
+	for sum := range rs.entries {
+		rs.filter.Add(sum[:])
+	}
+	rs.Epoch++
+}
+
+//Applies the revocation statements of a processed fabric block to the set. At every epoch boundary (relay index is a multiple
+//of the epoch length) revocations which expired before the fabric block's timestamp are purged. The ledger timestamp is used
+//(rather than the relay's clock) so that the chain can be recomputed from the ledger. The bloom filter is rebuilt, starting a
+//new epoch, if anything was purged or reinstated. Returns true if the bloom filter was rebuilt.
+func (rs *RevocationSet) Apply(pb *ProcessedBlock, relayIndex uint64) (bool, error) {
+	reinstated := 0
+	if pb.Revocations != nil {
+		for _, statement := range *pb.Revocations {
+			if rs.Add(statement) {
+				reinstated++
+			}
+		}
+	}
+	purged := 0
+	if rs.epochLength != 0 && relayIndex != 0 && relayIndex%rs.epochLength == 0 {
+		purged = rs.purgeExpired(pb.Timestamp)
+	}
+	if purged == 0 && reinstated == 0 {
+		return false, nil
+	}
+	rs.rebuild()
+	fmt.Printf("Purged %d expired revocations and %d reinstated certs, starting epoch %d\n", purged, reinstated, rs.Epoch)
+	return true, nil
+}
+
+//Returns the bloom filter as []byte along with sha256(filter bytes)
+func (rs *RevocationSet) FilterBytes() ([]byte, []byte, error) {
+	filterBuffer := bytes.NewBuffer([]byte{})
+	if _, err := rs.filter.WriteTo(filterBuffer); err != nil {
+		return nil, nil, err
+	}
+	filterBufferHash := sha256.Sum256(filterBuffer.Bytes())
+	return filterBuffer.Bytes(), filterBufferHash[:], nil
+}
@@ -0,0 +1,38 @@
+package relayTypes
+
+import (
+	"fmt"
+	"crypto/rsa"
+
+	"blockchain-service/blockchain"
+)
+
+//blockchain.RootSource of signed relay blocks, e.g. the relay blocks bundled in a v2 PCN
+type RelayRoots map[int64]RelayBlock
+
+func (r RelayRoots) BlockRoot(index int64, strategy string) ([]byte, error) {
+	block, ok := r[index]
+	if !ok {
+		return nil, fmt.Errorf("relay block %d not available", index)
+	}
+	if blockchain.RecordedHashStrategy(block.HashStrategy) != blockchain.RecordedHashStrategy(strategy) {
+		return nil, fmt.Errorf("relay block %d was built with hash strategy %q, not %q", index, block.HashStrategy, strategy)
+	}
+	return block.BlockMerkleRoot, nil
+}
+
+//Decodes binary relay block messages and checks they are signed by the relay key
+func NewRelayRoots(messages [][]byte, key *rsa.PublicKey) (RelayRoots, error) {
+	roots := make(RelayRoots)
+	for _, data := range messages {
+		var msg RelayBlockMessage
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		if err := msg.Verify(key); err != nil {
+			return nil, err
+		}
+		roots[int64(msg.Block.Index)] = msg.Block
+	}
+	return roots, nil
+}
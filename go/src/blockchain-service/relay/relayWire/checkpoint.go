@@ -0,0 +1,158 @@
+package relayWire
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+//Signed snapshot of the relay state at a relay block. A device that trusts the checkpoint can start verifying the chain at
+//Index instead of replaying every block from 0.
+type Checkpoint struct {
+	RelayID string `json:"relayID"`
+	Index uint64 `json:"index"` // Relay block the checkpoint was taken at
+	BlockHash []byte `json:"blockhash"` // Hash of relay block Index
+	RevocationDigest []byte `json:"revocations"` // Cumulative digest of every revocation statement (revocation, suspension, reinstatement) up to and including relay block Index
+	TrustAnchorRoot []byte `json:"trustAnchors"` // Merkle root of the root certs (relay block 0)
+	Epoch uint64 `json:"epoch,omitempty"` // Revocation epoch at relay block Index
+}
+
+type CheckpointMessage struct {
+	Checkpoint Checkpoint `json:"checkpoint"`
+	Block RelayBlockMessage `json:"block"` // Signed relay block Index, receivers link the blocks after the checkpoint to it
+	SigList [][]byte `json:"siglist"` // RSA_SIG(SHA256(checkpoint))
+	Hash []byte `json:"hash"`
+}
+
+const CheckpointVersion = uint8(1)
+
+// checkpoint bytes = ["GPCP"] + [1 byte version] + [8 bytes for index] + [8 bytes for epoch] + LP(Block hash)
+//                  + LP(Revocation digest) + LP(Trust anchor root) + LP(Relay ID)
+func (cp *Checkpoint) Bytes() []byte {
+	buf := bytes.NewBuffer([]byte("GPCP"))
+	buf.WriteByte(CheckpointVersion)
+	binary.Write(buf, binary.BigEndian, cp.Index)
+	binary.Write(buf, binary.BigEndian, cp.Epoch)
+	for _, field := range [][]byte{cp.BlockHash, cp.RevocationDigest, cp.TrustAnchorRoot, []byte(cp.RelayID)} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	return buf.Bytes()
+}
+
+// checkpoint hash = sha256(checkpoint bytes)
+func (cp *Checkpoint) Hash() []byte {
+	sum := sha256.Sum256(cp.Bytes())
+	return sum[:]
+}
+
+//Checks the checkpoint is signed by key and that the relay block it carries is the one it commits to
+func (m *CheckpointMessage) Verify(key *rsa.PublicKey) error {
+	cp := &m.Checkpoint
+	hash := cp.Hash()
+	if !bytes.Equal(hash, m.Hash) {
+		return errors.New(fmt.Sprintf("Checkpoint %d: hash does not match checkpoint contents\n", cp.Index))
+	}
+	signed := false
+	for _, sig := range m.SigList {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, sig) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New(fmt.Sprintf("Checkpoint %d: no valid relay signature\n", cp.Index))
+	}
+	if len(cp.RevocationDigest) != sha256.Size || len(cp.TrustAnchorRoot) == 0 {
+		return errors.New(fmt.Sprintf("Checkpoint %d: missing revocation digest or trust anchor root\n", cp.Index))
+	}
+
+	if err := m.Block.Verify(key); err != nil {
+		return err
+	}
+	if m.Block.Block.Index != cp.Index || !bytes.Equal(m.Block.BlockHash, cp.BlockHash) {
+		return errors.New(fmt.Sprintf("Checkpoint %d: relay block %d is not the checkpointed block\n", cp.Index, m.Block.Block.Index))
+	}
+	if m.Block.Block.Epoch != cp.Epoch {
+		return errors.New(fmt.Sprintf("Checkpoint %d: epoch %d does not match relay block epoch %d\n", cp.Index, cp.Epoch, m.Block.Block.Epoch))
+	}
+	if m.Block.Block.HeaderVersion() >= RelayBlockV2 && m.Block.Block.RelayID != cp.RelayID {
+		return errors.New(fmt.Sprintf("Checkpoint %d: relay ID %s does not match relay block relay ID %s\n", cp.Index, cp.RelayID, m.Block.Block.RelayID))
+	}
+	return nil
+}
+
+const TypeCheckpoint = byte(3)
+
+// Checkpoint message tags
+const (
+	tagCheckpointIndex = byte(1)
+	tagCheckpointBlockHash = byte(2)
+	tagRevocationDigest = byte(3)
+	tagTrustAnchorRoot = byte(4)
+	tagCheckpointEpoch = byte(5)
+	tagCheckpointRelayID = byte(6)
+	tagCheckpointBlock = byte(7) // Binary encoded relay block message
+	tagCheckpointSig = byte(8)
+	tagCheckpointHash = byte(9)
+)
+
+func (m *CheckpointMessage) MarshalBinary() ([]byte, error) {
+	block, err := m.Block.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	e := newEncoder(TypeCheckpoint)
+	e.uint(tagCheckpointIndex, m.Checkpoint.Index)
+	e.bytes(tagCheckpointBlockHash, m.Checkpoint.BlockHash)
+	e.bytes(tagRevocationDigest, m.Checkpoint.RevocationDigest)
+	e.bytes(tagTrustAnchorRoot, m.Checkpoint.TrustAnchorRoot)
+	if m.Checkpoint.Epoch != 0 {
+		e.uint(tagCheckpointEpoch, m.Checkpoint.Epoch)
+	}
+	e.bytes(tagCheckpointRelayID, []byte(m.Checkpoint.RelayID))
+	e.bytes(tagCheckpointBlock, block)
+	for _, sig := range m.SigList {
+		e.bytes(tagCheckpointSig, sig)
+	}
+	e.bytes(tagCheckpointHash, m.Hash)
+	return e.buf.Bytes(), nil
+}
+
+func (m *CheckpointMessage) UnmarshalBinary(data []byte) error {
+	var msg CheckpointMessage
+	seen := make(map[byte]bool)
+	err := decode(data, TypeCheckpoint, func(tag byte, value []byte) error {
+		var err error
+		if seen[tag] && tag != tagCheckpointSig {
+			return errors.New(fmt.Sprintf("Duplicate field %d\n", tag))
+		}
+		seen[tag] = true
+		switch tag {
+		case tagCheckpointIndex: msg.Checkpoint.Index, err = decodeUint(tag, value)
+		case tagCheckpointBlockHash: msg.Checkpoint.BlockHash = clone(value)
+		case tagRevocationDigest: msg.Checkpoint.RevocationDigest = clone(value)
+		case tagTrustAnchorRoot: msg.Checkpoint.TrustAnchorRoot = clone(value)
+		case tagCheckpointEpoch: msg.Checkpoint.Epoch, err = decodeUint(tag, value)
+		case tagCheckpointRelayID: msg.Checkpoint.RelayID = string(value)
+		case tagCheckpointBlock: err = msg.Block.UnmarshalBinary(value)
+		case tagCheckpointSig: msg.SigList = append(msg.SigList, clone(value))
+		case tagCheckpointHash: msg.Hash = clone(value)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, tag := range []byte{tagCheckpointIndex, tagCheckpointBlockHash, tagRevocationDigest, tagTrustAnchorRoot, tagCheckpointBlock, tagCheckpointHash} {
+		if !seen[tag] {
+			return errors.New(fmt.Sprintf("Checkpoint message is missing field %d\n", tag))
+		}
+	}
+	*m = msg
+	return nil
+}
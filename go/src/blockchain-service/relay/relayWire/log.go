@@ -0,0 +1,199 @@
+package relayWire
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"crypto/sha256"
+	"crypto/sha512"
+)
+
+//The relay keeps an append-only Merkle log (RFC 6962) of relay block hashes, leaf i is the hash of relay block i. Every v2
+//block from the relay's -log_from on commits to the root of the log over all blocks before it (LogRoot, tree size = Index),
+//so a device can check that its head is an ancestor of a much later block with two logarithmic proofs instead of fetching
+//every block in between. The log is built with the block's hash strategy, the proofs are checked here with the standard
+//library only (kept in sync with blockchain/hasher.go).
+
+//Consistency proof between the log at tree size From and at tree size To (RFC 6962 2.1.2)
+type ConsistencyProof struct {
+	From uint64 `json:"from"`
+	To uint64 `json:"to"`
+	Hashes [][]byte `json:"hashes"`
+}
+
+//Inclusion proof of the hash of relay block Index in the log at tree size Size (RFC 6962 2.1.1)
+type LogInclusionProof struct {
+	Index uint64 `json:"index"`
+	Size uint64 `json:"size"`
+	Hashes [][]byte `json:"hashes"`
+}
+
+//Proves relay block From is an ancestor of relay block To: the hash of From is in the log To commits to, and the log From
+//commits to (if it commits to one) is a prefix of it
+type LogJump struct {
+	From uint64 `json:"from"`
+	To uint64 `json:"to"`
+	Inclusion LogInclusionProof `json:"inclusion"`
+	Consistency *ConsistencyProof `json:"consistency,omitempty"`
+}
+
+type logHasher func([]byte) []byte
+
+func newLogHasher(strategy string) (logHasher, error) {
+	switch strategy {
+	case "", "RFC6962_SHA256":
+		return func(data []byte) []byte { sum := sha256.Sum256(data); return sum[:] }, nil
+	case "RFC6962_SHA512_256":
+		return func(data []byte) []byte { sum := sha512.Sum512_256(data); return sum[:] }, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown hash strategy: %s\n", strategy))
+}
+
+func (h logHasher) leaf(leaf []byte) []byte {
+	return h(append([]byte{0}, leaf...))
+}
+
+func (h logHasher) node(left, right []byte) []byte {
+	data := append([]byte{1}, left...)
+	return h(append(data, right...))
+}
+
+//Checks proof shows leaf is at index in the tree of size leaves with the given root (RFC 9162 2.1.3.2)
+func verifyLogInclusion(h logHasher, index, size uint64, leaf, root []byte, proof [][]byte) error {
+	if index >= size {
+		return errors.New(fmt.Sprintf("Leaf %d is outside a log of %d leaves\n", index, size))
+	}
+	fn, sn := index, size-1
+	hash := h.leaf(leaf)
+	for _, p := range proof {
+		if sn == 0 {
+			return errors.New("Log inclusion proof has too many hashes\n")
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = h.node(p, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = h.node(hash, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("Log inclusion proof has too few hashes\n")
+	}
+	if !bytes.Equal(hash, root) {
+		return errors.New(fmt.Sprintf("Log inclusion proof of leaf %d does not match the root of a log of %d leaves\n", index, size))
+	}
+	return nil
+}
+
+//Checks proof shows the log of size1 leaves with root1 is a prefix of the log of size2 leaves with root2 (RFC 9162 2.1.4.2)
+func verifyLogConsistency(h logHasher, size1, size2 uint64, root1, root2 []byte, proof [][]byte) error {
+	if size1 > size2 {
+		return errors.New(fmt.Sprintf("Log of %d leaves can't be a prefix of a log of %d leaves\n", size1, size2))
+	}
+	if size1 == size2 || size1 == 0 {
+		if len(proof) != 0 {
+			return errors.New("Log consistency proof should be empty\n")
+		}
+		if size1 == size2 && !bytes.Equal(root1, root2) {
+			return errors.New("Log roots of the same size differ\n")
+		}
+		return nil
+	}
+	//If size1 is a power of two its root is the first node of the path
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root1}, proof...)
+	}
+	if len(proof) == 0 {
+		return errors.New("Log consistency proof is empty\n")
+	}
+	fn, sn := size1-1, size2-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errors.New("Log consistency proof has too many hashes\n")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = h.node(c, fr)
+			sr = h.node(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = h.node(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("Log consistency proof has too few hashes\n")
+	}
+	if !bytes.Equal(fr, root1) || !bytes.Equal(sr, root2) {
+		return errors.New(fmt.Sprintf("Log consistency proof from %d to %d leaves does not match the roots\n", size1, size2))
+	}
+	return nil
+}
+
+//Checks rb descends from the earlier block previous using jump instead of the blocks in between. Both blocks must carry
+//verified signatures, rb must commit to the log and, like VerifyLink, come from the same relay, hash strategy and move
+//forward in fabric block number and time.
+func (rb *RelayBlock) VerifyJump(previous *RelayBlock, jump *LogJump) error {
+	if rb.Index <= previous.Index {
+		return errors.New(fmt.Sprintf("Relay block %d does not follow relay block %d\n", rb.Index, previous.Index))
+	}
+	if jump.From != previous.Index || jump.To != rb.Index {
+		return errors.New(fmt.Sprintf("Log jump from %d to %d does not connect relay blocks %d and %d\n", jump.From, jump.To, previous.Index, rb.Index))
+	}
+	if len(rb.LogRoot) == 0 {
+		return errors.New(fmt.Sprintf("Relay block %d does not commit to the block log\n", rb.Index))
+	}
+	if rb.HeaderVersion() < previous.HeaderVersion() {
+		return errors.New(fmt.Sprintf("Relay block %d: header version downgraded from %d to %d\n", rb.Index, previous.HeaderVersion(), rb.HeaderVersion()))
+	}
+	if previous.HeaderVersion() >= RelayBlockV2 {
+		if rb.RelayID != previous.RelayID {
+			return errors.New(fmt.Sprintf("Relay block %d: relay ID changed from %s to %s\n", rb.Index, previous.RelayID, rb.RelayID))
+		}
+		if rb.HashStrategy != previous.HashStrategy {
+			return errors.New(fmt.Sprintf("Relay block %d: hash strategy changed from %q to %q\n", rb.Index, previous.HashStrategy, rb.HashStrategy))
+		}
+		if rb.FabricBlockNumber <= previous.FabricBlockNumber {
+			return errors.New(fmt.Sprintf("Relay block %d: fabric block number %d does not follow %d\n", rb.Index, rb.FabricBlockNumber, previous.FabricBlockNumber))
+		}
+		if rb.Timestamp < previous.Timestamp {
+			return errors.New(fmt.Sprintf("Relay block %d: timestamp is older than relay block %d\n", rb.Index, previous.Index))
+		}
+	}
+
+	h, err := newLogHasher(rb.HashStrategy)
+	if err != nil {
+		return err
+	}
+	inclusion := &jump.Inclusion
+	if inclusion.Index != previous.Index || inclusion.Size != rb.Index {
+		return errors.New(fmt.Sprintf("Log inclusion proof is for leaf %d of %d, want %d of %d\n", inclusion.Index, inclusion.Size, previous.Index, rb.Index))
+	}
+	if err = verifyLogInclusion(h, inclusion.Index, inclusion.Size, previous.Hash(), rb.LogRoot, inclusion.Hashes); err != nil {
+		return errors.New(fmt.Sprintf("Relay block %d is not in the log of relay block %d: %s", previous.Index, rb.Index, err))
+	}
+	if len(previous.LogRoot) == 0 {
+		return nil
+	}
+	consistency := jump.Consistency
+	if consistency == nil || consistency.From != previous.Index || consistency.To != rb.Index {
+		return errors.New(fmt.Sprintf("Missing log consistency proof from %d to %d\n", previous.Index, rb.Index))
+	}
+	if err = verifyLogConsistency(h, consistency.From, consistency.To, previous.LogRoot, rb.LogRoot, consistency.Hashes); err != nil {
+		return errors.New(fmt.Sprintf("Log of relay block %d is not a prefix of the log of relay block %d: %s", previous.Index, rb.Index, err))
+	}
+	return nil
+}
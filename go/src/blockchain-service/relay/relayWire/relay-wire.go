@@ -0,0 +1,354 @@
+package relayWire
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+//Messages broadcast by the relay. This package only depends on the standard library so receivers (relay-receviver,
+//bloom-filter-reader) can use it without pulling in the fabric sdk.
+
+type BloomMessage struct {
+	Index uint64 `json:"index"` // Relay block index commiting to this bloom filter
+	Filter []byte `json:"filter"` // Byte repersenation of bloom filter
+	Epoch uint64 `json:"epoch,omitempty"` // Revocation epoch of the filter
+}
+
+//Relay block header versions. Blocks without a version are v1.
+const (
+	RelayBlockV1 = uint8(1)
+	RelayBlockV2 = uint8(2)
+)
+
+type RelayBlock struct {
+	Version uint8 `json:"version,omitempty"` // Header version, 0 is treated as v1
+	Index uint64 `json:"index"`
+	BlockMerkleRoot []byte `json:"root"` //Root of block merkle tree
+	BloomFilterHash []byte `json:"bloom"` // Hash of bloomfilter bytes
+	PreviousBlockHash []byte `json:"previous"`// Hash of previous relay block
+	Epoch uint64 `json:"epoch,omitempty"` // Revocation epoch, incremented each time the bloom filter is rebuilt (expired revocations purged or suspended certs reinstated)
+	Rebuilt bool `json:"rebuilt,omitempty"` // Rebuild marker, set on the first block of a new epoch (bloom filter was rebuilt rather than extended)
+
+	// v2 only
+	FabricBlockNumber uint64 `json:"fabricBlock,omitempty"` // Fabric block this relay block was built from
+	FabricBlockHash []byte `json:"fabricHash,omitempty"` // Header hash of that fabric block
+	Timestamp int64 `json:"timestamp,omitempty"` // Latest transaction time in the fabric block (unix nanoseconds)
+	RelayID string `json:"relayID,omitempty"` // Relay that produced the block
+	HashStrategy string `json:"hashStrategy,omitempty"` // Strategy of the block merkle tree, empty for RFC6962_SHA256 (blockchain.HashStrategies)
+	LogRoot []byte `json:"logRoot,omitempty"` // Root of the log of the hashes of relay blocks 0 to Index-1, see log.go
+}
+
+type RelayBlockMessage struct {
+	Block RelayBlock `json:"block"`
+	SigList [][]byte `json:"siglist"` // RSA_SIG(SHA256(relayBlock))
+	BlockHash []byte `json:"blockhash"`
+}
+
+//Header version of the block (v1 if unset)
+func (rb *RelayBlock) HeaderVersion() uint8 {
+	if rb.Version == 0 {
+		return RelayBlockV1
+	}
+	return rb.Version
+}
+
+// v1 block bytes = [4 bytes for index] + [Merkle root as bytes] + [Bloom filter hash as bytes] + [Previous block hash as bytes]
+// Blocks from epoch 1 onwards (or carrying the rebuild marker) also append [8 bytes for epoch] + [1 byte rebuild marker],
+// blocks from epoch 0 hash exactly as before so existing receivers keep verifying them.
+func (rb *RelayBlock) Bytes() []byte {
+	if rb.HeaderVersion() >= RelayBlockV2 {
+		return rb.bytesV2()
+	}
+	var blockData []byte
+	indexAsBytes := bytes.NewBuffer([]byte{})
+	binary.Write(indexAsBytes, binary.BigEndian, uint32(rb.Index))
+	blockData = append(blockData, indexAsBytes.Bytes()...)
+	blockData = append(blockData, rb.BlockMerkleRoot...)
+	blockData = append(blockData, rb.BloomFilterHash...)
+	blockData = append(blockData, rb.PreviousBlockHash...)
+	if rb.Epoch != 0 || rb.Rebuilt {
+		epochAsBytes := bytes.NewBuffer([]byte{})
+		binary.Write(epochAsBytes, binary.BigEndian, rb.Epoch)
+		blockData = append(blockData, epochAsBytes.Bytes()...)
+		if rb.Rebuilt {
+			blockData = append(blockData, byte(1))
+		} else {
+			blockData = append(blockData, byte(0))
+		}
+	}
+	return blockData
+}
+
+// v2 block bytes = ["GPRB"] + [1 byte version] + [8 bytes for index] + [8 bytes for epoch] + [1 byte rebuild marker]
+//                + [8 bytes for fabric block number] + [8 bytes for timestamp] + LP(Merkle root) + LP(Bloom filter hash)
+//                + LP(Previous block hash) + LP(Fabric block hash) + LP(Relay ID) [+ LP(Hash strategy) [+ LP(Log root)]]
+// LP(x) = [4 bytes for len(x)] + [x], so no two different blocks share the same bytes. The hash strategy is only appended
+// if set or if the block commits to the log, so blocks built with the default strategy and no log hash as before.
+func (rb *RelayBlock) bytesV2() []byte {
+	buf := bytes.NewBuffer([]byte("GPRB"))
+	buf.WriteByte(rb.Version)
+	binary.Write(buf, binary.BigEndian, rb.Index)
+	binary.Write(buf, binary.BigEndian, rb.Epoch)
+	if rb.Rebuilt {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(buf, binary.BigEndian, rb.FabricBlockNumber)
+	binary.Write(buf, binary.BigEndian, rb.Timestamp)
+	fields := [][]byte{rb.BlockMerkleRoot, rb.BloomFilterHash, rb.PreviousBlockHash, rb.FabricBlockHash, []byte(rb.RelayID)}
+	if rb.HashStrategy != "" || len(rb.LogRoot) != 0 {
+		fields = append(fields, []byte(rb.HashStrategy))
+	}
+	if len(rb.LogRoot) != 0 {
+		fields = append(fields, rb.LogRoot)
+	}
+	for _, field := range fields {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	return buf.Bytes()
+}
+
+// block hash = sha256(block bytes)
+func (rb *RelayBlock) Hash() []byte {
+	sum := sha256.Sum256(rb.Bytes())
+	return sum[:]
+}
+
+// Binary encoding
+//
+// message = [2 byte magic "GP"] + [1 byte format version] + [1 byte message type] + fields
+// field   = [1 byte tag] + [uvarint length] + [value]
+//
+// Integers are uvarints inside the value, byte strings are stored as is. Repeated fields (signatures) repeat the tag.
+// Decoders skip tags they don't know so fields can be added without bumping the format version.
+
+const BinaryVersion = 1
+
+const (
+	TypeRelayBlock = byte(1)
+	TypeBloom = byte(2)
+)
+
+var magic = []byte("GP")
+
+// Relay block message tags
+const (
+	tagIndex = byte(1)
+	tagRoot = byte(2)
+	tagBloomHash = byte(3)
+	tagPrevious = byte(4)
+	tagEpoch = byte(5)
+	tagRebuilt = byte(6)
+	tagSig = byte(7)
+	tagBlockHash = byte(8)
+	tagVersion = byte(9)
+	tagFabricNumber = byte(10)
+	tagFabricHash = byte(11)
+	tagTimestamp = byte(12)
+	tagRelayID = byte(13)
+	tagHashStrategy = byte(14)
+	tagLogRoot = byte(15)
+)
+
+// Bloom message tags
+const (
+	tagBloomIndex = byte(1)
+	tagFilter = byte(2)
+	tagBloomEpoch = byte(3)
+)
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func newEncoder(msgType byte) *encoder {
+	e := &encoder{}
+	e.buf.Write(magic)
+	e.buf.WriteByte(BinaryVersion)
+	e.buf.WriteByte(msgType)
+	return e
+}
+
+func (e *encoder) bytes(tag byte, value []byte) {
+	var length [binary.MaxVarintLen64]byte
+	e.buf.WriteByte(tag)
+	e.buf.Write(length[:binary.PutUvarint(length[:], uint64(len(value)))])
+	e.buf.Write(value)
+}
+
+func (e *encoder) uint(tag byte, value uint64) {
+	var v [binary.MaxVarintLen64]byte
+	e.bytes(tag, v[:binary.PutUvarint(v[:], value)])
+}
+
+//Calls f for each field of a binary message of type msgType
+func decode(data []byte, msgType byte, f func(tag byte, value []byte) error) error {
+	if len(data) < 4 || !bytes.Equal(data[:2], magic) {
+		return errors.New("Not a binary relay message\n")
+	}
+	if data[2] != BinaryVersion {
+		return errors.New(fmt.Sprintf("Unsupported binary format version %d\n", data[2]))
+	}
+	if data[3] != msgType {
+		return errors.New(fmt.Sprintf("Unexpected message type %d, expected %d\n", data[3], msgType))
+	}
+	data = data[4:]
+	for len(data) != 0 {
+		tag := data[0]
+		length, n := binary.Uvarint(data[1:])
+		if n <= 0 || length > uint64(len(data)-1-n) {
+			return errors.New(fmt.Sprintf("Truncated field %d\n", tag))
+		}
+		start := 1 + n
+		if err := f(tag, data[start:start+int(length)]); err != nil {
+			return err
+		}
+		data = data[start+int(length):]
+	}
+	return nil
+}
+
+func decodeUint(tag byte, value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n <= 0 || n != len(value) {
+		return 0, errors.New(fmt.Sprintf("Invalid integer in field %d\n", tag))
+	}
+	return v, nil
+}
+
+//Copies value, decoded fields must not alias the message buffer
+func clone(value []byte) []byte {
+	return append([]byte{}, value...)
+}
+
+//Reports whether data starts with the binary message header (as opposed to JSON)
+func IsBinary(data []byte) bool {
+	return len(data) >= 4 && bytes.Equal(data[:2], magic)
+}
+
+func (m *RelayBlockMessage) MarshalBinary() ([]byte, error) {
+	e := newEncoder(TypeRelayBlock)
+	if m.Block.Version != 0 {
+		e.uint(tagVersion, uint64(m.Block.Version))
+	}
+	e.uint(tagIndex, m.Block.Index)
+	e.bytes(tagRoot, m.Block.BlockMerkleRoot)
+	e.bytes(tagBloomHash, m.Block.BloomFilterHash)
+	e.bytes(tagPrevious, m.Block.PreviousBlockHash)
+	if m.Block.Epoch != 0 {
+		e.uint(tagEpoch, m.Block.Epoch)
+	}
+	if m.Block.Rebuilt {
+		e.uint(tagRebuilt, 1)
+	}
+	if m.Block.HeaderVersion() >= RelayBlockV2 {
+		e.uint(tagFabricNumber, m.Block.FabricBlockNumber)
+		e.bytes(tagFabricHash, m.Block.FabricBlockHash)
+		e.uint(tagTimestamp, uint64(m.Block.Timestamp))
+		e.bytes(tagRelayID, []byte(m.Block.RelayID))
+		if m.Block.HashStrategy != "" {
+			e.bytes(tagHashStrategy, []byte(m.Block.HashStrategy))
+		}
+		if len(m.Block.LogRoot) != 0 {
+			e.bytes(tagLogRoot, m.Block.LogRoot)
+		}
+	}
+	for _, sig := range m.SigList {
+		e.bytes(tagSig, sig)
+	}
+	e.bytes(tagBlockHash, m.BlockHash)
+	return e.buf.Bytes(), nil
+}
+
+func (m *RelayBlockMessage) UnmarshalBinary(data []byte) error {
+	var msg RelayBlockMessage
+	seen := make(map[byte]bool)
+	err := decode(data, TypeRelayBlock, func(tag byte, value []byte) error {
+		var err error
+		if seen[tag] && tag != tagSig {
+			return errors.New(fmt.Sprintf("Duplicate field %d\n", tag))
+		}
+		seen[tag] = true
+		switch tag {
+		case tagIndex: msg.Block.Index, err = decodeUint(tag, value)
+		case tagRoot: msg.Block.BlockMerkleRoot = clone(value)
+		case tagBloomHash: msg.Block.BloomFilterHash = clone(value)
+		case tagPrevious: msg.Block.PreviousBlockHash = clone(value)
+		case tagEpoch: msg.Block.Epoch, err = decodeUint(tag, value)
+		case tagRebuilt:
+			var rebuilt uint64
+			rebuilt, err = decodeUint(tag, value)
+			msg.Block.Rebuilt = rebuilt != 0
+		case tagSig: msg.SigList = append(msg.SigList, clone(value))
+		case tagBlockHash: msg.BlockHash = clone(value)
+		case tagVersion:
+			var version uint64
+			version, err = decodeUint(tag, value)
+			if version > 0xff {
+				err = errors.New(fmt.Sprintf("Invalid relay block version %d\n", version))
+			}
+			msg.Block.Version = uint8(version)
+		case tagFabricNumber: msg.Block.FabricBlockNumber, err = decodeUint(tag, value)
+		case tagFabricHash: msg.Block.FabricBlockHash = clone(value)
+		case tagTimestamp:
+			var timestamp uint64
+			timestamp, err = decodeUint(tag, value)
+			msg.Block.Timestamp = int64(timestamp)
+		case tagRelayID: msg.Block.RelayID = string(value)
+		case tagHashStrategy: msg.Block.HashStrategy = string(value)
+		case tagLogRoot: msg.Block.LogRoot = clone(value)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, tag := range []byte{tagIndex, tagRoot, tagBloomHash, tagPrevious, tagBlockHash} {
+		if !seen[tag] {
+			return errors.New(fmt.Sprintf("Relay block message is missing field %d\n", tag))
+		}
+	}
+	*m = msg
+	return nil
+}
+
+func (m *BloomMessage) MarshalBinary() ([]byte, error) {
+	e := newEncoder(TypeBloom)
+	e.uint(tagBloomIndex, m.Index)
+	e.bytes(tagFilter, m.Filter)
+	if m.Epoch != 0 {
+		e.uint(tagBloomEpoch, m.Epoch)
+	}
+	return e.buf.Bytes(), nil
+}
+
+func (m *BloomMessage) UnmarshalBinary(data []byte) error {
+	var msg BloomMessage
+	seen := make(map[byte]bool)
+	err := decode(data, TypeBloom, func(tag byte, value []byte) error {
+		var err error
+		if seen[tag] {
+			return errors.New(fmt.Sprintf("Duplicate field %d\n", tag))
+		}
+		seen[tag] = true
+		switch tag {
+		case tagBloomIndex: msg.Index, err = decodeUint(tag, value)
+		case tagFilter: msg.Filter = clone(value)
+		case tagBloomEpoch: msg.Epoch, err = decodeUint(tag, value)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !seen[tagBloomIndex] || !seen[tagFilter] {
+		return errors.New("Bloom message is missing a required field\n")
+	}
+	*m = msg
+	return nil
+}
@@ -0,0 +1,156 @@
+package relayWire
+
+import (
+	"fmt"
+	"bytes"
+	"testing"
+	"crypto"
+	"crypto/rsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/willf/bloom"
+)
+
+//Compares the size and encode/decode cost of the JSON and binary encodings of relay broadcasts.
+//Messages are built the same way the relay builds them (SHA256 hashes, 2048 bit RSA signature, n=1000 p=0.000001 bloom filter).
+//Run with: go test -run NONE -bench . blockchain-service/relay/relayWire
+
+//n : number of items in bloom filter, p : probability of false positives
+const (
+	benchN = uint(1000)
+	benchP = 0.000001
+)
+
+type message interface {
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary([]byte) error
+}
+
+type benchCase struct {
+	name string
+	msg message
+	fresh func() message
+}
+
+func sampleBlock(key *rsa.PrivateKey, version uint8, epoch uint64) (*RelayBlockMessage, error) {
+	root := sha256.Sum256([]byte("root"))
+	bloomHash := sha256.Sum256([]byte("bloom"))
+	previous := sha256.Sum256([]byte("previous"))
+	blk := RelayBlock{Version: version, Index: 123456, BlockMerkleRoot: root[:], BloomFilterHash: bloomHash[:], PreviousBlockHash: previous[:], Epoch: epoch, Rebuilt: epoch != 0}
+	if version >= RelayBlockV2 {
+		fabricHash := sha256.Sum256([]byte("fabric"))
+		blk.FabricBlockNumber = 123457
+		blk.FabricBlockHash = fabricHash[:]
+		blk.Timestamp = 1560000000000000000
+		blk.RelayID = "relay1"
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, blk.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return &RelayBlockMessage{blk, [][]byte{sig}, blk.Hash()}, nil
+}
+
+func sampleBloom(revocations int) (*BloomMessage, error) {
+	filter := bloom.NewWithEstimates(benchN, benchP)
+	for i := 0; i < revocations; i++ {
+		certHash := sha256.Sum256([]byte(fmt.Sprintf("cert %d", i)))
+		filter.Add(certHash[:])
+	}
+	filterBuffer := bytes.NewBuffer([]byte{})
+	if _, err := filter.WriteTo(filterBuffer); err != nil {
+		return nil, err
+	}
+	return &BloomMessage{123456, filterBuffer.Bytes(), 1}, nil
+}
+
+func benchCases(b *testing.B) []benchCase {
+	var cases []benchCase
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatalf("Could not generate rsa key: %s", err)
+	}
+	for _, version := range []uint8{RelayBlockV1, RelayBlockV2} {
+		for _, epoch := range []uint64{0, 7} {
+			msg, err := sampleBlock(key, version, epoch)
+			if err != nil {
+				b.Fatalf("Could not build relay block: %s", err)
+			}
+			cases = append(cases, benchCase{fmt.Sprintf("RelayBlock/v%d/epoch%d", version, epoch), msg, func() message { return &RelayBlockMessage{} }})
+		}
+	}
+	for _, revocations := range []int{0, 100, 1000} {
+		msg, err := sampleBloom(revocations)
+		if err != nil {
+			b.Fatalf("Could not build bloom filter: %s", err)
+		}
+		cases = append(cases, benchCase{fmt.Sprintf("Bloom/%drevocations", revocations), msg, func() message { return &BloomMessage{} }})
+	}
+	return cases
+}
+
+func BenchmarkEncodeBinary(b *testing.B) {
+	for _, c := range benchCases(b) {
+		b.Run(c.name, func(b *testing.B) {
+			var data []byte
+			var err error
+			for i := 0; i < b.N; i++ {
+				if data, err = c.msg.MarshalBinary(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+		})
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	for _, c := range benchCases(b) {
+		b.Run(c.name, func(b *testing.B) {
+			var data []byte
+			var err error
+			for i := 0; i < b.N; i++ {
+				if data, err = json.Marshal(c.msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+		})
+	}
+}
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	for _, c := range benchCases(b) {
+		data, err := c.msg.MarshalBinary()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := c.fresh().UnmarshalBinary(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+		})
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	for _, c := range benchCases(b) {
+		data, err := json.Marshal(c.msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := json.Unmarshal(data, c.fresh()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package relayWire
+
+import (
+	"fmt"
+	"bytes"
+	"errors"
+	"crypto"
+	"crypto/rsa"
+)
+
+//Checks the header is well formed for its version
+func (rb *RelayBlock) CheckHeader() error {
+	switch rb.HeaderVersion() {
+	case RelayBlockV1:
+		//The v1 header only carries the low 32 bits of the index
+		if rb.Index > 0xffffffff {
+			return errors.New(fmt.Sprintf("Relay block %d: index does not fit a v1 header\n", rb.Index))
+		}
+		if rb.FabricBlockNumber != 0 || len(rb.FabricBlockHash) != 0 || rb.Timestamp != 0 || rb.RelayID != "" || rb.HashStrategy != "" || len(rb.LogRoot) != 0 {
+			return errors.New(fmt.Sprintf("Relay block %d: v1 header carries v2 fields\n", rb.Index))
+		}
+	case RelayBlockV2:
+		if len(rb.BlockMerkleRoot) == 0 {
+			return errors.New(fmt.Sprintf("Relay block %d: missing merkle root\n", rb.Index))
+		}
+		if len(rb.FabricBlockHash) == 0 {
+			return errors.New(fmt.Sprintf("Relay block %d: missing fabric block hash\n", rb.Index))
+		}
+		if rb.RelayID == "" {
+			return errors.New(fmt.Sprintf("Relay block %d: missing relay ID\n", rb.Index))
+		}
+	default:
+		return errors.New(fmt.Sprintf("Relay block %d: unknown header version %d\n", rb.Index, rb.Version))
+	}
+	return nil
+}
+
+//Checks rb directly follows previous. Headers may be upgraded from v1 to v2 but not downgraded, and v2 blocks must come
+//from the same relay and move forward in fabric block number and time.
+func (rb *RelayBlock) VerifyLink(previous *RelayBlock) error {
+	if rb.Index != previous.Index+1 {
+		return errors.New(fmt.Sprintf("Relay block %d does not follow relay block %d\n", rb.Index, previous.Index))
+	}
+	if !bytes.Equal(rb.PreviousBlockHash, previous.Hash()) {
+		return errors.New(fmt.Sprintf("Relay block %d: previous block hash does not match relay block %d\n", rb.Index, previous.Index))
+	}
+	if rb.HeaderVersion() < previous.HeaderVersion() {
+		return errors.New(fmt.Sprintf("Relay block %d: header version downgraded from %d to %d\n", rb.Index, previous.HeaderVersion(), rb.HeaderVersion()))
+	}
+	if rb.HeaderVersion() >= RelayBlockV2 && previous.HeaderVersion() >= RelayBlockV2 {
+		if rb.RelayID != previous.RelayID {
+			return errors.New(fmt.Sprintf("Relay block %d: relay ID changed from %s to %s\n", rb.Index, previous.RelayID, rb.RelayID))
+		}
+		if rb.HashStrategy != previous.HashStrategy {
+			return errors.New(fmt.Sprintf("Relay block %d: hash strategy changed from %q to %q\n", rb.Index, previous.HashStrategy, rb.HashStrategy))
+		}
+		if len(previous.LogRoot) != 0 && len(rb.LogRoot) == 0 {
+			return errors.New(fmt.Sprintf("Relay block %d: stopped committing to the block log\n", rb.Index))
+		}
+		if rb.FabricBlockNumber <= previous.FabricBlockNumber {
+			return errors.New(fmt.Sprintf("Relay block %d: fabric block number %d does not follow %d\n", rb.Index, rb.FabricBlockNumber, previous.FabricBlockNumber))
+		}
+		if rb.Timestamp < previous.Timestamp {
+			return errors.New(fmt.Sprintf("Relay block %d: timestamp is older than relay block %d\n", rb.Index, previous.Index))
+		}
+	}
+	return nil
+}
+
+//Checks the header, that BlockHash matches the block and that at least one signature in SigList is from key
+func (m *RelayBlockMessage) Verify(key *rsa.PublicKey) error {
+	if err := m.Block.CheckHeader(); err != nil {
+		return err
+	}
+	hash := m.Block.Hash()
+	if !bytes.Equal(hash, m.BlockHash) {
+		return errors.New(fmt.Sprintf("Relay block %d: block hash does not match block contents\n", m.Block.Index))
+	}
+	for _, sig := range m.SigList {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Relay block %d: no valid relay signature\n", m.Block.Index))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"sync/atomic"
+
+	"github.com/google/trillian/merkle/hashers"
+
+	"blockchain-service/blockchain"
+	"blockchain-service/relay/relayTypes"
+)
+
+//Source of processed fabric blocks. The relay reads them through the fabric sdk, tests can substitute a fake ledger.
+type ledger interface {
+	ProcessBlock(n uint64) (*relayTypes.ProcessedBlock, error)
+}
+
+type fabricLedger struct {
+	sdkLock *sync.Mutex //Must acquire before using fSetup
+	fSetup *blockchain.FabricSetup
+	hasher hashers.LogHasher // Hasher of the block merkle trees
+}
+
+func (l fabricLedger) ProcessBlock(n uint64) (*relayTypes.ProcessedBlock, error) {
+	return relayTypes.ProcessBlock(n, l.sdkLock, l.fSetup, l.hasher)
+}
+
+//Turns block events, which may arrive late, more than once or out of order, into an ordered stream of fabric blocks.
+//A single goroutine (Run) fetches every block from the next unapplied one up to the highest block seen and applies them
+//in order, so a gap of any size is filled without recursion or polling.
+type sequencer struct {
+	ledger ledger
+	apply func(*relayTypes.ProcessedBlock) error // Builds and publishes the relay block, on error the block is retried
+	events chan uint64
+	stop chan bool
+	stopped chan bool
+	retryInterval time.Duration
+
+	next uint64 // Next fabric block to apply, only written by the Run goroutine (use atomic loads elsewhere)
+	target uint64 // Highest fabric block seen in an event, only used by the Run goroutine
+}
+
+//Returns a sequencer starting at fabric block next. Close stop to end Run.
+func newSequencer(l ledger, apply func(*relayTypes.ProcessedBlock) error, next uint64, stop chan bool) *sequencer {
+	return &sequencer{
+		ledger:        l,
+		apply:         apply,
+		events:        make(chan uint64, 64),
+		stop:          stop,
+		stopped:       make(chan bool),
+		retryInterval: 5 * time.Second,
+		next:          next,
+	}
+}
+
+//Queues a block event for fabric block n, safe to call from any goroutine
+func (s *sequencer) Notify(n uint64) {
+	select {
+	case s.events <- n:
+	case <-s.stop:
+	}
+}
+
+//Next fabric block to apply, the block listener resumes from here after a reconnect
+func (s *sequencer) Next() uint64 {
+	return atomic.LoadUint64(&s.next)
+}
+
+//Applies blocks in order until stop is closed. If a block can't be fetched or applied it is retried after retryInterval
+//(or on the next event).
+func (s *sequencer) Run() {
+	defer close(s.stopped)
+	retry := time.NewTimer(s.retryInterval)
+	retry.Stop()
+	defer retry.Stop()
+
+	for true {
+		select {
+		case n := <-s.events:
+			if n < s.next {
+				fmt.Printf("Sequencer: Fabric Block %d already applied, ignoring event\n", n)
+				continue
+			}
+			if n > s.target {
+				s.target = n
+			}
+		case <-retry.C:
+		case <-s.stop:
+			return
+		}
+
+		if err := s.catchUp(); err != nil {
+			fmt.Printf("Sequencer: Could not apply Fabric Block %d, retrying in %s: %s\n", s.next, s.retryInterval, err)
+			retry.Stop()
+			retry.Reset(s.retryInterval)
+		}
+	}
+}
+
+//Applies fabric blocks next to target
+func (s *sequencer) catchUp() error {
+	for s.next <= s.target {
+		select {
+		case <-s.stop:
+			return nil
+		default:
+		}
+		if s.target != s.next {
+			fmt.Printf("Sequencer: Processing Fabric Block: %d (up to %d)\n", s.next, s.target)
+		}
+		processed, err := s.ledger.ProcessBlock(s.next)
+		if err != nil {
+			return err
+		}
+		if err = s.apply(processed); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.next, 1)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"testing"
+
+	"blockchain-service/relay/relayTypes"
+)
+
+//Ledger that serves empty blocks and fails fetching a block as often as listed in failures
+type fakeLedger struct {
+	lock sync.Mutex
+	fetched []uint64
+	failures map[uint64]int
+}
+
+func (l *fakeLedger) ProcessBlock(n uint64) (*relayTypes.ProcessedBlock, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.fetched = append(l.fetched, n)
+	if l.failures[n] > 0 {
+		l.failures[n]--
+		return nil, fmt.Errorf("fetch of block %d failed", n)
+	}
+	return &relayTypes.ProcessedBlock{Number: n}, nil
+}
+
+//Records the blocks applied, failing a block as often as listed in failures
+type recorder struct {
+	lock sync.Mutex
+	applied []uint64
+	attempts map[uint64]int
+	failures map[uint64]int
+}
+
+func (r *recorder) apply(block *relayTypes.ProcessedBlock) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.attempts[block.Number]++
+	if r.failures[block.Number] > 0 {
+		r.failures[block.Number]--
+		return fmt.Errorf("apply of block %d failed", block.Number)
+	}
+	r.applied = append(r.applied, block.Number)
+	return nil
+}
+
+func newTestSequencer(next uint64) (*sequencer, *fakeLedger, *recorder, chan bool) {
+	l := &fakeLedger{failures: map[uint64]int{}}
+	r := &recorder{attempts: map[uint64]int{}, failures: map[uint64]int{}}
+	stop := make(chan bool)
+	s := newSequencer(l, r.apply, next, stop)
+	s.retryInterval = 10 * time.Millisecond
+	return s, l, r, stop
+}
+
+//Waits until the sequencer's next block is next, then stops it
+func waitAndStop(t *testing.T, s *sequencer, stop chan bool, next uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Next() != next && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	//Give stray events a chance to be (wrongly) applied
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	<-s.stopped
+	if s.Next() != next {
+		t.Fatalf("Next is %d, want %d", s.Next(), next)
+	}
+}
+
+func checkApplied(t *testing.T, r *recorder, first, last uint64) {
+	if len(r.applied) != int(last-first+1) {
+		t.Fatalf("Applied %d blocks, want %d (%d to %d)", len(r.applied), last-first+1, first, last)
+	}
+	for i, n := range r.applied {
+		if n != first+uint64(i) {
+			t.Fatalf("Block %d applied at position %d, want %d", n, i, first+uint64(i))
+		}
+	}
+}
+
+func TestSequencerReversedOrder(t *testing.T) {
+	s, _, r, stop := newTestSequencer(3)
+	go s.Run()
+	for n := uint64(7); n >= 3; n-- {
+		s.Notify(n)
+	}
+	waitAndStop(t, s, stop, 8)
+	checkApplied(t, r, 3, 7)
+}
+
+func TestSequencerDuplicateEvents(t *testing.T) {
+	s, l, r, stop := newTestSequencer(3)
+	go s.Run()
+	for _, n := range []uint64{3, 3, 4, 4, 3, 5, 4, 5} {
+		s.Notify(n)
+	}
+	waitAndStop(t, s, stop, 6)
+	checkApplied(t, r, 3, 5)
+	if len(l.fetched) != 3 {
+		t.Fatalf("Fetched %v, want every block once", l.fetched)
+	}
+}
+
+func TestSequencerAppliedEvent(t *testing.T) {
+	s, l, r, stop := newTestSequencer(10)
+	go s.Run()
+	s.Notify(5)
+	s.Notify(9)
+	s.Notify(10)
+	s.Notify(2)
+	waitAndStop(t, s, stop, 11)
+	checkApplied(t, r, 10, 10)
+	if len(l.fetched) != 1 {
+		t.Fatalf("Fetched %v, want only block 10", l.fetched)
+	}
+}
+
+func TestSequencerLargeGap(t *testing.T) {
+	s, _, r, stop := newTestSequencer(3)
+	go s.Run()
+	s.Notify(10003)
+	waitAndStop(t, s, stop, 10004)
+	checkApplied(t, r, 3, 10003)
+}
+
+func TestSequencerRetry(t *testing.T) {
+	s, l, r, stop := newTestSequencer(3)
+	l.failures[4] = 2
+	r.failures[5] = 1
+	go s.Run()
+	//No further events, the retry timer alone has to get past blocks 4 and 5
+	s.Notify(6)
+	waitAndStop(t, s, stop, 7)
+	checkApplied(t, r, 3, 6)
+	if r.attempts[4] != 1 || r.attempts[5] != 2 {
+		t.Fatalf("Block 4 applied %d times, block 5 %d times, want 1 and 2", r.attempts[4], r.attempts[5])
+	}
+	fetches := 0
+	for _, n := range l.fetched {
+		if n == 4 {
+			fetches++
+		}
+	}
+	if fetches != 3 {
+		t.Fatalf("Block 4 fetched %d times, want 3", fetches)
+	}
+}
@@ -3,13 +3,17 @@
  * Each transaction must have 3 arguments:
  * 1. Merkle Tree of certificates
  * 2. List of revocations, where a revocation consists of:
-      a. Merkle Path to a certificate
+      a. Merkle Path to a certificate (under its batch root, and of the batch root under its relay block root)
 	  b. Certificate body
+	  c. PCN of the revoker, carrying the signed revocation statement (revocation, suspension or
+	     reinstatement, see blockchain/revocation.go)
    3. Current Time
  *
  * Chaincode will endorse this if:
  * 1. Merkle Tree of certificates has leaves that are parsable x509 certificates
- * 2. Revocations refer to published certificates that are not expired
+ * 2. Revocations refer to published certificates (included under a batch root in the world state, see
+ *    blockchain.ProofFile.Verify) that are not expired, their statements are
+ *    signed by the revoker they name, are about the certificate and don't take effect after Current Time
  * 3. Current Time = system time +- 12 hours
  *
  *
@@ -145,11 +149,22 @@ func pub(stub shim.ChaincodeStubInterface, args []string) (string, error) {
 		fmt.Printf("Revocation: %s\n", r.PCN)
 		//abbreviatedRevokeList = append(abbreviatedRevokeList, r.CertData) //change to r.PCN
 		abbreviatedRevokeList = append(abbreviatedRevokeList, r.PCN)
-		if val, err := stub.GetState(url.QueryEscape(string(r.PubValidationInfo.MerkleRoot))); (val == nil && err == nil) {
-			return "", errors.New(fmt.Sprintf("Merkle Root For Certificate Not Found in Ledger: %s", err))
+		if err = verifyPublished(stub, &r); err != nil {
+			return "", err
 		}
-		if err = blockchain.VerifyMerkleProof(r.PubValidationInfo.LeafIndex, r.PubValidationInfo.NumLeaves, r.PubValidationInfo.MerkleRoot, r.CertData, r.PubValidationInfo.Proof); err != nil {
-			return "", errors.New(fmt.Sprintf("Merkle Root For Certificate Found in Ledger, but Could Not Verify Inclusion: %s", err))
+		pcn, err := blockchain.ParsePCN(r.PCN)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Could Not Parse Revocation PCN: %s", err))
+		}
+		statement, err := pcn.VerifyRevocation()
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Invalid Revocation Statement: %s", err))
+		}
+		if !bytes.Equal(statement.Cert.Raw, r.CertData) {
+			return "", errors.New("Revocation Statement Is For a Different Certificate")
+		}
+		if statement.Effective.Unix() > timestamp + (timestampWindow * 60) {
+			return "", fmt.Errorf("%s of %s takes effect after the transaction time", statement.Action, statement.Cert.Subject.CommonName)
 		}
 	}
 	fmt.Printf("...Confirmed\n")
@@ -172,6 +187,47 @@ func pub(stub shim.ChaincodeStubInterface, args []string) (string, error) {
 	return "Hooray", nil
 }
 
+// Batch roots published in the world state
+
+type worldState struct {
+	stub shim.ChaincodeStubInterface
+}
+
+func (ws worldState) BatchPublished(root []byte) error {
+	val, err := ws.stub.GetState(url.QueryEscape(string(root)))
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return errors.New("Merkle Root Not Found in Ledger")
+	}
+	return nil
+}
+
+// Checks the revoked cert is included under its batch root, and the batch root is published. The chaincode can't rebuild
+// relay block roots, so the batch root is looked up in the world state.
+
+func verifyPublished(stub shim.ChaincodeStubInterface, r *blockchain.Revocation) error {
+	cert, err := x509.ParseCertificate(r.CertData)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could Not Parse Revoked Certificate: %s", err))
+	}
+	batch := r.PubValidationInfo
+	batch.BlockIndex = r.BroadcastValidationInfo.BlockIndex
+	pcn := &blockchain.ProofFile{Certs: []*x509.Certificate{cert}, ProofList: &blockchain.ProofList{ProofList: []blockchain.ValidationInfo{r.BroadcastValidationInfo}}, BatchProofs: []blockchain.ValidationInfo{batch}}
+	report, err := pcn.Verify(blockchain.VerifyContext{Batches: worldState{stub}})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid Proof of Publication: %s", err))
+	}
+	if err = report.Certs[0].Batch; err != nil {
+		return errors.New(fmt.Sprintf("Could Not Verify Inclusion of Certificate Under Merkle Root: %s", err))
+	}
+	if err = report.Certs[0].Block; err != nil {
+		return errors.New(fmt.Sprintf("Merkle Root For Certificate Not Published: %s", err))
+	}
+	return nil
+}
+
 // Get returns the paylaod for a merkle root
 
 func get(stub shim.ChaincodeStubInterface, args []string) (string, error) {
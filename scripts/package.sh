@@ -18,25 +18,41 @@ mkdir ./build/go/src/blockchain-service/permission-marshal ./build/go/src/blockc
 cp -r ./go/src/blockchain-service/permission-marshal/app/{assets,components,app.js,index.html,package.json,package-lock.json} ./build/go/src/blockchain-service/permission-marshal/app
 cp -r ./go/src/blockchain-service/permission-marshal/{certs,policy-eval,crypto-config} ./build/go/src/blockchain-service/permission-marshal/
 cp ./go/src/blockchain-service/permission-marshal/base.config.yaml ./build/go/src/blockchain-service/permission-marshal/config.yaml
+cp ./go/src/blockchain-service/permission-marshal/federation.json ./build/go/src/blockchain-service/permission-marshal/federation.json
 cd ./go/src/blockchain-service/permission-marshal/
 govendor update +vendor
 cd $DIR
-go build ./go/src/blockchain-service/permission-marshal/server.go
+go build -o ./server ./go/src/blockchain-service/permission-marshal/
 mv $DIR/go/src/blockchain-service/policy-evaluator/main $DIR/build/go/src/blockchain-service/permission-marshal/policy-eval/policy-eval
 mv $DIR/go/src/blockchain-service/bloom-filter-reader/bloomTest $DIR/build/go/src/blockchain-service/permission-marshal/policy-eval/bloomTest
 mv ./server ./build/go/src/blockchain-service/permission-marshal/
+go build -o ./availability-store ./go/src/blockchain-service/permission-marshal/availability-store/
+mv ./availability-store ./build/go/src/blockchain-service/permission-marshal/
+go build -o ./pcn-convert ./go/src/blockchain-service/permission-marshal/pcn-convert/
+mv ./pcn-convert ./build/go/src/blockchain-service/permission-marshal/
 echo "...Done"
 
 echo "Building Relay..."
 mkdir ./build/go/src/blockchain-service/relay
 cp -r ./go/src/blockchain-service/relay/{certs,crypto-config} ./build/go/src/blockchain-service/relay
 cp ./go/src/blockchain-service/relay/base.config.1.yaml ./build/go/src/blockchain-service/relay/config.1.yaml
+cp ./go/src/blockchain-service/relay/relay.yaml ./build/go/src/blockchain-service/relay/relay.yaml
 cp ./go/src/blockchain-service/policy-evaluator/pb.txt ./build/go/src/blockchain-service/relay/pb.txt
 cd ./go/src/blockchain-service/relay/
 govendor update +vendor
 cd $DIR
-go build ./go/src/blockchain-service/relay/main.go
+go build -o ./main ./go/src/blockchain-service/relay/
 mv ./main ./build/go/src/blockchain-service/relay/relay
+go build ./go/src/blockchain-service/relay/relay-audit/main.go
+mv ./main ./build/go/src/blockchain-service/relay/relay-audit
+go build -o ./gpc-replay ./go/src/blockchain-service/relay/gpc-replay/
+mv ./gpc-replay ./build/go/src/blockchain-service/relay/
+go build -o ./permission-monitor ./go/src/blockchain-service/relay/permission-monitor/
+mv ./permission-monitor ./build/go/src/blockchain-service/relay/
+cp ./go/src/blockchain-service/relay/permission-monitor/monitor.yaml ./build/go/src/blockchain-service/relay/monitor.yaml
+mkdir ./build/go/src/blockchain-service/relay/policy-eval
+cp ./build/go/src/blockchain-service/permission-marshal/policy-eval/policy-eval ./build/go/src/blockchain-service/relay/policy-eval/
+cp ./go/src/blockchain-service/policy-evaluator/pb.txt ./build/go/src/blockchain-service/relay/policy-eval/pb.txt
 echo "...Done"
 
 echo "Copying Chaincode Source to build directory..."